@@ -2,16 +2,20 @@ package main
 
 import (
 	"bufio"
+	"client"
+	"context"
 	"encoding/xml"
-	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"message"
 	"net"
 	"net/url"
 	"os"
+	"secure"
+	"server"
+	"store"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -20,61 +24,13 @@ import (
 )
 
 const (
-	DEFAULT_ADDR        = "127.0.0.1:1200"
-	MULTICAST_PORT      = "224.0.1.60:1888"
-	MAX_USR             = 50000
-	MAX_CONN            = 5000
-	MILIS_BETWEEN_RETRY = 200
-	MAX_RETRY           = 3
-	BLOCKED_INITIAL     = 10
-	TIME_BETWEEN_CLOCK  = 10
+	DEFAULT_ADDR   = "127.0.0.1:1200"
+	MULTICAST_PORT = "224.0.1.60:1888"
 )
 
-// Each incoming connection will have a message with whatever they want to send
-// and who sent it
-type Message struct {
-	Content   []byte
-	Sender    *net.UDPAddr
-	Timestamp time.Time
-}
-
-// ******** Server stuff  ******** //
-// Map of aliases
-var users map[string]*User
-
-// Map of addresses
-var connections map[string]*User
-var serverConn *net.UDPConn
-
-var areWeGettingClocks bool
-var userClocks []clockMessage
-
-type InternalMessage struct {
-	Type      message.Type
-	Content   *message.UserPackage
-	Sender    *net.UDPAddr
-	Timestamp time.Time
-}
-
-type User struct {
-	Alias   string
-	Address *net.UDPAddr
-	Online  bool
-	Blocked []string
-	Pending [][]byte
-}
-
-type clockMessage struct {
-	User       *net.UDPAddr
-	Offset     *time.Duration
-	Timestamp  *time.Time
-	ServerTime *time.Time
-}
-
 // ******** Client stuff  ******** //
 // Global
-// Now just a map of addresses
-var clientConn *net.UDPConn
+var chat *client.Client
 var GlobalPort string
 
 // A petition to start the server. For now just holds the port to connect to
@@ -82,16 +38,11 @@ type ServerPetition struct {
 	Port string
 }
 
-var myAlias string
-var myTime time.Time
-var myAddress int // Useful when electing new server
-
 var noServer bool
 var inVotingProcess bool
 
 var startServer chan ServerPetition
 var stopServer chan ServerPetition
-var sendingChannel chan []byte
 
 // Thins to look for when electing a new server
 var listenMulticast *net.UDPConn
@@ -99,6 +50,21 @@ var writeMulticast *net.UDPConn
 var multicastAddr *net.UDPAddr
 var otherClientsAddress map[int]bool
 
+// The last search, so /search more goes on from where it was
+var lastSearch struct {
+	sync.Mutex
+	query client.SearchQuery
+	last  string // Id of the last result, empty if there are no more
+}
+
+// The last history we got, so /history more goes further back
+var lastHistory struct {
+	sync.Mutex
+	with   string
+	limit  int
+	oldest string // Id of the oldest one we got, empty if there are no more
+}
+
 // Brain rant
 // We need to get several channels
 // Server:
@@ -120,18 +86,33 @@ var otherClientsAddress map[int]bool
 // To check if a user is connected don't just reserve logins. Use the login message to map a user to a connection,
 // but a user can connect from multiple addresses. Is just as a login without passwords ;)
 func init() {
-	users = make(map[string]*User, MAX_USR)
-	connections = make(map[string]*User, MAX_CONN)
 	startServer = make(chan ServerPetition, 1)
 	stopServer = make(chan ServerPetition, 1)
-	sendingChannel = make(chan []byte)
-	userClocks = make([]clockMessage, 1)
 	otherClientsAddress = make(map[int]bool, 1)
 }
 
+// What -encrypt can say
+var encryptions = map[string]client.Encryption{
+	"auto":   client.ENCRYPT_IF_POSSIBLE,
+	"always": client.ENCRYPT_ALWAYS,
+	"never":  client.ENCRYPT_NEVER,
+}
+
 func main() {
 	portPtr := flag.String("port", DEFAULT_ADDR, "port to bind to")
 	serverPtr := flag.Bool("s", false, "Wheter this instance should become the server")
+	reorderPtr := flag.Duration("reorder-wait", 2*time.Second, "How long to wait for a missing message before skipping it")
+	codecPtr := flag.String("codec", message.CODEC_XML, "What to talk with the server: xml, json or binary")
+	securePtr := flag.Bool("secure", false, "Encrypt everything we send to the server")
+	identityPtr := flag.String("identity", "", "Sign what we send and encrypt direct messages and files end to end, with the identity in this file")
+	encryptPtr := flag.String("encrypt", "auto", "With an identity, when direct messages and files are encrypted: auto if the other one has a key, always or never")
+	pinsPtr := flag.String("pins", "pins.json", "Where to keep the keys we trust for each user")
+	serverPinsPtr := flag.String("server-pins", "servers.json", "Where to keep the keys we trust for each server")
+	serverKeyPtr = flag.String("server-key", "server.key", "Where the server keeps the key it signs secure handshakes with")
+	accountsPtr = flag.String("accounts", "accounts.json", "Where the server keeps the registered nicknames")
+	storePtr = flag.String("store", "store.log", "Where the server keeps the users, what they blocked and the messages waiting for them")
+	channelPtr = flag.String("channel", server.DEFAULT_CHANNEL, "Where the server puts the messages that don't say a channel, everyone is in it")
+	operatorsPtr = flag.String("operators", "", "Registered nicknames, separated by commas, that are operators of the default channel")
 	flag.Parse()
 
 	// Start logger
@@ -147,9 +128,7 @@ func main() {
 	shouldBeServer := *serverPtr
 	port := *portPtr
 	GlobalPort = port
-	confirmationChan := make(chan []byte)
 	go serverControl()
-	go sendDataToServer(sendingChannel, confirmationChan)
 	if shouldBeServer {
 		s := ServerPetition{port}
 		startServer <- s
@@ -180,50 +159,48 @@ func main() {
 	listenMulticast = conn
 	writeMulticast = lconn
 	multicastAddr = mcaddr
-	// Always create a client
-	go listenOutage(listenMulticast)
-	client(port, confirmationChan)
-}
-
-// ******** Client functions  ******** //
-
-// ****** Starting the client  ****** //
-// client Dials in the server and starts the functions that deal with
-// recieving user input and sending to the server
-func client(port string, confirmation chan []byte) {
-	log.Println("Starting client")
-	retries := 3
-	var err error
-	var con net.Conn
-	var conn *net.UDPConn
-	for ; retries > 0; retries-- {
-		con, err = net.Dial("udp", port)
-		if con == nil {
-			continue
-		}
-		conn = con.(*net.UDPConn)
-		if err == nil {
-			break
-		} else {
-			// Give some time to the server to setup
-			time.Sleep(500 * time.Millisecond)
-			log.Println("Failing because", err)
+	var identity *secure.Identity
+	if *identityPtr != "" {
+		identity, err = secure.LoadIdentity(*identityPtr)
+		if err != nil {
+			log.Fatal("Couldn't load the identity in ", *identityPtr, err)
 		}
 	}
-
-	if retries == 0 {
+	encryption, ok := encryptions[*encryptPtr]
+	if !ok {
+		log.Fatal("-encrypt is auto, always or never, not ", *encryptPtr)
+	}
+	pins, err := secure.LoadPins(*pinsPtr)
+	if err != nil {
+		log.Fatal("Couldn't load the keys in ", *pinsPtr, err)
+	}
+	serverPins, err := secure.LoadPins(*serverPinsPtr)
+	if err != nil {
+		log.Fatal("Couldn't load the keys in ", *serverPinsPtr, err)
+	}
+	// Always create a client
+	chat = client.New(client.Config{
+		ServerAddr:  port,
+		Codecs:      []string{*codecPtr, message.CODEC_XML},
+		ReorderWait: *reorderPtr,
+		Secure:      *securePtr,
+		Identity:    identity,
+		Encryption:  encryption,
+		Pins:        pins,
+		ServerPins:  serverPins,
+	})
+	err = chat.Dial()
+	if err != nil {
 		// If we couldn't create a client we are useless
 		log.Fatal("Couldn't connect to port", port, err)
 	}
-	myTime = time.Now()
-	clientConn = conn
-	c := make(chan []byte)
-	go listenClient(clientConn, c)
-	go handleClient(c, confirmation)
-	go updateClock(&myTime, time.Second*3)
+	go listenOutage(listenMulticast)
+	go showEvents(chat.Events())
 	getUserInput()
 }
 
+// ******** Client functions  ******** //
+
 func listenOutage(conn *net.UDPConn) {
 	for {
 		b := make([]byte, 256)
@@ -241,7 +218,7 @@ func listenOutage(conn *net.UDPConn) {
 			}
 			address := m.VoteMessage.Number
 			fmt.Println("Got this address", address)
-			if address != myAddress {
+			if address != chat.Address() {
 				// Add Adress to list of known address
 				otherClientsAddress[address] = true
 				fmt.Println("Known address", otherClientsAddress)
@@ -255,81 +232,63 @@ func listenOutage(conn *net.UDPConn) {
 	}
 }
 
-// ****** Client time  ****** //
-// Since the time is not tied to the computer clock it needs to be updated
-// each n time
-func updateClock(clock *time.Time, period time.Duration) {
-	c := time.Tick(period)
-	mutex := sync.Mutex{}
-	for _ = range c {
-		mutex.Lock()
-		*clock = clock.Add(period)
-		mutex.Unlock()
-	}
-}
+// ****** Controlling the server  ****** //
+// The server we run when we are elected, kept between a stop and a start
+// so the users are still there
+var srv *server.Server
 
-func updateClockWithOffset(offset time.Duration) {
-	log.Println("[Client] Updating clock with new offset", offset)
-	// TODO probably add a global mutex to this var
-	myTime = myTime.Add(offset)
-}
+// Where it keeps the accounts
+var accountsPtr *string
+
+// Where it keeps the users, so they are there after a restart or when
+// another one is elected on the same machine
+var storePtr *string
+
+// The key it signs the secure handshakes with, the same for every server
+// on the machine so clients that pinned it still trust who takes over
+var serverKeyPtr *string
+
+// The channel everyone is in, and who moderates it
+var channelPtr *string
+var operatorsPtr *string
 
-// ****** Controlling the server  ****** //
 func serverControl() {
 	for {
 		select {
 		case b := <-startServer:
-			conn := initServer(b.Port)
-			serverConn = conn
-			defer conn.Close()
-
-			// Handle incoming messages and loop forever
-			go handleIncoming()
+			if srv == nil {
+				st, err := store.OpenFile(*storePtr)
+				if err != nil {
+					log.Println("[Client] Couldn't open the store, reason", err.Error())
+					continue
+				}
+				identity, err := secure.LoadIdentity(*serverKeyPtr)
+				if err != nil {
+					log.Println("[Client] Couldn't load the server key, reason", err.Error())
+					continue
+				}
+				var operators []string
+				if *operatorsPtr != "" {
+					operators = strings.Split(*operatorsPtr, ",")
+				}
+				srv = server.New(server.Config{Addr: b.Port, Accounts: *accountsPtr, Store: st, DefaultChannel: *channelPtr, Operators: operators, Identity: identity})
+			}
+			err := srv.Start(context.Background())
+			if err != nil {
+				log.Println("[Client] Couldn't start the server, reason", err.Error())
+			}
 
 		case <-stopServer:
-			killServer()
-		}
-	}
-}
-
-func initServer(port string) *net.UDPConn {
-	log.Println("[Server] Starting server")
-	udpAddress, err := net.ResolveUDPAddr("udp4", port)
-	if err != nil {
-		log.Fatal("[Server] error resolving UDP address on ", port, err)
-	}
-	conn, err := net.ListenUDP("udp", udpAddress)
-	if err != nil {
-		log.Fatal("[Server] error listening on UDP port ", port, err)
-	}
-	go sendTimeRequest(time.Second * TIME_BETWEEN_CLOCK)
-	go sendAddresses(time.Second*10, 20)
-	log.Println("[Server] Listening on ", udpAddress)
-	return conn
-}
-
-func killServer() {
-	var retries int32
-	var err error
-	// Sanity check
-	if serverConn == nil {
-		log.Println("[Client] Trying to stop a non started server!")
-		return
-	}
-	for retries = 3; retries > 0; retries-- {
-		err = serverConn.Close()
-		if err == nil {
-			break
+			if srv == nil || srv.Stop() != nil {
+				log.Println("[Client] Trying to stop a non started server!")
+			}
 		}
-		time.Sleep(500 * time.Millisecond)
-	}
-	if retries == 0 {
-		panic("Couldn't stop the server, reason" + err.Error())
 	}
 }
 
 func startVotingAlgorithm() {
 	inVotingProcess = true
+	myAddress := chat.Address()
 	broadcastMessageWithMyPid(myAddress)
 
 	// Give some time to collect messages
@@ -348,7 +307,7 @@ func startVotingAlgorithm() {
 
 func startBecomingTheServer() {
 	// ? Send message saying that I'm the new server
-	msga := message.NewCoordinatorMessage(string(myAddress))
+	msga := message.NewCoordinatorMessage(string(chat.Address()))
 	mmm, _ := xml.Marshal(msga)
 	writeMulticast.WriteToUDP(mmm, multicastAddr)
 	fmt.Println("NOW I AM BECOME DEATH")
@@ -366,7 +325,7 @@ func stopVotingProcess() {
 		delete(otherClientsAddress, key)
 	}
 	// Send your alias again
-	handleUserInput("/nick " + myAlias)
+	chat.Reconnect()
 }
 
 func broadcastMessageWithMyPid(myaddr int) {
@@ -378,100 +337,232 @@ func broadcastMessageWithMyPid(myaddr int) {
 	}
 }
 
-// ****** Listen messages from the server  ****** //
-func listenClient(conn *net.UDPConn, c chan<- []byte) {
-	buff := make([]byte, 1024)
-	for {
-		n, addr, err := conn.ReadFromUDP(buff)
-		if n > 0 && addr != nil {
-			// Copy the response
-			res := make([]byte, n)
-
-			// Trim newline
-			if string(buff[n-1]) == "\n" {
-				copy(res, buff[:n-1])
+// ****** Showing what the server says  ****** //
+// showEvents prints whatever comes from the server
+func showEvents(events <-chan client.Event) {
+	for e := range events {
+		switch e.Type {
+		case client.ERROR_E:
+			showError(e.Error)
+
+		case client.DM_E:
+			if e.Encrypted {
+				fmt.Println(e.Time.Format("15:04:05"), "Encrypted message from ", e.From, "[", e.Fingerprint, "]"+signatureNote(e.Signature)+": ", e.Message)
+				continue
+			}
+			fmt.Println(e.Time.Format("15:04:05"), "Message from ", e.From, signatureNote(e.Signature)+": ", e.Message)
+
+		case client.BROADCAST_E:
+			fmt.Println(e.Time.Format("15:04:05"), "Broadcast from ", e.From, inChannel(e.Channel)+signatureNote(e.Signature)+": ", e.Message)
+
+		case client.TOPIC_E:
+			if e.Message == "" {
+				fmt.Println(e.Channel, "has no topic, set one with /topic", e.Channel, "something")
+				continue
+			}
+			fmt.Println("Topic of", e.Channel, "set by", e.From+":", e.Message)
+
+		case client.CHANNELS_E:
+			fmt.Println("Channels")
+			for _, ch := range e.Channels {
+				fmt.Println("-", ch.Name, ch.Modes, "("+strconv.Itoa(ch.Members), "online)", ch.Topic)
+			}
+
+		case client.KICK_E:
+			fmt.Println(e.Time.Format("15:04:05"), e.From, "kicked", e.Kick.Nickname, "out of", e.Channel, e.Kick.Reason)
+
+		case client.BAN_E:
+			if e.Ban.Remove {
+				fmt.Println(e.Time.Format("15:04:05"), e.From, "lifted the ban on", e.Ban.Mask, "in", e.Channel)
+				continue
+			}
+			fmt.Println(e.Time.Format("15:04:05"), e.From, "banned", e.Ban.Mask, "from", e.Channel)
+
+		case client.MUTE_E:
+			if e.Mute.Remove {
+				fmt.Println(e.Time.Format("15:04:05"), e.From, "let", e.Mute.Nickname, "talk again in", e.Channel)
+				continue
+			}
+			fmt.Println(e.Time.Format("15:04:05"), e.From, "muted", e.Mute.Nickname, "in", e.Channel, "for", e.Mute.For)
+
+		case client.INVITE_E:
+			fmt.Println(e.Time.Format("15:04:05"), e.From, "invited you to", e.Channel+", come in with /join", e.Channel)
+
+		case client.MODE_E:
+			if e.From == "" {
+				fmt.Println("Modes of", e.Channel+":", e.Mode.Mode, "bans:", strings.Join(e.Mode.Bans, " "))
+				continue
+			}
+			fmt.Println(e.Time.Format("15:04:05"), e.From, "set", e.Mode.Mode, e.Mode.Nickname, "in", e.Channel)
+
+		case client.RECEIPT_E:
+			if e.Receipt.Status == message.RECEIPT_DELIVERED {
+				fmt.Println(e.Time.Format("15:04:05"), e.Receipt.To, "got what you sent him while he was offline")
 			} else {
-				copy(res, buff[:n])
+				fmt.Println(e.Time.Format("15:04:05"), "What you sent", e.Receipt.To, "while he was offline expired before he came back")
 			}
-			c <- res
-		}
-		if err != nil {
-			fmt.Println("[Client] Error reading from server", err)
-		}
-	}
-}
 
-func handleClient(c <-chan []byte, confirmation chan<- []byte) {
-	for {
-		b := <-c
-		log.Println("[Client] From handle client", string(b))
-		if message.IsConfirmation(b) {
-			confirmation <- b
-			continue
-		}
-		t, m, err := message.DecodeServerMessage(b)
-		if err != nil {
-			fmt.Println("[Client] Error reading XML from server")
-			fmt.Println("[Client] Got", string(b))
-			log.Println("[Client] ", err.Error())
-			continue
-		}
-		switch t {
-		case message.ERROR_T:
-			log.Println("[Client] Error from server:", m.Error.Message)
-
-		case message.LOGIN_RES_T:
-			// Update your address
-			myAddress = m.Login.Address
-			log.Println("[Client] My address is", myAddress)
-
-		case message.DM_T:
-			msg := m.Direct
-			fmt.Println(myTime.Format("15:04:05"), "Message from ", msg.From, ": ", msg.Message)
-		case message.BROAD_T:
-			msg := m.Direct
-			fmt.Println(myTime.Format("15:04:05"), "Broadcast from ", msg.From, ": ", msg.Message)
-
-		case message.GET_CONN_T:
-			msg := m.Connected
+		case client.USERS_E:
 			fmt.Println("Connected users")
-			users := msg.Users.ConnUsers
-			for _, usr := range users {
+			for _, usr := range e.Users {
 				fmt.Println("-", usr)
 			}
 
-		case message.FILE_T:
-			msg := m.File
-			switch msg.Kind {
+		case client.FILE_E:
+			switch e.File.Kind {
 			// TODO Check blocked
 			case message.FILETRANSFER_START:
-				createFile(msg.Filename)
+				fmt.Println("Getting", e.File.Filename, "from", e.From+signatureNote(e.Signature))
+				createFile(e.File.Filename)
 			case message.FILETRANSFER_MID:
-				writeToFile(msg.Filename, msg.Cont)
+				if e.Signature != client.SIGNED && e.Signature != client.UNSIGNED {
+					fmt.Println("A piece of", e.File.Filename+signatureNote(e.Signature))
+				}
+				writeToFile(e.File.Filename, e.File.Cont)
 			case message.FILETRANSFER_END:
 				closeFile()
 			}
 
-		case message.CLOCK_T:
-			// Check if request or response
-			msg := m.Clock
-			log.Println("[Client] Clock mesage", m.Clock)
-			sendOffsetToServer(msg.Time)
+		case client.HISTORY_E:
+			if e.From == "" || e.From[0] == '#' {
+				fmt.Println("Last broadcasts" + inChannel(e.From))
+			} else {
+				fmt.Println("Last messages with", e.From)
+			}
+			for _, h := range e.History {
+				showHistoryItem(h)
+			}
+			lastHistory.Lock()
+			lastHistory.with = e.From
+			lastHistory.oldest = ""
+			if e.MoreHistory && len(e.History) > 0 {
+				// They come oldest first
+				lastHistory.oldest = e.History[0].Id
+				fmt.Println("There are older ones, see them with /history more")
+			}
+			lastHistory.Unlock()
 
-		case message.OFFSET_T:
-			// Update your clock
-			updateClockWithOffset(m.Offset.Offset)
+		case client.SEARCH_E:
+			if len(e.History) == 0 {
+				fmt.Println("Nothing found for", e.Message)
+			} else {
+				fmt.Println("Found for", e.Message)
+			}
+			for _, h := range e.History {
+				showHistoryItem(h)
+			}
+			lastSearch.Lock()
+			lastSearch.last = ""
+			if e.MoreHistory && len(e.History) > 0 {
+				lastSearch.last = e.History[len(e.History)-1].Id
+				fmt.Println("There are more, see them with /search more")
+			}
+			lastSearch.Unlock()
 
-		case message.ADDRESS_T:
-			log.Println("[Client] appending address to list of known addresses", m.Address.Address)
-			// otherClientsAddress[m.Address.Address] = true
+		case client.SERVER_LOST_E:
+			if !inVotingProcess {
+				log.Println("[Client] timeouts over, starting new server")
+				go startVotingAlgorithm()
+			}
 
 		default:
-			log.Println("[Client] Don't know what to do with ", m)
+			log.Println("[Client]", e.Type, e)
 		}
+	}
+}
+
+// showHistoryItem prints a message from the history or a search
+func showHistoryItem(h client.HistoryItem) {
+	text := h.Message
+	if h.Sealed {
+		text = "(encrypted for " + h.To + ")"
+	}
+	who := h.From + inChannel(h.Channel)
+	if h.To != "" {
+		who += " to " + h.To
+	}
+	fmt.Println(h.Time.Format("2006-01-02 15:04:05"), who+signatureNote(h.Signature)+": ", text)
+}
 
+// inChannel says where a broadcast was said, if we know
+func inChannel(channel string) string {
+	if channel == "" {
+		return ""
 	}
+	return " in " + channel
+}
 
+// parseSearch takes from:Buddy, since:2006-01-02 and until:2006-01-02 out
+// of the words to search
+func parseSearch(args []string) (client.SearchQuery, error) {
+	var q client.SearchQuery
+	text := make([]string, 0, len(args))
+	for _, arg := range args {
+		var err error
+		switch {
+		case strings.HasPrefix(arg, "from:"):
+			q.From = strings.TrimPrefix(arg, "from:")
+		case strings.HasPrefix(arg, "since:"):
+			q.Since, err = time.ParseInLocation("2006-01-02", strings.TrimPrefix(arg, "since:"), time.Local)
+		case strings.HasPrefix(arg, "until:"):
+			q.Until, err = time.ParseInLocation("2006-01-02", strings.TrimPrefix(arg, "until:"), time.Local)
+			// That day too
+			q.Until = q.Until.AddDate(0, 0, 1)
+		default:
+			text = append(text, arg)
+		}
+		if err != nil {
+			return q, err
+		}
+	}
+	q.Text = strings.Join(text, " ")
+	return q, nil
+}
+
+// signatureNote says if a message may not be from who it says
+func signatureNote(v client.Verification) string {
+	switch v {
+	case client.UNSIGNED:
+		return " (unsigned)"
+	case client.FIRST_SEEN:
+		return " (new key, trusted from now on)"
+	case client.KEY_CHANGED:
+		return " (WARNING: not his key, use /trust if he changed it)"
+	case client.FORGED:
+		return " (WARNING: forged)"
+	case client.REPLAYED:
+		return " (WARNING: sent again, you already got it)"
+	}
+	return ""
+}
+
+// showError tells the user what went wrong in a way he can do something about
+func showError(e *message.ErrorMessage) {
+	switch e.Code {
+	case message.ERR_NICK_TAKEN:
+		fmt.Println("That nickname is already taken, choose a different one with /nick")
+	case message.ERR_UNKNOWN_RECIPIENT:
+		fmt.Println(e.Message, "Use /names to see who is connected")
+	case message.ERR_AUTH:
+		fmt.Println(e.Message + ". Login with /nick nickname password")
+	case message.ERR_NOT_LOGGED_IN:
+		fmt.Println("You are not logged in, choose a nickname with /nick")
+	case message.ERR_NOT_IN_CHANNEL:
+		fmt.Println(e.Message + ", join it with /join")
+	case message.ERR_NOT_OPERATOR, message.ERR_BANNED, message.ERR_MUTED, message.ERR_INVITE_ONLY:
+		fmt.Println(e.Message)
+	case message.ERR_BLOCKED, message.ERR_QUEUE_FULL:
+		fmt.Println("Your message wasn't delivered,", e.Message)
+	case message.ERR_RATE_LIMITED:
+		wait := time.Duration(e.RetryAfter) * time.Millisecond
+		fmt.Println("You are sending too fast, slow down.", e.Message+". Try again in", wait)
+	case message.ERR_VERSION:
+		fmt.Println("The server doesn't speak our protocol, it supports versions", e.Versions)
+	case message.ERR_MALFORMED, message.ERR_UNSUPPORTED:
+		fmt.Println("The server couldn't handle our message:", e.Message)
+	default:
+		fmt.Println("Error from server:", e.Message)
+	}
 }
 
 // ****** User interface  ****** //
@@ -529,16 +620,21 @@ func handleUserInput(line string) {
 			fmt.Println("Missing arguments")
 			return
 		}
-		nick := arr[1]
-		m := message.NewLogin(nick)
-		// You can do this but the server will
-		// reject you if there is an error
-		myAlias = nick
-		sendXmlToServer(m)
+		if length > 2 {
+			chat.LoginWithPassword(arr[1], arr[2])
+			return
+		}
+		chat.Login(arr[1])
+
+	case l == "/register":
+		if length <= 2 {
+			fmt.Println("Missing arguments")
+			return
+		}
+		chat.Register(arr[1], arr[2])
 
 	case l == "/names":
-		m := message.NewUGetConnected()
-		sendXmlToServer(m)
+		chat.ListUsers()
 
 	case l == "/msg":
 		if length <= 2 {
@@ -547,8 +643,108 @@ func handleUserInput(line string) {
 		}
 		to := arr[1]
 		msg := strings.Join(arr[2:length], " ")
-		m := message.NewDirectMessage(to, msg)
-		sendXmlToServer(m)
+		var err error
+		if strings.HasPrefix(to, "#") {
+			err = chat.BroadcastTo(to, msg)
+		} else {
+			err = chat.DirectMessage(to, msg)
+		}
+		if err != nil {
+			fmt.Println("Couldn't send the message,", err)
+		}
+
+	case l == "/join", l == "/part":
+		if length <= 1 || !strings.HasPrefix(arr[1], "#") {
+			fmt.Println("Missing arguments, channels go like #room")
+			return
+		}
+		if l == "/join" {
+			chat.Join(arr[1])
+		} else {
+			chat.Part(arr[1])
+		}
+
+	case l == "/topic":
+		// Without a channel it's the default one
+		channel := ""
+		if length > 1 && strings.HasPrefix(arr[1], "#") {
+			channel = arr[1]
+			arr = arr[1:]
+			length--
+		}
+		chat.Topic(channel, strings.Join(arr[1:length], " "))
+
+	case l == "/list":
+		chat.ListChannels()
+
+	case l == "/kick", l == "/ban", l == "/unban", l == "/mute", l == "/unmute", l == "/invite":
+		if length <= 2 || !strings.HasPrefix(arr[1], "#") {
+			fmt.Println("Missing arguments, it goes like", l, "#room Buddy")
+			return
+		}
+		channel, who := arr[1], arr[2]
+		switch l {
+		case "/kick":
+			chat.Kick(channel, who, strings.Join(arr[3:length], " "))
+		case "/ban":
+			chat.Ban(channel, who)
+		case "/unban":
+			chat.Unban(channel, who)
+		case "/mute":
+			// The server picks how long without one
+			var d time.Duration
+			if length > 3 {
+				var err error
+				d, err = time.ParseDuration(arr[3])
+				if err != nil {
+					fmt.Println("How long goes like 10m or 1h,", err)
+					return
+				}
+			}
+			chat.Mute(channel, who, d)
+		case "/unmute":
+			chat.Unmute(channel, who)
+		case "/invite":
+			chat.Invite(channel, who)
+		}
+
+	case l == "/mode":
+		if length <= 1 || !strings.HasPrefix(arr[1], "#") {
+			fmt.Println("Missing arguments, it goes like /mode #room +i")
+			return
+		}
+		mode, who := "", ""
+		if length > 2 {
+			mode = arr[2]
+		}
+		if length > 3 {
+			who = arr[3]
+		}
+		chat.Mode(arr[1], mode, who)
+
+	case l == "/trust":
+		if length <= 1 {
+			fmt.Println("Missing arguments")
+			return
+		}
+		err := chat.ForgetKey(arr[1])
+		if err != nil {
+			fmt.Println("Couldn't forget the key of", arr[1]+",", err)
+			return
+		}
+		fmt.Println("The next key", arr[1], "signs with will be trusted")
+
+	case l == "/fingerprint":
+		if length <= 1 {
+			fmt.Println("Your fingerprint is", chat.Fingerprint())
+			return
+		}
+		fingerprint, err := chat.PeerFingerprint(arr[1])
+		if err != nil {
+			fmt.Println("Couldn't get the fingerprint of", arr[1]+",", err)
+			return
+		}
+		fmt.Println("The fingerprint of", arr[1], "is", fingerprint)
 
 	case l == "/send":
 		if length <= 2 {
@@ -557,16 +753,72 @@ func handleUserInput(line string) {
 		}
 		to := arr[1]
 		filename := arr[2]
-		fileSender(to, filename)
+		err := chat.SendFile(to, filename)
+		if err != nil {
+			fmt.Println("Couldn't send the file,", err)
+		}
+
+	case l == "/history":
+		lastHistory.Lock()
+		if length == 2 && arr[1] == "more" {
+			if lastHistory.oldest == "" {
+				lastHistory.Unlock()
+				fmt.Println("There's nothing older")
+				return
+			}
+		} else {
+			// Anything that isn't a number is who with
+			lastHistory.with, lastHistory.limit, lastHistory.oldest = "", 0, ""
+			for _, arg := range arr[1:length] {
+				if v, err := strconv.Atoi(arg); err == nil {
+					lastHistory.limit = v
+				} else {
+					lastHistory.with = arg
+				}
+			}
+		}
+		with, n, before := lastHistory.with, lastHistory.limit, lastHistory.oldest
+		lastHistory.Unlock()
+		err := chat.History(with, n, before)
+		if err != nil {
+			fmt.Println("Couldn't ask for the history,", err)
+		}
+
+	case l == "/search":
+		if length <= 1 {
+			fmt.Println("Missing arguments")
+			return
+		}
+		lastSearch.Lock()
+		if length == 2 && arr[1] == "more" {
+			if lastSearch.last == "" {
+				lastSearch.Unlock()
+				fmt.Println("There's nothing more, search something else")
+				return
+			}
+			lastSearch.query.Before = lastSearch.last
+		} else {
+			q, err := parseSearch(arr[1:length])
+			if err != nil {
+				lastSearch.Unlock()
+				fmt.Println("Dates go like 2006-01-02,", err)
+				return
+			}
+			lastSearch.query = q
+		}
+		q := lastSearch.query
+		lastSearch.Unlock()
+		err := chat.Search(q)
+		if err != nil {
+			fmt.Println("Couldn't search,", err)
+		}
 
 	case l == "/block":
 		if length <= 1 {
 			fmt.Println("Missing arguments")
 			return
 		}
-		who := arr[1]
-		m := message.NewBlock(myAlias, who)
-		sendXmlToServer(m)
+		chat.Block(arr[1])
 
 	case l == "/twitter":
 		if length < 2 {
@@ -581,8 +833,7 @@ func handleUserInput(line string) {
 		client.Update(message, url.Values{})
 
 	case l == "/quit":
-		m := message.NewExit()
-		sendXmlToServer(m)
+		chat.Quit()
 
 	case l == "/help":
 		displayHelpMessage()
@@ -605,53 +856,7 @@ func handleUserInput(line string) {
 		}
 
 	default:
-		m := message.NewBroadcast(line)
-		sendXmlToServer(m)
-	}
-}
-
-// ****** Client time to server ****** //
-func sendOffsetToServer(serverTime time.Time) {
-	// Calculate offset
-	offset := myTime.Sub(serverTime)
-	m := message.NewClockOffset(offset)
-	log.Println("[Client] Client has offset of", offset)
-	sendXmlToServer(m)
-}
-
-// ****** Client-to-server interface  ****** //
-
-// sendXmlToServer unmarshals an Xml structure and writes it to the
-// sending channel
-// TODO change name because I tried to send a marshaled xml
-func sendXmlToServer(xmlMessage interface{}) {
-	bytes, err := xml.Marshal(xmlMessage)
-	if err != nil {
-		log.Println("[Client] Error marshaling", err)
-	}
-	sendingChannel <- bytes
-}
-
-// sendDataToServer is a queue of messages for the server. It recieves a message
-// writes it to the connectin and waits for confirmation
-func sendDataToServer(sending chan []byte, confirmation chan []byte) {
-	timeoutsLeft := 3
-	for {
-		bytes := <-sending
-		log.Println("[Client] From send data to server ", string(bytes))
-		clientConn.Write(bytes)
-		select {
-		case <-confirmation:
-			log.Println("[Client] Got confirmation")
-			timeoutsLeft = 3
-		case <-time.After(1 * time.Second):
-			log.Println("[Client] Timeout!")
-			timeoutsLeft--
-			if timeoutsLeft <= 0 && !inVotingProcess {
-				log.Println("[Client] timeouts over, starting new server")
-				startVotingAlgorithm()
-			}
-		}
+		chat.Broadcast(line)
 	}
 }
 
@@ -694,554 +899,27 @@ func closeFile() {
 
 // ******** Client helper  ******** //
 func displayHelpMessage() {
-	fmt.Println("Any message that you write is going to be sent to all connected users. ")
+	fmt.Println("Any message that you write is going to be sent to everyone in the default channel. ")
 	fmt.Println("However, there are some special commands that you can use. ")
 	fmt.Println("/help - Displays this message")
-	fmt.Println("/msg Buddy Hello man - sends \"Hello man\" to \"Buddy\"")
+	fmt.Println("/nick Buddy secret - logs in as \"Buddy\", the password is only for registered nicknames")
+	fmt.Println("/register Buddy secret - registers \"Buddy\" so only you can use it")
+	fmt.Println("/msg Buddy Hello man - sends \"Hello man\" to \"Buddy\", or to everyone in a #room")
+	fmt.Println("/join #room - joins \"#room\", /part #room leaves it")
+	fmt.Println("/topic #room Lunch at noon - sets the topic of \"#room\", without a topic shows it")
+	fmt.Println("/list - gives you the channels there are")
+	fmt.Println("/kick #room Buddy reason - takes \"Buddy\" out of \"#room\", if you are an operator of it. So do the ones below")
+	fmt.Println("/ban #room Buddy@10.0.0.* - keeps whoever matches out of \"#room\", /unban lifts it")
+	fmt.Println("/mute #room Buddy 10m - \"Buddy\" can't talk in \"#room\" for 10 minutes, /unmute lets him")
+	fmt.Println("/invite #room Buddy - lets \"Buddy\" join \"#room\" when it's invite only")
+	fmt.Println("/mode #room +i - makes \"#room\" invite only, +m moderated, +o Buddy and +v Buddy make him operator or voiced. - takes it away, without a mode it shows them")
+	fmt.Println("/fingerprint Buddy - shows the fingerprint of \"Buddy\" to check it with him, yours without a name")
+	fmt.Println("/trust Buddy - trusts the next key \"Buddy\" signs with, for when he changed it")
 	fmt.Println("/send Buddy file.jpg - sends file \"file.jpg\" to \"Buddy\"")
+	fmt.Println("/history Buddy 50 - shows the last 50 messages with \"Buddy\", the broadcasts of a #room or the default channel without a name, /history more for older ones")
+	fmt.Println("/search from:Buddy since:2006-01-02 until:2006-01-31 lunch \"at noon\" - finds broadcasts of your channels and your messages, /search more for the next page")
 	fmt.Println("/names - gives you the names of all connected users.")
 	fmt.Println("/block Buddy - Blocks \"Buddy\" from sending messages to you")
 	fmt.Println("/twitter I like this day! - updates your Twitter status with the message shown")
 	fmt.Println("/quit - Exits the chat")
 }
-
-// ******** Server functions  ******** //
-// ****** Incoming interface  ****** //
-
-// listen handles any incomming connections and writes them to the channel
-// It doesn't deal with confirmation nor validation
-func listenServer() <-chan Message {
-	c := make(chan Message)
-	go func() {
-		buff := make([]byte, 1024)
-
-		for {
-			n, addr, err := serverConn.ReadFromUDP(buff)
-			if n > 0 && addr != nil {
-				// Copy the response
-				res := make([]byte, n)
-
-				// Trim newline
-				if string(buff[n-1]) == "\n" {
-					copy(res, buff[:n-1])
-				} else {
-					copy(res, buff[:n])
-				}
-
-				// Create the message
-				m := Message{Content: res,
-					Sender:    addr,
-					Timestamp: time.Now()}
-				// Send to the channel
-				c <- m
-			}
-			if err != nil {
-				// If it fails send a nil message
-				c <- Message{nil, nil, time.Now()}
-				break
-			}
-		}
-	}()
-	return c
-}
-
-// handleIncoming gets incoming messages, sends a confirmation
-// and dispatchs the message to the several "handlers"
-func handleIncoming() <-chan Message {
-	read := listenServer()
-	for {
-		m := <-read
-		if m.Content == nil {
-			continue
-		}
-		log.Println("[Server] Content", string(m.Content))
-		log.Println("[Server] From address", *m.Sender)
-		log.Println("[Server] In time", m.Timestamp)
-		msg := []byte("OK")
-		err := sendMessage(m.Sender, msg)
-		if err != nil {
-			// Assume he went offline
-			log.Println("[Server] Couldn't write message ", string(msg), "to ", m.Sender)
-			disconnectUser(m.Sender)
-
-		}
-		// Convert to internal message
-		t, p, err := message.DecodeUserMessage(m.Content)
-		if err != nil {
-			log.Println("[Server] Error reading XML. Please check it")
-			log.Println("[Server] Got", string(m.Content))
-			log.Println("[Server] Error from server, got", err.Error())
-			sendError(m.Sender, "Error reading XML. Please check it")
-			continue
-		}
-		internalM := InternalMessage{
-			Type:      t,
-			Content:   p,
-			Sender:    m.Sender,
-			Timestamp: m.Timestamp,
-		}
-		// Dispatch
-		switch internalM.Type {
-		case message.UNKNOWN_T:
-			sendError(internalM.Sender, "Couldn't match type to any know type")
-
-		case message.LOGIN_T:
-			loginHandler(internalM)
-
-		case message.BROAD_T:
-			broadcastHandler(internalM)
-
-		case message.DM_T:
-			directMessageHandler(internalM)
-
-		case message.GET_CONN_T:
-			getConnectedHandler(internalM)
-
-		case message.BLOCK_T:
-			blockHandler(internalM)
-
-		case message.FILE_T:
-			fileHandler(internalM)
-
-		case message.OFFSET_T:
-			clockHandler(internalM)
-
-		case message.EXIT_T:
-			exitHandler(internalM)
-
-		}
-	}
-}
-
-// ****** Server time  ****** //
-func sendTimeRequest(period time.Duration) {
-	c := time.Tick(period)
-	mutex := sync.Mutex{}
-	for _ = range c {
-		mutex.Lock()
-		areWeGettingClocks = true
-		time.AfterFunc(period/2, func() {
-			// Stop getting clocks after n time and send updates
-			log.Println("[Server] Stop recieving time")
-			// Sanity check, if no one is here return
-			if len(connections) == 0 {
-				return
-			}
-			areWeGettingClocks = false
-			var sumOfClocks int64
-			var computedCloks int64
-			for _, c := range userClocks {
-				// FIXME
-				// Calculate average
-				// TODO Probably should check for overflow
-				log.Println("[Server] user clocks", userClocks)
-				log.Println("[Server] ", c)
-				if c.Timestamp == nil {
-					continue
-				}
-				sumOfClocks += c.Timestamp.Unix()
-				computedCloks++
-			}
-			if computedCloks == 0 {
-				return
-			}
-			average := sumOfClocks / computedCloks
-			log.Println("[Server] Clock average", average)
-			// Create new time object and send to users
-			// "0" since we don't have nanoseconds
-			averageTime := time.Unix(average, 0)
-
-			// Then send that average to all users that need to adjust their clocks
-			// Now send it to all users
-			for i, u := range userClocks {
-				// This gives me an offset.
-				// FIXME
-				if u.Timestamp == nil {
-					continue
-				}
-				adjustment := averageTime.Sub(*u.Timestamp)
-				m := message.NewClockOffset(adjustment)
-				log.Println("[Server] Adjustment for user", i, adjustment)
-				log.Println("[Server] Becasue user has", *u.Timestamp)
-				mm, _ := xml.Marshal(m)
-				// Get user reference
-				usr, ok := connections[u.User.String()]
-				if !ok {
-					log.Println("[Server] error sending message to user with address", userClocks[i].User.String())
-				}
-				sendMessageToUser(usr, mm)
-			}
-
-			// Finally, clear slice
-			userClocks = userClocks[:0]
-		})
-		// For server time is always time.Now, since he
-		// doesn't adjust his clock
-		m := message.NewClockSyncPetition(time.Now())
-		mm, _ := xml.Marshal(m)
-		log.Println("[Server] Sending time to user", m)
-		for _, u := range connections {
-			sendMessageToUser(u, mm)
-		}
-		mutex.Unlock()
-	}
-}
-
-func sendAddresses(period time.Duration, max_send int) {
-	c := time.Tick(period)
-
-	for _ = range c {
-		log.Println("[Server] >>>>>>>>>>>")
-		log.Println("[Server] Sending address")
-		// Send addresses to users
-		for _, usr := range connections {
-			for _, u := range connections {
-				if usr == u {
-					continue
-				}
-				log.Println("[Server]Sending address to", usr.Alias)
-				addr := u.Address.Port
-				m := message.NewAddressMessage(addr)
-				mm, err := xml.Marshal(m)
-				if err != nil {
-					log.Println("[Server] Can't send address", err)
-					continue
-				}
-				sendMessageToUser(usr, mm)
-			}
-		}
-	}
-}
-
-// ****** Server handlers  ****** //
-func loginHandler(m InternalMessage) {
-	usr, ok := isUserConnected(m.Sender)
-	if ok {
-		// User is already connected, meanning he already picked an alias
-		// don't do anything.
-		// Maybe this could be an error, but it seems to much
-		log.Println("[Server] User already connected", usr)
-	} else {
-		// Means we haven't seen him before
-		log.Println("[Server] Registring new connection", m.Sender)
-		err := registerUser(m.Sender, m.Content.Login)
-		if err != nil {
-			sendError(m.Sender, err.Error())
-		}
-	}
-}
-
-func broadcastHandler(m InternalMessage) {
-	// Create a broadcastMessage
-	alias, err := getUserAlias(m.Sender)
-	if err != nil {
-		sendError(m.Sender, "Fail to send broadcast, reason"+err.Error())
-	}
-	msg := message.NewSBroadcast(alias, m.Content.UMessage.Message)
-	log.Println("[Server] ", msg)
-	sendBroadcast(&msg)
-}
-
-func directMessageHandler(m InternalMessage) {
-	dm := m.Content.UMessage
-	// Get the alias of the sender
-	alias, err := getUserAlias(m.Sender)
-	if err != nil {
-		sendError(m.Sender, "Fail to send broadcast, reason"+err.Error())
-	}
-	// Create new message
-	msg := message.NewSDirectMessage(alias, dm.Message)
-
-	// Get a reference to the user we are sending the message
-	reciever, ok := users[dm.To]
-	if !ok {
-		sendError(m.Sender, "The user"+dm.To+"Doesn't exist!")
-	}
-
-	// send it!
-	mm, err := xml.Marshal(msg)
-	if err != nil {
-		log.Println("Error marshaling dm, reason", err.Error())
-	}
-	sendMessaeToUserCheckBlocked(reciever, alias, mm)
-	// sendMessageToUser(reciever, mm)
-}
-
-func getConnectedHandler(m InternalMessage) {
-	// Get all the alias of connected users
-	// TODO This is probably very expensive, maybe should keep a cache of this
-	// but maybe is not worthy
-	connectedUsers := make([]string, len(connections))
-	i := 0
-	for _, usr := range connections {
-		connectedUsers[i] = usr.Alias
-		i++
-	}
-
-	// Make the response
-	msg := message.NewSGetConnected(connectedUsers)
-
-	// Prepare the message to be sent
-	mm, err := xml.Marshal(msg)
-	if err != nil {
-		log.Println("[Server] Error marshaling getConnected, reason", err.Error())
-	}
-
-	// Get reference to the user who sent this
-	usr, ok := connections[m.Sender.String()]
-	if !ok {
-		log.Println("[Server] Fuck!!!")
-	}
-
-	// Send it!
-	sendMessageToUser(usr, mm)
-}
-
-func blockHandler(m InternalMessage) {
-	block := m.Content.Block
-	blockUser(block.Blocker, block.Blocked)
-}
-
-func fileHandler(m InternalMessage) {
-	alias, err := getUserAlias(m.Sender)
-	if err != nil {
-		sendError(m.Sender, "Fail to send file message, reason"+err.Error())
-	}
-	fm := m.Content.File
-	// Get a reference to the user we are sending the message
-	reciever, ok := users[fm.To]
-	if !ok {
-		sendError(m.Sender, "The user"+fm.To+"Doesn't exist!")
-	}
-	mm, err := xml.Marshal(fm)
-	if err != nil {
-		log.Println("[Server] Error marshaling file, reason", err.Error())
-	}
-	sendMessaeToUserCheckBlocked(reciever, alias, mm)
-}
-
-func clockHandler(m InternalMessage) {
-	offsetM := m.Content.Clock
-	log.Println("Server got", offsetM)
-	if !areWeGettingClocks {
-		// Ignore value
-		log.Println("Clock handler rejected message")
-		return
-	}
-	log.Println("Clock handler accepted message")
-	serverTime := time.Now()
-	timestamp := serverTime.Add(offsetM.Offset)
-	message := clockMessage{
-		User:       m.Sender,
-		Offset:     &offsetM.Offset,
-		Timestamp:  &timestamp,
-		ServerTime: &serverTime,
-	}
-	userClocks = append(userClocks, message)
-}
-
-func exitHandler(m InternalMessage) {
-	// I guess that's it
-	disconnectUser(m.Sender)
-}
-
-// ****** Server senders  ****** //
-func sendBroadcast(broadcastMessage *message.SMessage) {
-	m, err := xml.Marshal(broadcastMessage)
-	if err != nil {
-		// server error
-		log.Println("Server error sending broadcast", err.Error())
-		return
-	}
-	for _, usr := range connections {
-		if usr.Alias == broadcastMessage.From {
-			continue
-		}
-		log.Println("sending data", broadcastMessage, "to user", usr.Alias)
-		// TODO Check blocked
-		sendMessaeToUserCheckBlocked(usr, broadcastMessage.From, m)
-	}
-}
-
-func fileSender(alias string, path string) {
-	// Send start message
-	log.Println("Sending file")
-	file, err := os.Open(path)
-	if err != nil {
-		log.Println("[Server] Error opening file in ", path, " ", err.Error())
-		return
-	}
-	defer file.Close()
-	// TODO temporary fix
-	path = "temp.txt"
-	start := message.NewFileStart(alias, path)
-	log.Println("[Server] ", start)
-	sendXmlToServer(start)
-	r := bufio.NewReader(file)
-
-	// Send all contents
-	buf := make([]byte, 1024)
-	var m message.FileMessage
-	for {
-		n, err := r.Read(buf)
-		if err != nil && err != io.EOF {
-			log.Println("[Server] pinshi error")
-		}
-		if n == 0 {
-			log.Println("Got no bytes from file", path)
-			break
-		}
-		log.Println("[Server] Readed >>")
-		log.Println("[Server]", string(buf[:n]))
-
-		m = message.NewFileSend(alias, path, buf[:n])
-		sendXmlToServer(m)
-
-	}
-	// Send final message
-	m = message.NewFileEnd(alias, path)
-	sendXmlToServer(m)
-}
-
-func sendPendingMessages(usr *User) {
-	pending := usr.Pending
-	for _, message := range pending {
-		sendMessageToUser(usr, message)
-	}
-}
-
-func sendMessaeToUserCheckBlocked(to *User, sender string, msg []byte) error {
-	// Iterate and check if the user is blocked
-	for _, alias := range to.Blocked {
-		if alias == sender {
-			return nil
-		}
-	}
-	return sendMessageToUser(to, msg)
-}
-
-func sendMessageToUser(usr *User, msg []byte) error {
-	// See if the user is connected
-	if usr.Online {
-		// If he is, try to send message
-		err := sendMessage(usr.Address, msg)
-		if err == nil {
-			return nil
-		}
-	}
-	// If user is not currently connected or sent failed try to save it for later
-	err := saveMessageForLater(usr, msg)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func saveMessageForLater(usr *User, msg []byte) error {
-	usr.Pending = append(usr.Pending, msg)
-	return nil
-}
-
-// sendMessage tries to send a confirmation to the user who
-// sent the message. If it doesn't get any confirmation it sends an error
-func sendMessage(whom *net.UDPAddr, msg []byte) error {
-	retriesLeft := MAX_RETRY
-	// Send confirmation
-	for retriesLeft > 0 {
-		_, err := serverConn.WriteTo(msg, whom)
-		if err == nil {
-			return nil
-		}
-		time.Sleep(time.Millisecond * MILIS_BETWEEN_RETRY)
-		retriesLeft--
-	}
-	return errors.New("Couldn't send confirmation")
-}
-
-// ****** Server helpers  ****** //
-
-// registerUser assumes that a user already was already chec
-func registerUser(who *net.UDPAddr, loginMessage *message.Login) error {
-	alias := loginMessage.Nickname
-	// Check that he doesn't exist already
-	var usr *User
-	usr, isAlreadyRegistered := users[alias]
-	if isAlreadyRegistered {
-		if usr.Online {
-			// That login is already used, choose a different one
-			sendError(who, "Login already taken, choose a different one")
-			return errors.New("Login already taken")
-		}
-
-		// Update to new status
-		usr.Address = who
-		usr.Online = true
-		sendPendingMessages(usr)
-
-	} else {
-		// Create a new user
-		usr = &User{alias,
-			who,
-			true,
-			make([]string, BLOCKED_INITIAL),
-			make([][]byte, 100),
-		}
-		users[usr.Alias] = usr
-	}
-	connections[who.String()] = usr
-	m := message.NewLoginResponse(who.Port)
-	mm, _ := xml.Marshal(m)
-	sendMessageToUser(usr, mm)
-	return nil
-}
-
-func disconnectUser(who *net.UDPAddr) {
-	usr, ok := connections[who.String()]
-	if ok {
-		// User already known, set as offline
-		usr.Online = false
-	}
-	delete(connections, who.String())
-}
-
-func blockUser(blocker string, blocked string) {
-	// Get both users
-	I, ok := users[blocker]
-	if !ok {
-		log.Println("[Server] Couldn't get the current alias for blocking", blocker)
-	}
-	_, ok = users[blocked]
-	if !ok {
-		log.Println("[Server] You can't block a user that is not registered!, you tried to block", blocked)
-	}
-
-	I.Blocked = append(I.Blocked, blocked)
-}
-
-func sendError(who *net.UDPAddr, msg string) {
-	log.Println("[Server] Sending error to ", who.String())
-	log.Println("[Server] Message", msg)
-	errMsg := message.NewErrorMessage(msg)
-	m, err := xml.Marshal(errMsg)
-	if err != nil {
-		// server error
-		log.Println("[Server] Server error sending broadcast", err.Error())
-		return
-	}
-	// Don't buffer error messages
-	sendMessage(who, m)
-}
-
-func isUserConnected(who *net.UDPAddr) (*User, bool) {
-	val, ok := connections[who.String()]
-	return val, ok
-}
-
-// It's not found because we are using a different thing
-func getUserAlias(who *net.UDPAddr) (string, error) {
-	usr, ok := connections[who.String()]
-	if !ok {
-		return "", errors.New("Your user wasn't found. Please login first")
-	}
-	return usr.Alias, nil
-}
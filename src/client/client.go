@@ -0,0 +1,618 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"message"
+	"net"
+	"os"
+	"secure"
+	"sync"
+	"time"
+)
+
+const (
+	MAX_RETRY    = 3
+	DIAL_RETRIES = 3
+	MAX_TIMEOUTS = 3 // Unanswered tries before we say the server is lost
+	ACK_TIMEOUT  = 1 * time.Second
+	CLOCK_TICK   = 3 * time.Second
+	EVENT_BUFFER = 100
+	FILE_CHUNK   = 1024
+)
+
+var ErrClosed = errors.New("Client is closed")
+var ErrHandshake = errors.New("Server didn't agree on a secure session")
+var ErrServerKey = errors.New("The server signed its handshake with a key we don't trust")
+
+// Config is where the server is and how we want to talk to it. Anything
+// left empty takes its default
+type Config struct {
+	ServerAddr  string
+	Codecs      []string         // What we'd like to talk, most wanted first
+	ReorderWait time.Duration    // How long an out of order message waits for the ones before it
+	Token       string           // A session from before, to pick it up from a new address
+	Secure      bool             // Encrypt everything, Dial fails if the server can't
+	Identity    *secure.Identity // Sign what we send and encrypt direct messages and files end to end, nil for no
+	Encryption  Encryption       // When direct messages and files are encrypted, if there's an identity
+	Pins        *secure.Pins     // Keys we trust for each sender, only kept in memory if nil
+	ServerKey   []byte           // The key the server signs the handshake with. If nil the first one we see for ServerAddr is pinned in ServerPins
+	ServerPins  *secure.Pins     // Keys we trust for each server address, only kept in memory if nil
+}
+
+// Client talks to a server on behalf of one user. Whatever the server
+// sends comes out of Events, which has to be read or the client stops
+// reading from the server
+type Client struct {
+	config Config
+	conn   *net.UDPConn
+	events chan Event
+
+	// Queue of messages for the server, and the ids it acked
+	sending      chan outgoingMessage
+	confirmation chan string
+	// Signaled when the server answers a login, the session comes with it
+	loggedIn chan bool
+	// WELCOMEs from the server, for whoever is doing the handshake
+	welcome chan []byte
+	// Challenges to what we sent, for sendQueue to answer
+	challenges chan *message.Challenge
+	// Keys the server gave us, for whoever asked in PeerKey
+	keys     chan *message.KeyResponse
+	keyMutex sync.Mutex
+	pins     *secure.Pins
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Guards everything below
+	mutex        sync.Mutex
+	alias        string
+	password     string // To login again if the server changes
+	address      int
+	clock        time.Time
+	codec        message.Codec // Until the login response comes we talk XML
+	capabilities []string
+	token        string // Goes in every message once the server gives it
+	cookie       string // Proves to the server it's really us at this address
+	channel      string // Where the server puts broadcasts without a channel
+	secure       *secure.Session
+	// Signed messages we got, the oldest first
+	signedIds   map[string]bool
+	signedOrder []string
+}
+
+// What the client queues for the server. The id is what the server
+// will echo back in its Ack. It's marshaled when its turn comes, so it
+// goes with the session and codec we have by then
+type outgoingMessage struct {
+	Id  string
+	Msg message.Identified
+}
+
+func New(config Config) *Client {
+	if config.ReorderWait == 0 {
+		config.ReorderWait = 2 * time.Second
+	}
+	if len(config.Codecs) == 0 {
+		config.Codecs = []string{message.CODEC_XML}
+	}
+	pins := config.Pins
+	if pins == nil {
+		pins = secure.NewPins()
+	}
+	if config.ServerPins == nil {
+		config.ServerPins = secure.NewPins()
+	}
+	return &Client{
+		config: config,
+		events: make(chan Event, EVENT_BUFFER),
+		// Buffered so a late ack doesn't block the reader
+		sending:      make(chan outgoingMessage),
+		confirmation: make(chan string, MAX_RETRY*4),
+		loggedIn:     make(chan bool, 1),
+		welcome:      make(chan []byte, 1),
+		challenges:   make(chan *message.Challenge, 1),
+		keys:         make(chan *message.KeyResponse, 4),
+		pins:         pins,
+		done:         make(chan struct{}),
+		clock:        time.Now(),
+		codec:        message.DefaultCodec,
+		token:        config.Token,
+	}
+}
+
+// Dial connects to the server and starts reading from it. Nothing is sent
+// until Login, except for the handshake if the client is secure
+func (c *Client) Dial() error {
+	log.Println("Starting client")
+	var err error
+	var con net.Conn
+	for retries := DIAL_RETRIES; retries > 0; retries-- {
+		con, err = net.Dial("udp", c.config.ServerAddr)
+		if err == nil {
+			break
+		}
+		// Give some time to the server to setup
+		log.Println("Failing because", err)
+		time.Sleep(500 * time.Millisecond)
+	}
+	if err != nil {
+		return err
+	}
+	c.conn = con.(*net.UDPConn)
+	c.setClock(time.Now())
+	in := make(chan []byte)
+	go c.listen(in)
+	go c.handle(in)
+	go c.sendQueue()
+	go c.updateClock(CLOCK_TICK)
+	if c.config.Secure {
+		err = c.handshake()
+		if err != nil {
+			c.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// handshake agrees on a secure session with the server. Anything sent
+// after it is sealed
+func (c *Client) handshake() error {
+	kx, err := secure.NewKeyExchange()
+	if err != nil {
+		return err
+	}
+	// Forget WELCOMEs from a handshake before this one
+	select {
+	case <-c.welcome:
+	default:
+	}
+	for retries := DIAL_RETRIES; retries > 0; retries-- {
+		// The hello goes as it is, there are no keys yet
+		_, err = c.conn.Write(kx.Hello())
+		if err != nil {
+			return err
+		}
+		select {
+		case w := <-c.welcome:
+			sess, key, err := kx.Finish(w)
+			if err != nil {
+				log.Println("[Client] Bad welcome from server", err)
+				continue
+			}
+			err = c.trustServer(key)
+			if err != nil {
+				// Someone else answered for the server
+				return err
+			}
+			log.Println("[Client] Secure session", sess.Id(), "with the server")
+			c.mutex.Lock()
+			c.secure = sess
+			c.mutex.Unlock()
+			return nil
+		case <-time.After(ACK_TIMEOUT):
+			log.Println("[Client] No welcome from server, saying hello again")
+		case <-c.done:
+			return ErrClosed
+		}
+	}
+	return ErrHandshake
+}
+
+// trustServer tells if key is the one of our server, the one in the
+// config or else the one we saw the first time
+func (c *Client) trustServer(key []byte) error {
+	if c.config.ServerKey != nil {
+		if !bytes.Equal(key, c.config.ServerKey) {
+			log.Println("[Client] The server signed with", secure.Fingerprint(key), "and it isn't its key")
+			return ErrServerKey
+		}
+		return nil
+	}
+	pin, err := c.config.ServerPins.Check(c.config.ServerAddr, key)
+	if err != nil {
+		log.Println("[Client] Couldn't save the key of the server", err)
+	}
+	switch pin {
+	case secure.PIN_NEW:
+		log.Println("[Client] Trusting the server key", secure.Fingerprint(key), "from now on")
+	case secure.PIN_MISMATCH:
+		log.Println("[Client] The server signed with", secure.Fingerprint(key), "and it isn't the key it had")
+		return ErrServerKey
+	}
+	return nil
+}
+
+// Close stops everything. It doesn't tell the server, that's what Quit is for
+func (c *Client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if c.conn != nil {
+			err = c.conn.Close()
+		}
+	})
+	return err
+}
+
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// ****** What a user can do  ****** //
+
+// Login as a guest, that only works for nicknames nobody registered
+func (c *Client) Login(nick string) error {
+	return c.LoginWithPassword(nick, "")
+}
+
+func (c *Client) LoginWithPassword(nick string, password string) error {
+	m := message.NewLogin(nick)
+	m.Codecs = c.config.Codecs
+	m.Password = password
+	// You can do this but the server will
+	// reject you if there is an error
+	c.mutex.Lock()
+	c.alias = nick
+	c.password = password
+	c.mutex.Unlock()
+	err := c.send(&m)
+	if err != nil {
+		return err
+	}
+	// If this login fails it goes with the next one
+	return c.publishKey()
+}
+
+// Register creates an account for nick and logs in with it. If we
+// already are that guest it becomes ours
+func (c *Client) Register(nick string, password string) error {
+	m := message.NewRegister(nick, password)
+	err := c.send(&m)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	already := c.alias == nick
+	if already {
+		c.password = password
+	}
+	c.mutex.Unlock()
+	if already {
+		return nil
+	}
+	return c.LoginWithPassword(nick, password)
+}
+
+// Broadcast goes to the default channel of the server
+func (c *Client) Broadcast(text string) error {
+	return c.BroadcastTo("", text)
+}
+
+// BroadcastTo goes to everyone in channel, we have to be in it. The
+// channel is signed too, so it can't be said somewhere else
+func (c *Client) BroadcastTo(channel string, text string) error {
+	if channel == "" {
+		channel = c.DefaultChannel()
+	}
+	m := message.NewChannelMessage(channel, text)
+	c.sign(&m)
+	return c.send(&m)
+}
+
+// Join puts us in channel, its topic comes as a TOPIC_E
+func (c *Client) Join(channel string) error {
+	m := message.NewJoin(channel)
+	return c.send(&m)
+}
+
+func (c *Client) Part(channel string) error {
+	m := message.NewPart(channel)
+	return c.send(&m)
+}
+
+// Topic changes the topic of channel, or asks for it if topic is empty.
+// It comes as a TOPIC_E
+func (c *Client) Topic(channel string, topic string) error {
+	m := message.NewTopic(channel, topic, "")
+	return c.send(&m)
+}
+
+// ListChannels asks for the channels there are, they come as a CHANNELS_E
+func (c *Client) ListChannels() error {
+	m := message.NewListChannels()
+	return c.send(&m)
+}
+
+// ****** Moderation  ****** //
+// These need us to be an operator of the channel. What's done comes to
+// everyone in it as an event
+
+// Kick takes nick out of channel, it comes as a KICK_E
+func (c *Client) Kick(channel string, nick string, reason string) error {
+	m := message.NewKick(channel, nick, reason, "")
+	return c.send(&m)
+}
+
+// Ban keeps whoever matches mask out of channel, see message.Ban. It comes
+// as a BAN_E
+func (c *Client) Ban(channel string, mask string) error {
+	m := message.NewBan(channel, mask, false, "")
+	return c.send(&m)
+}
+
+func (c *Client) Unban(channel string, mask string) error {
+	m := message.NewBan(channel, mask, true, "")
+	return c.send(&m)
+}
+
+// Mute keeps nick quiet in channel for d, the server picks how long if
+// it's 0. It comes as a MUTE_E
+func (c *Client) Mute(channel string, nick string, d time.Duration) error {
+	m := message.NewMute(channel, nick, d, false, "")
+	return c.send(&m)
+}
+
+func (c *Client) Unmute(channel string, nick string) error {
+	m := message.NewMute(channel, nick, 0, true, "")
+	return c.send(&m)
+}
+
+// Invite lets nick join channel once, only he gets an INVITE_E
+func (c *Client) Invite(channel string, nick string) error {
+	m := message.NewInvite(channel, nick, "")
+	return c.send(&m)
+}
+
+// Mode sets a mode of channel like +i, or a role of nick like +o. An empty
+// mode asks for the modes and bans. It comes as a MODE_E
+func (c *Client) Mode(channel string, mode string, nick string) error {
+	m := message.NewMode(channel, mode, nick, "")
+	return c.send(&m)
+}
+
+// DirectMessage is encrypted end to end as Config.Encryption says, and
+// signed if we have an identity
+func (c *Client) DirectMessage(to string, text string) error {
+	m := message.NewDirectMessage(to, text)
+	key, err := c.keyFor(to)
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		m.Message, err = c.sealFor(key, []byte(text))
+		if err != nil {
+			return err
+		}
+		m.Encrypted = true
+	}
+	// What gets signed is what goes, encrypted or not
+	c.sign(&m)
+	return c.send(&m)
+}
+
+// History asks for the last limit broadcasts of the channel with, or
+// direct messages with someone if it isn't a #channel. Empty is the
+// default channel. before is the id of the oldest one we have
+// to go further back, empty for the newest. They come as a HISTORY_E
+func (c *Client) History(with string, limit int, before string) error {
+	m := message.NewHistoryRequest(with, limit, before)
+	return c.send(&m)
+}
+
+// SearchQuery is what to look for with Search. Text has the words and
+// "quoted phrases" the messages must have, the rest is left empty to not
+// filter by it. Before is the id of the last result we got, for the next
+// page
+type SearchQuery struct {
+	Text   string
+	From   string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+	Before string
+}
+
+// Search looks for broadcasts of our channels and our direct messages,
+// newest first. They come as a SEARCH_E
+func (c *Client) Search(q SearchQuery) error {
+	m := message.NewSearch(q.Text, q.From, q.Since, q.Until, q.Limit, q.Before)
+	return c.send(&m)
+}
+
+// ListUsers asks for the connected users, they come as a USERS_E event
+func (c *Client) ListUsers() error {
+	m := message.NewUGetConnected()
+	return c.send(&m)
+}
+
+func (c *Client) Block(who string) error {
+	m := message.NewBlock(c.Alias(), who)
+	return c.send(&m)
+}
+
+func (c *Client) Quit() error {
+	m := message.NewExit()
+	return c.send(&m)
+}
+
+// SendFile sends the file in path to the user to, a piece at a time. Like
+// direct messages the pieces are encrypted as Config.Encryption says
+func (c *Client) SendFile(to string, path string) error {
+	log.Println("Sending file")
+	file, err := os.Open(path)
+	if err != nil {
+		log.Println("[Client] Error opening file in ", path, " ", err.Error())
+		return err
+	}
+	defer file.Close()
+	key, err := c.keyFor(to)
+	if err != nil {
+		return err
+	}
+	// TODO temporary fix
+	path = "temp.txt"
+	start := message.NewFileStart(to, path)
+	c.signFile(&start)
+	err = c.send(&start)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(file)
+
+	// Send all contents
+	buf := make([]byte, FILE_CHUNK)
+	for {
+		n, err := r.Read(buf)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		piece := message.NewFileSend(to, path, buf[:n])
+		if key != nil {
+			piece.Cont, err = c.sealFor(key, buf[:n])
+			if err != nil {
+				return err
+			}
+			piece.Encrypted = true
+		}
+		c.signFile(&piece)
+		err = c.send(&piece)
+		if err != nil {
+			return err
+		}
+	}
+	// Send final message
+	end := message.NewFileEnd(to, path)
+	c.signFile(&end)
+	return c.send(&end)
+}
+
+// Reconnect logs in again with the same nickname, after a new server took
+// over. The server may talk differently, so we start with XML again
+func (c *Client) Reconnect() error {
+	c.mutex.Lock()
+	c.codec = message.DefaultCodec
+	c.capabilities = nil
+	c.token = ""
+	alias := c.alias
+	password := c.password
+	c.mutex.Unlock()
+	if c.config.Secure {
+		if c.config.ServerKey == nil {
+			// It's another server, with a key of its own
+			c.config.ServerPins.Forget(c.config.ServerAddr)
+		}
+		// The new server doesn't know our keys
+		err := c.handshake()
+		if err != nil {
+			return err
+		}
+	}
+	err := c.LoginWithPassword(alias, password)
+	if err != nil {
+		return err
+	}
+	c.emit(Event{Type: SERVER_CHANGED_E})
+	return nil
+}
+
+// ****** Session  ****** //
+func (c *Client) Alias() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.alias
+}
+
+// DefaultChannel is where our broadcasts go if we don't say, empty until
+// we login
+func (c *Client) DefaultChannel() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.channel
+}
+
+// Address is what the server told us at login, useful when electing a
+// new server
+func (c *Client) Address() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.address
+}
+
+// Session is the token the server gave us at login. With it we can pick
+// up where we were from a new address
+func (c *Client) Session() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.token
+}
+
+// Now is our clock, which is kept in sync with the other clients
+func (c *Client) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.clock
+}
+
+func (c *Client) setClock(t time.Time) {
+	c.mutex.Lock()
+	c.clock = t
+	c.mutex.Unlock()
+}
+
+// Since the time is not tied to the computer clock it needs to be updated
+// each n time
+func (c *Client) updateClock(period time.Duration) {
+	tick := time.NewTicker(period)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-c.done:
+			return
+		}
+		c.adjustClock(period)
+	}
+}
+
+func (c *Client) adjustClock(offset time.Duration) {
+	c.mutex.Lock()
+	c.clock = c.clock.Add(offset)
+	c.mutex.Unlock()
+}
+
+func (c *Client) secureSession() *secure.Session {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.secure
+}
+
+func (c *Client) currentCodec() message.Codec {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.codec
+}
+
+// serverCan tells if we agreed with the server on using a capability
+func (c *Client) serverCan(capability string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return message.HasCapability(c.capabilities, capability)
+}
+
+// emit hands an event to whoever is reading them
+func (c *Client) emit(e Event) {
+	e.Time = c.Now()
+	select {
+	case c.events <- e:
+	case <-c.done:
+	}
+}
@@ -0,0 +1,525 @@
+package client
+
+import (
+	"log"
+	"message"
+	"secure"
+	"time"
+)
+
+// ****** Listen messages from the server  ****** //
+func (c *Client) listen(in chan<- []byte) {
+	buff := make([]byte, message.MAX_DATAGRAM)
+	fragments := message.NewReassembler(message.FRAGMENT_TIMEOUT)
+	for {
+		n, addr, err := c.conn.ReadFromUDP(buff)
+		if n > 0 && addr != nil {
+			// Copy the response
+			res := make([]byte, n)
+
+			// Trim newline
+			if string(buff[n-1]) == "\n" && !message.IsBinary(buff[:n]) && !secure.IsSecure(buff[:n]) {
+				copy(res, buff[:n-1])
+				res = res[:n-1]
+			} else {
+				copy(res, buff[:n])
+			}
+			// Wait for the rest if it's a piece of something bigger
+			if whole, ok := fragments.Add(addr.String(), res, time.Now()); ok {
+				whole, ok = c.unseal(whole)
+				if !ok {
+					continue
+				}
+				select {
+				case in <- whole:
+				case <-c.done:
+					return
+				}
+			}
+		}
+		if err != nil {
+			select {
+			case <-c.done:
+				return
+			default:
+			}
+			log.Println("[Client] Error reading from server", err)
+		}
+	}
+}
+
+// unseal opens whatever comes sealed, WELCOMEs go to the handshake. Once
+// we have a secure session nothing in plain text is taken
+func (c *Client) unseal(b []byte) ([]byte, bool) {
+	sess := c.secureSession()
+	if !secure.IsSecure(b) {
+		if sess != nil {
+			log.Println("[Client] Dropping plain message, we only talk sealed")
+			return nil, false
+		}
+		return b, true
+	}
+	switch secure.Kind(b) {
+	case secure.WELCOME:
+		select {
+		case c.welcome <- b:
+		default:
+		}
+	case secure.DATA:
+		if sess == nil {
+			return nil, false
+		}
+		plain, err := sess.Open(b)
+		if err != nil {
+			log.Println("[Client] Dropping sealed message", err)
+			return nil, false
+		}
+		return plain, true
+	}
+	return nil, false
+}
+
+func (c *Client) handle(in <-chan []byte) {
+	reorder := newReorderBuffer(c.config.ReorderWait)
+	for {
+		var b []byte
+		select {
+		case b = <-in:
+		case <-reorder.Expired():
+			log.Println("[Client] Gave up waiting for message", reorder.Expected)
+			for _, h := range reorder.Skip() {
+				c.deliver(h.Type, h.Content)
+			}
+			continue
+		case <-c.done:
+			return
+		}
+		log.Println("[Client] From handle client", message.Redact(b))
+		t, m, err := message.DecodeServerMessage(b)
+		if err != nil {
+			log.Println("[Client] Error reading XML from server")
+			log.Println("[Client] Got", message.Redact(b))
+			log.Println("[Client] ", err.Error())
+			continue
+		}
+		// Same session as before means the server moved us to a new address
+		resumed := false
+		if t == message.LOGIN_RES_T {
+			log.Println("[Client] Speaking version", m.Login.Version, "with", m.Login.Capabilities)
+			c.mutex.Lock()
+			resumed = c.token != "" && c.token == m.Login.Session
+			c.capabilities = m.Login.Capabilities
+			// Even the ack for this one has to carry it
+			c.token = m.Login.Session
+			c.mutex.Unlock()
+		}
+		if t != message.ACK_T && m.Header.Id != "" && c.serverCan(message.CAP_ACK) {
+			// Confirm everything, even repeated ones, or the server keeps sending them
+			c.sendAck(m.Header.Id)
+		}
+		switch t {
+		case message.ACK_T:
+			for _, id := range m.Ack.Ids {
+				select {
+				case c.confirmation <- id:
+				default:
+					log.Println("[Client] Dropping ack, nobody is waiting for", id)
+				}
+			}
+
+		case message.LOGIN_RES_T:
+			// Update your address
+			log.Println("[Client] My address is", m.Login.Address)
+			c.mutex.Lock()
+			c.address = m.Login.Address
+			c.channel = m.Login.Channel
+			if codec, ok := message.CodecByName(m.Login.Codec); ok {
+				log.Println("[Client] Talking", codec.Name(), "with the server")
+				c.codec = codec
+			}
+			c.mutex.Unlock()
+			c.signalLogin(true)
+			c.emit(Event{Type: LOGIN_E, Address: m.Login.Address})
+			if resumed && reorder.Started && m.Login.Order <= reorder.Expected {
+				// We were already counting, don't go back and show things twice
+				continue
+			}
+			for _, h := range reorder.Start(m.Login.Order) {
+				c.deliver(h.Type, h.Content)
+			}
+
+		case message.DM_T, message.BROAD_T, message.FILE_T:
+			order := m.Order()
+			if order == 0 {
+				// Server doesn't care about the order of this one
+				c.deliver(t, m)
+				continue
+			}
+			ready, missing := reorder.Push(order, t, m)
+			if len(missing) > 0 && c.serverCan(message.CAP_ORDER) {
+				log.Println("[Client] Asking the server again for", missing)
+				// Don't block this loop, the ack comes through here
+				gap := message.NewGapRequest(missing)
+				go c.send(&gap)
+			}
+			for _, h := range ready {
+				c.deliver(h.Type, h.Content)
+			}
+
+		case message.ERROR_T:
+			if m.Error.Ref != "" {
+				// The server refused it instead of acking it, sending it
+				// again would only get the same error
+				select {
+				case c.confirmation <- m.Error.Ref:
+				default:
+				}
+			}
+			c.deliver(t, m)
+
+		default:
+			c.deliver(t, m)
+		}
+	}
+}
+
+// deliver turns a message from the server into an event, by now ordered
+// messages already come in the right order
+func (c *Client) deliver(t message.Type, m *message.ServerPackage) {
+	switch t {
+	case message.ERROR_T:
+		log.Println("[Client] Error from server:", m.Error.Code, m.Error.Ref, m.Error.Message)
+		if m.Error.Code == message.ERR_NICK_TAKEN || m.Error.Code == message.ERR_VERSION {
+			c.signalLogin(false)
+		}
+		c.emit(Event{Type: ERROR_E, Error: m.Error})
+
+	case message.DM_T:
+		e := Event{Type: DM_E, From: m.Direct.From, Message: m.Direct.Message}
+		e.Signature = c.verify(signedMessage(m.Direct, c.Alias()), true)
+		if m.Direct.Encrypted {
+			plain, fingerprint, err := c.open(m.Direct.Message)
+			if err != nil {
+				c.undecryptable(m, "a message from "+m.Direct.From, err)
+				return
+			}
+			e.Message, e.Encrypted, e.Fingerprint = string(plain), true, fingerprint
+		}
+		c.emit(e)
+
+	case message.BROAD_T:
+		c.emit(Event{Type: BROADCAST_E, From: m.Direct.From, Channel: m.Direct.Channel, Message: m.Direct.Message, Signature: c.verify(signedMessage(m.Direct, m.Direct.Channel), true)})
+
+	case message.GET_CONN_T:
+		users := make([]string, len(m.Connected.Users.ConnUsers))
+		for i, u := range m.Connected.Users.ConnUsers {
+			users[i] = u.Id
+		}
+		c.emit(Event{Type: USERS_E, Users: users})
+
+	case message.FILE_T:
+		// Checked before it's decrypted, it was signed that way
+		e := Event{Type: FILE_E, From: m.File.From, File: m.File, Signature: c.verify(signedFile(m.File), true)}
+		if m.File.Encrypted && m.File.Kind == message.FILETRANSFER_MID {
+			plain, fingerprint, err := c.open(m.File.Cont)
+			if err != nil {
+				c.undecryptable(m, "a piece of "+m.File.Filename, err)
+				return
+			}
+			m.File.Cont = string(plain)
+			e.Encrypted, e.Fingerprint = true, fingerprint
+		}
+		c.emit(e)
+
+	case message.HISTORY_RES_T:
+		e := Event{Type: HISTORY_E, From: m.History.With, MoreHistory: m.History.More}
+		e.History = c.historyItems(m.History.Entries)
+		c.emit(e)
+
+	case message.SEARCH_RES_T:
+		e := Event{Type: SEARCH_E, Message: m.Search.Query, MoreHistory: m.Search.More}
+		e.History = c.historyItems(m.Search.Results)
+		c.emit(e)
+
+	case message.RECEIPT_T:
+		c.emit(Event{Type: RECEIPT_E, Receipt: m.Receipt})
+
+	case message.TOPIC_T:
+		c.emit(Event{Type: TOPIC_E, From: m.Topic.By, Channel: m.Topic.Channel, Message: m.Topic.Topic})
+
+	case message.LIST_RES_T:
+		c.emit(Event{Type: CHANNELS_E, Channels: m.Channels.Channels})
+
+	case message.KICK_T:
+		c.emit(Event{Type: KICK_E, From: m.Kick.By, Channel: m.Kick.Channel, Kick: m.Kick})
+
+	case message.BAN_T:
+		c.emit(Event{Type: BAN_E, From: m.Ban.By, Channel: m.Ban.Channel, Ban: m.Ban})
+
+	case message.MUTE_T:
+		c.emit(Event{Type: MUTE_E, From: m.Mute.By, Channel: m.Mute.Channel, Mute: m.Mute})
+
+	case message.INVITE_T:
+		c.emit(Event{Type: INVITE_E, From: m.Invite.By, Channel: m.Invite.Channel, Invite: m.Invite})
+
+	case message.MODE_T:
+		c.emit(Event{Type: MODE_E, From: m.Mode.By, Channel: m.Mode.Channel, Mode: m.Mode})
+
+	case message.CHALLENGE_T:
+		select {
+		case c.challenges <- m.Challenge:
+		default:
+			log.Println("[Client] Dropping challenge for", m.Challenge.Ref)
+		}
+
+	case message.KEY_RES_T:
+		select {
+		case c.keys <- m.Key:
+		default:
+			log.Println("[Client] Dropping key, nobody asked for", m.Key.Nickname)
+		}
+
+	case message.CLOCK_T:
+		log.Println("[Client] Clock mesage", m.Clock)
+		// Don't block this loop, the ack comes through here
+		go c.sendOffset(m.Clock.Time)
+
+	case message.OFFSET_T:
+		log.Println("[Client] Updating clock with new offset", m.Offset.Offset)
+		c.adjustClock(m.Offset.Offset)
+		c.emit(Event{Type: CLOCK_E, Offset: m.Offset.Offset})
+
+	case message.ADDRESS_T:
+		log.Println("[Client] Got the address of another client", m.Address.Address)
+
+	default:
+		log.Println("[Client] Don't know what to do with ", t)
+	}
+}
+
+// historyItems decrypts and checks the messages of a history page
+func (c *Client) historyItems(entries []message.HistoryEntry) []HistoryItem {
+	me := c.Alias()
+	items := make([]HistoryItem, 0, len(entries))
+	for _, h := range entries {
+		item := HistoryItem{HistoryEntry: h}
+		p := signed{Kind: h.Kind, Id: h.SignedId, From: h.From, To: h.To, Text: h.Message, Signature: h.Signature, SigningKey: h.SigningKey}
+		if h.Kind == message.BROAD {
+			// Broadcasts are signed for their channel
+			p.To = h.Channel
+		}
+		item.Signature = c.verify(p, false)
+		if h.Encrypted {
+			// Even the ones we sent can only be read by him
+			item.Message, item.Sealed = "", true
+			if h.To == me {
+				plain, fingerprint, err := c.open(h.Message)
+				if err == nil {
+					item.Message, item.Fingerprint, item.Sealed = string(plain), fingerprint, false
+				}
+			}
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// ****** Client time to server ****** //
+func (c *Client) sendOffset(serverTime time.Time) {
+	// Calculate offset
+	offset := c.Now().Sub(serverTime)
+	log.Println("[Client] Client has offset of", offset)
+	m := message.NewClockOffset(offset)
+	c.send(&m)
+}
+
+// ****** Client-to-server interface  ****** //
+
+// send queues a message for the server
+func (c *Client) send(m message.Identified) error {
+	select {
+	case c.sending <- outgoingMessage{Id: m.MessageId(), Msg: m}:
+		return nil
+	case <-c.done:
+		return ErrClosed
+	}
+}
+
+// marshal signs a message with our session and marshals it with whatever
+// we talk with the server
+func (c *Client) marshal(m message.Identified) ([]byte, error) {
+	if t, ok := m.(message.Tokened); ok {
+		t.SetToken(c.Session())
+	}
+	return c.currentCodec().Marshal(m)
+}
+
+// setCookie puts the last cookie the server gave us in the message
+func (c *Client) setCookie(m message.Identified) {
+	if cm, ok := m.(message.Cookied); ok {
+		c.mutex.Lock()
+		cm.SetCookie(c.cookie)
+		c.mutex.Unlock()
+	}
+}
+
+func (c *Client) signalLogin(ok bool) {
+	select {
+	case c.loggedIn <- ok:
+	default:
+	}
+}
+
+// write seals the message if we are secure, and splits whatever doesn't
+// fit in a datagram
+func (c *Client) write(b []byte) error {
+	if sess := c.secureSession(); sess != nil {
+		b = sess.Seal(b)
+	}
+	fragments, err := message.Fragment(b, message.MAX_DATAGRAM)
+	if err != nil {
+		return err
+	}
+	for _, f := range fragments {
+		_, err := c.conn.Write(f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendAck confirms a message from the server. It doesn't go through
+// the queue since acks aren't confirmed
+func (c *Client) sendAck(id string) {
+	ack := message.NewAck(id)
+	bytes, err := c.marshal(&ack)
+	if err != nil {
+		log.Println("[Client] Error marshaling ack", err)
+		return
+	}
+	err = c.write(bytes)
+	if err != nil {
+		log.Println("[Client] Couldn't ack", id, err)
+	}
+}
+
+// sendQueue writes the queued messages one at a time and waits for the ack
+// with its id, resending the same bytes if it doesn't come. When the server
+// stops answering everyone gets a SERVER_LOST_E
+func (c *Client) sendQueue() {
+	timeoutsLeft := MAX_TIMEOUTS
+	for {
+		var out outgoingMessage
+		select {
+		case out = <-c.sending:
+		case <-c.done:
+			return
+		}
+		_, isLogin := out.Msg.(*message.Login)
+		if isLogin {
+			// Forget answers to logins before this one
+			select {
+			case <-c.loggedIn:
+			default:
+			}
+		}
+		_, isRegister := out.Msg.(*message.Register)
+		if isLogin || isRegister {
+			// Forget challenges to logins before this one
+			select {
+			case <-c.challenges:
+			default:
+			}
+		}
+		if isLogin || isRegister {
+			// Anything else only needs it if it's challenged
+			c.setCookie(out.Msg)
+		}
+		bytes, err := c.marshal(out.Msg)
+		if err != nil {
+			log.Println("[Client] Error marshaling", err)
+			continue
+		}
+		if isLogin || isRegister {
+			// It has the password
+			log.Println("[Client] Sending login to server", out.Id)
+		} else {
+			log.Println("[Client] From send data to server ", message.Redact(bytes))
+		}
+		for retries := MAX_RETRY; retries > 0; retries-- {
+			c.write(bytes)
+			acked, challenged := c.waitForAck(out.Id, ACK_TIMEOUT)
+			if challenged {
+				// The server did answer, it only wants the cookie first. It
+				// still takes a retry, or a server that keeps asking would
+				// keep us here
+				log.Println("[Client] Answering challenge for", out.Id)
+				c.setCookie(out.Msg)
+				bytes, err = c.marshal(out.Msg)
+				if err != nil {
+					log.Println("[Client] Error marshaling", err)
+					break
+				}
+				continue
+			}
+			if acked {
+				log.Println("[Client] Got confirmation for", out.Id)
+				timeoutsLeft = MAX_TIMEOUTS
+				if isLogin {
+					// What comes next has to carry the session
+					c.waitForLogin(ACK_TIMEOUT)
+				}
+				break
+			}
+			log.Println("[Client] Timeout! retransmitting", out.Id)
+			timeoutsLeft--
+			if timeoutsLeft <= 0 {
+				log.Println("[Client] timeouts over, the server is lost")
+				timeoutsLeft = MAX_TIMEOUTS
+				c.emit(Event{Type: SERVER_LOST_E})
+				break
+			}
+		}
+	}
+}
+
+// waitForLogin waits until the server answers a login, or gives up
+func (c *Client) waitForLogin(timeout time.Duration) {
+	select {
+	case <-c.loggedIn:
+	case <-time.After(timeout):
+		log.Println("[Client] No answer to our login")
+	case <-c.done:
+	}
+}
+
+// waitForAck waits until the ack for id arrives. Acks for other messages
+// are late ones for something we already gave up on, so they are ignored.
+// If the server challenges id instead we keep the cookie and say so, it
+// has to be sent again with it
+func (c *Client) waitForAck(id string, timeout time.Duration) (bool, bool) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case got := <-c.confirmation:
+			if got == id {
+				return true, false
+			}
+			log.Println("[Client] Ignoring stale ack for", got)
+		case challenge := <-c.challenges:
+			if challenge.Ref != id {
+				log.Println("[Client] Ignoring stale challenge for", challenge.Ref)
+				continue
+			}
+			c.mutex.Lock()
+			c.cookie = challenge.Cookie
+			c.mutex.Unlock()
+			return false, true
+		case <-deadline:
+			return false, false
+		case <-c.done:
+			return false, false
+		}
+	}
+}
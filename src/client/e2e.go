@@ -0,0 +1,262 @@
+package client
+
+import (
+	"encoding/base64"
+	"errors"
+	"log"
+	"message"
+	"secure"
+	"strconv"
+	"time"
+)
+
+// How long we wait for the server to give us a key
+const KEY_TIMEOUT = 2 * ACK_TIMEOUT
+
+// How many ids of signed messages we remember to catch the ones sent again
+const SIGNED_IDS = 1000
+
+var ErrNoIdentity = errors.New("End to end encryption is off, there's no identity")
+var ErrNoKey = errors.New("That user has no key, he can't get encrypted messages")
+
+// Encryption says when direct messages and files are encrypted end to
+// end. Without an identity they never are
+type Encryption int
+
+const (
+	ENCRYPT_IF_POSSIBLE Encryption = iota // If the other user has a key, signed but in plain text if he doesn't
+	ENCRYPT_ALWAYS                        // Not sent at all to someone without a key
+	ENCRYPT_NEVER                         // Only signed
+)
+
+// Fingerprint is the one of our identity, others can check it's the same
+// they see in our messages
+func (c *Client) Fingerprint() string {
+	if c.config.Identity == nil {
+		return ""
+	}
+	return c.config.Identity.Fingerprint()
+}
+
+// PeerFingerprint is the fingerprint of the key the server has for nick
+func (c *Client) PeerFingerprint(nick string) (string, error) {
+	key, err := c.PeerKey(nick)
+	if err != nil {
+		return "", err
+	}
+	return secure.Fingerprint(key), nil
+}
+
+// PeerKey asks the server for the public key of nick and waits for it
+func (c *Client) PeerKey(nick string) ([]byte, error) {
+	// One question at a time, or we could take someone else's answer
+	c.keyMutex.Lock()
+	defer c.keyMutex.Unlock()
+	// Forget answers nobody waited for
+	for len(c.keys) > 0 {
+		<-c.keys
+	}
+	m := message.NewKeyRequest(nick)
+	err := c.send(&m)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.After(KEY_TIMEOUT)
+	for {
+		select {
+		case res := <-c.keys:
+			if res.Nickname != nick {
+				continue
+			}
+			if res.Key == "" {
+				return nil, ErrNoKey
+			}
+			return base64.StdEncoding.DecodeString(res.Key)
+		case <-deadline:
+			return nil, ErrNoKey
+		case <-c.done:
+			return nil, ErrClosed
+		}
+	}
+}
+
+// keyFor is the key to encrypt what goes to nick with, nil if it goes in
+// plain text
+func (c *Client) keyFor(nick string) ([]byte, error) {
+	if c.config.Identity == nil || c.config.Encryption == ENCRYPT_NEVER {
+		return nil, nil
+	}
+	key, err := c.PeerKey(nick)
+	if err == ErrNoKey && c.config.Encryption == ENCRYPT_IF_POSSIBLE {
+		log.Println("[Client]", nick, "has no key, it goes signed but not encrypted")
+		return nil, nil
+	}
+	return key, err
+}
+
+// publishKey tells the server our key, so others can encrypt for us
+func (c *Client) publishKey() error {
+	if c.config.Identity == nil {
+		return nil
+	}
+	m := message.NewPublishKey(base64.StdEncoding.EncodeToString(c.config.Identity.Public()))
+	return c.send(&m)
+}
+
+// sealFor encrypts plain for the owner of key, the way it goes in a message
+func (c *Client) sealFor(key []byte, plain []byte) (string, error) {
+	sealed, err := c.config.Identity.SealFor(key, plain)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts something sealed for us, and gives the fingerprint of
+// whoever sealed it
+func (c *Client) open(text string) ([]byte, string, error) {
+	if c.config.Identity == nil {
+		return nil, "", ErrNoIdentity
+	}
+	sealed, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		return nil, "", err
+	}
+	plain, sender, err := c.config.Identity.Open(sealed)
+	if err != nil {
+		return nil, "", err
+	}
+	return plain, secure.Fingerprint(sender), nil
+}
+
+// undecryptable turns something we couldn't open into an error event
+func (c *Client) undecryptable(m *message.ServerPackage, what string, err error) {
+	log.Println("[Client] Couldn't decrypt", what, err)
+	e := message.NewErrorMessage(message.ERR_MALFORMED, m.Header.Id, "Couldn't decrypt "+what)
+	c.emit(Event{Type: ERROR_E, Error: &e})
+}
+
+// ****** Signatures  ****** //
+
+// signed is what a signature covers and the signature itself. The id the
+// sender gave the message goes too, so the server can't send it again as
+// if it were new without us noticing
+type signed struct {
+	Kind       string
+	Id         string
+	From       string
+	To         string
+	Text       string
+	Signature  string
+	SigningKey string
+}
+
+// payload is what gets signed, who it's from and for go too so the server
+// can't pass it as someone else's or send it to someone else. A broadcast
+// is for its channel
+func (p signed) payload() []byte {
+	return []byte(p.Kind + "\x00" + p.Id + "\x00" + p.From + "\x00" + p.To + "\x00" + p.Text)
+}
+
+// signedMessage is what was signed of a message from the server
+func signedMessage(m *message.SMessage, to string) signed {
+	return signed{Kind: m.Type, Id: m.SignedId, From: m.From, To: to, Text: m.Message, Signature: m.Signature, SigningKey: m.SigningKey}
+}
+
+// signedFile is what was signed of a piece of a file, its kind and name
+// too so it can't be passed as another piece
+func signedFile(m *message.FileMessage) signed {
+	text := strconv.Itoa(m.Kind) + "\x00" + m.Filename + "\x00" + m.Cont
+	return signed{Kind: m.Type, Id: m.SignedId, From: m.From, To: m.To, Text: text, Signature: m.Signature, SigningKey: m.SigningKey}
+}
+
+// signature of p with our identity, and the key to check it. Empty if we
+// don't have an identity
+func (c *Client) signature(p signed) (string, string) {
+	if c.config.Identity == nil {
+		return "", ""
+	}
+	signature := base64.StdEncoding.EncodeToString(c.config.Identity.Sign(p.payload()))
+	return signature, base64.StdEncoding.EncodeToString(c.config.Identity.SigningKey())
+}
+
+// sign adds our signature to a message, if we have an identity
+func (c *Client) sign(m *message.UMessage) {
+	to := m.To
+	if m.Type == message.BROAD {
+		to = m.Channel
+	}
+	p := signed{Kind: m.Type, Id: m.Id, From: c.Alias(), To: to, Text: m.Message}
+	m.Signature, m.SigningKey = c.signature(p)
+}
+
+// signFile adds our signature to a piece of a file, once it's encrypted
+func (c *Client) signFile(m *message.FileMessage) {
+	p := signedFile(m)
+	p.Id, p.From = m.Id, c.Alias()
+	m.Signature, m.SigningKey = c.signature(p)
+}
+
+// verify checks the signature of a message from the server against the
+// key we pinned for the sender. A live one is checked against the ones we
+// already got, history can show them as many times as we ask
+func (c *Client) verify(p signed, live bool) Verification {
+	if p.Signature == "" {
+		return UNSIGNED
+	}
+	signature, err := base64.StdEncoding.DecodeString(p.Signature)
+	if err != nil {
+		return FORGED
+	}
+	key, err := base64.StdEncoding.DecodeString(p.SigningKey)
+	if err != nil {
+		return FORGED
+	}
+	if !secure.Verify(key, p.payload(), signature) {
+		log.Println("[Client] Bad signature on a message from", p.From)
+		return FORGED
+	}
+	if live && c.seenSigned(p.From, p.Id) {
+		log.Println("[Client] Got", p.Id, "from", p.From, "again")
+		return REPLAYED
+	}
+	pin, err := c.pins.Check(p.From, key)
+	if err != nil {
+		log.Println("[Client] Couldn't save the key of", p.From, err)
+	}
+	switch pin {
+	case secure.PIN_NEW:
+		return FIRST_SEEN
+	case secure.PIN_MISMATCH:
+		log.Println("[Client] Message from", p.From, "signed by a key that isn't his")
+		return KEY_CHANGED
+	}
+	return SIGNED
+}
+
+// seenSigned says if we already got the message id from someone, and
+// remembers it. Only the last SIGNED_IDS are kept
+func (c *Client) seenSigned(from string, id string) bool {
+	key := from + "\x00" + id
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.signedIds[key] {
+		return true
+	}
+	if c.signedIds == nil {
+		c.signedIds = make(map[string]bool)
+	}
+	if len(c.signedOrder) >= SIGNED_IDS {
+		delete(c.signedIds, c.signedOrder[0])
+		c.signedOrder = c.signedOrder[1:]
+	}
+	c.signedIds[key] = true
+	c.signedOrder = append(c.signedOrder, key)
+	return false
+}
+
+// ForgetKey drops the key pinned for nick, for when he changed it. The
+// next one we see from him is pinned
+func (c *Client) ForgetKey(nick string) error {
+	return c.pins.Forget(nick)
+}
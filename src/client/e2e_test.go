@@ -0,0 +1,55 @@
+package client
+
+import (
+	"message"
+	"secure"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	id, err := secure.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := New(Config{Identity: id})
+	alice.alias = "alice"
+	bob := New(Config{})
+	bob.alias = "bob"
+
+	// What the server makes of a direct message from alice
+	um := message.NewDirectMessage("bob", "Hi bob")
+	alice.sign(&um)
+	dm := message.NewSDirectMessage("alice", um.Message)
+	dm.SignedId, dm.Signature, dm.SigningKey = um.Id, um.Signature, um.SigningKey
+	other := dm
+	other.SignedId = "someone-else-1"
+	unsigned := message.NewSDirectMessage("alice", "Hi bob")
+
+	sent := message.NewFileSend("bob", "a.txt", []byte("some data"))
+	alice.signFile(&sent)
+	piece := message.NewSFile("alice", &sent)
+	end := piece
+	end.Kind = message.FILETRANSFER_END
+
+	// In this order, each one leaves its id and key behind
+	cases := []struct {
+		name string
+		p    signed
+		live bool
+		want Verification
+	}{
+		{"first one", signedMessage(&dm, "bob"), true, FIRST_SEEN},
+		{"sent again", signedMessage(&dm, "bob"), true, REPLAYED},
+		{"again in the history", signedMessage(&dm, "bob"), false, SIGNED},
+		{"another id", signedMessage(&other, "bob"), true, FORGED},
+		{"for someone else", signedMessage(&dm, "carol"), false, FORGED},
+		{"unsigned", signedMessage(&unsigned, "bob"), true, UNSIGNED},
+		{"piece of a file", signedFile(&piece), true, SIGNED},
+		{"piece passed as the end", signedFile(&end), true, FORGED},
+	}
+	for _, c := range cases {
+		if got := bob.verify(c.p, c.live); got != c.want {
+			t.Errorf("%s is %v, want %v", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"message"
+	"time"
+)
+
+// EventType says what happened, and so which fields of the Event are set
+type EventType int
+
+const (
+	LOGIN_E          EventType = iota // The server accepted our nickname. Address
+	DM_E                              // From, Message
+	BROADCAST_E                       // From, Channel, Message
+	USERS_E                           // Users
+	FILE_E                            // File, a piece of a file someone sent us
+	ERROR_E                           // Error
+	CLOCK_E                           // Offset, our clock was adjusted
+	SERVER_LOST_E                     // The server stopped answering
+	SERVER_CHANGED_E                  // We logged in again with a new server
+	RECEIPT_E                         // Receipt, for a message that waited for someone offline
+	HISTORY_E                         // History, From is who the direct messages were with
+	SEARCH_E                          // History has the results, Message what was searched
+	TOPIC_E                           // Channel, Message is its topic and From who set it. We joined or it changed
+	CHANNELS_E                        // Channels
+	KICK_E                            // Kick, From kicked someone out of Channel
+	BAN_E                             // Ban, From banned or unbanned a mask in Channel
+	MUTE_E                            // Mute, From muted or unmuted someone in Channel
+	INVITE_E                          // Invite, From invited us to Channel
+	MODE_E                            // Mode, From changed it in Channel. Without From it's what we asked for
+)
+
+var eventNames = map[EventType]string{
+	LOGIN_E:          "login",
+	DM_E:             "direct message",
+	BROADCAST_E:      "broadcast",
+	USERS_E:          "users",
+	FILE_E:           "file",
+	ERROR_E:          "error",
+	CLOCK_E:          "clock",
+	SERVER_LOST_E:    "server lost",
+	SERVER_CHANGED_E: "server changed",
+	RECEIPT_E:        "receipt",
+	HISTORY_E:        "history",
+	SEARCH_E:         "search",
+	TOPIC_E:          "topic",
+	CHANNELS_E:       "channels",
+	KICK_E:           "kick",
+	BAN_E:            "ban",
+	MUTE_E:           "mute",
+	INVITE_E:         "invite",
+	MODE_E:           "mode",
+}
+
+func (t EventType) String() string {
+	return eventNames[t]
+}
+
+// Verification says what we know about who sent a message
+type Verification int
+
+const (
+	UNSIGNED    Verification = iota // Anyone could have sent it, the server too
+	SIGNED                          // By the key we have pinned for the sender
+	FIRST_SEEN                      // By a key we didn't have for him, it's pinned now
+	KEY_CHANGED                     // By a key that isn't the one pinned for him
+	FORGED                          // The signature is wrong
+	REPLAYED                        // Signed, but we already got it once
+)
+
+var verificationNames = map[Verification]string{
+	UNSIGNED:    "unsigned",
+	SIGNED:      "signed",
+	FIRST_SEEN:  "first seen",
+	KEY_CHANGED: "key changed",
+	FORGED:      "forged",
+	REPLAYED:    "replayed",
+}
+
+func (v Verification) String() string {
+	return verificationNames[v]
+}
+
+// Event is something the server told us, or something that happened to
+// the connection with it. Time is our clock when it happened
+type Event struct {
+	Type    EventType
+	Time    time.Time
+	From    string
+	Channel string
+	Message string
+	Users   []string
+	File    *message.FileMessage
+	Error   *message.ErrorMessage
+	Receipt *message.Receipt
+	// Channels there are, for a CHANNELS_E
+	Channels []message.ChannelInfo
+	// What an operator did in a channel
+	Kick    *message.Kick
+	Ban     *message.Ban
+	Mute    *message.Mute
+	Invite  *message.Invite
+	Mode    *message.Mode
+	Offset  time.Duration
+	Address int
+	// The message or file was encrypted end to end, by the key with this
+	// fingerprint
+	Encrypted   bool
+	Fingerprint string
+	// Whether a direct message, broadcast or piece of a file is really
+	// From who it says
+	Signature Verification
+	// A page of what was said before, oldest first, and if there's more.
+	// For a search it's the results, newest first
+	History     []HistoryItem
+	MoreHistory bool
+}
+
+// HistoryItem is a message from before, decrypted and checked as if it
+// had just come
+type HistoryItem struct {
+	message.HistoryEntry
+	Fingerprint string
+	Signature   Verification
+	Sealed      bool // Encrypted for someone else, Message can't be read
+}
@@ -0,0 +1,136 @@
+package client
+
+import (
+	"log"
+	"message"
+	"time"
+)
+
+// ****** Ordering messages from the server  ****** //
+type heldMessage struct {
+	Type    message.Type
+	Content *message.ServerPackage
+}
+
+// reorderBuffer holds messages that came before the ones they should go
+// after. Until the login response tells us where the server starts counting
+// everything is held
+type reorderBuffer struct {
+	Started  bool
+	Expected uint64
+	Asked    uint64 // Highest order we already asked the server for
+	Held     map[uint64]heldMessage
+	MaxWait  time.Duration
+	timer    *time.Timer
+}
+
+func newReorderBuffer(maxWait time.Duration) *reorderBuffer {
+	return &reorderBuffer{
+		Expected: 1,
+		Held:     make(map[uint64]heldMessage),
+		MaxWait:  maxWait,
+	}
+}
+
+// Expired fires when something has been held for too long. It is nil, so it
+// never fires, when nothing is held
+func (r *reorderBuffer) Expired() <-chan time.Time {
+	if r.timer == nil {
+		return nil
+	}
+	return r.timer.C
+}
+
+// Push adds a message and gives back the ones that can be shown now, and the
+// orders missing that haven't been asked for yet
+func (r *reorderBuffer) Push(order uint64, t message.Type, m *message.ServerPackage) ([]heldMessage, []uint64) {
+	if r.Started && order < r.Expected {
+		log.Println("[Client] Already got message", order)
+		return nil, nil
+	}
+	if _, ok := r.Held[order]; ok {
+		return nil, nil
+	}
+	r.Held[order] = heldMessage{t, m}
+	if !r.Started {
+		r.arm()
+		return nil, nil
+	}
+	ready := r.release()
+	var missing []uint64
+	from := r.Expected
+	if r.Asked >= from {
+		from = r.Asked + 1
+	}
+	for o := from; o < order; o++ {
+		if _, ok := r.Held[o]; !ok {
+			missing = append(missing, o)
+		}
+	}
+	if order > r.Asked {
+		r.Asked = order
+	}
+	r.arm()
+	return ready, missing
+}
+
+// Start sets where the server starts counting, anything older is dropped
+func (r *reorderBuffer) Start(order uint64) []heldMessage {
+	r.Started = true
+	r.Expected = order
+	r.Asked = order - 1
+	for o := range r.Held {
+		if o < order {
+			delete(r.Held, o)
+		}
+	}
+	ready := r.release()
+	r.arm()
+	return ready
+}
+
+// Skip gives up on the missing messages and releases whatever is next
+func (r *reorderBuffer) Skip() []heldMessage {
+	r.timer = nil
+	if len(r.Held) == 0 {
+		return nil
+	}
+	var lowest uint64
+	for o := range r.Held {
+		if lowest == 0 || o < lowest {
+			lowest = o
+		}
+	}
+	r.Started = true
+	r.Expected = lowest
+	ready := r.release()
+	r.arm()
+	return ready
+}
+
+func (r *reorderBuffer) release() []heldMessage {
+	var ready []heldMessage
+	for {
+		h, ok := r.Held[r.Expected]
+		if !ok {
+			return ready
+		}
+		ready = append(ready, h)
+		delete(r.Held, r.Expected)
+		r.Expected++
+	}
+}
+
+// arm starts the wait when something is held and stops it when not
+func (r *reorderBuffer) arm() {
+	if len(r.Held) == 0 {
+		if r.timer != nil {
+			r.timer.Stop()
+			r.timer = nil
+		}
+		return
+	}
+	if r.timer == nil {
+		r.timer = time.NewTimer(r.MaxWait)
+	}
+}
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"message"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// push gives the buffer a message whose type is its order, so we can tell
+// which ones come out
+func push(r *reorderBuffer, order uint64) ([]uint64, []uint64) {
+	held, missing := r.Push(order, message.Type(order), &message.ServerPackage{})
+	return orders(held), missing
+}
+
+func orders(held []heldMessage) []uint64 {
+	var o []uint64
+	for _, h := range held {
+		o = append(o, uint64(h.Type))
+	}
+	return o
+}
+
+// Until the login response says where the server starts nothing comes out,
+// and whatever is older than that is never shown
+func TestReorderBeforeLogin(t *testing.T) {
+	r := newReorderBuffer(time.Hour)
+	for _, order := range []uint64{6, 3, 5} {
+		if ready, missing := push(r, order); ready != nil || missing != nil {
+			t.Fatalf("Before the login %d gave %v and asked for %v", order, ready, missing)
+		}
+	}
+	if r.Expired() == nil {
+		t.Error("Nothing is waiting for what's held")
+	}
+	if ready := orders(r.Start(5)); !reflect.DeepEqual(ready, []uint64{5, 6}) {
+		t.Errorf("The login gave %v", ready)
+	}
+	if ready, _ := push(r, 3); ready != nil {
+		t.Errorf("Something from before the login came out %v", ready)
+	}
+	if r.Expired() != nil {
+		t.Error("Still waiting with nothing held")
+	}
+}
+
+func TestReorderGap(t *testing.T) {
+	r := newReorderBuffer(time.Hour)
+	r.Start(1)
+	if _, missing := push(r, 4); !reflect.DeepEqual(missing, []uint64{1, 2, 3}) {
+		t.Errorf("Asked for %v", missing)
+	}
+	// They were already asked for, only the new gap is
+	if _, missing := push(r, 6); !reflect.DeepEqual(missing, []uint64{5}) {
+		t.Errorf("Asked again for %v", missing)
+	}
+	push(r, 2)
+	push(r, 2)
+	if ready, _ := push(r, 1); !reflect.DeepEqual(ready, []uint64{1, 2}) {
+		t.Errorf("Filling the start gave %v", ready)
+	}
+	if ready, _ := push(r, 3); !reflect.DeepEqual(ready, []uint64{3, 4}) {
+		t.Errorf("Filling the gap gave %v", ready)
+	}
+	if ready, _ := push(r, 4); ready != nil {
+		t.Errorf("A repeated one came out again %v", ready)
+	}
+}
+
+// When the missing one doesn't come the wait runs out and we go on without it
+func TestReorderSkip(t *testing.T) {
+	r := newReorderBuffer(10 * time.Millisecond)
+	if ready := orders(r.Skip()); ready != nil {
+		t.Errorf("Skipping nothing gave %v", ready)
+	}
+	r.Start(1)
+	push(r, 3)
+	push(r, 4)
+	push(r, 7)
+	select {
+	case <-r.Expired():
+	case <-time.After(time.Second):
+		t.Fatal("The wait never ran out")
+	}
+	if ready := orders(r.Skip()); !reflect.DeepEqual(ready, []uint64{3, 4}) {
+		t.Errorf("The first skip gave %v", ready)
+	}
+	if ready := orders(r.Skip()); !reflect.DeepEqual(ready, []uint64{7}) {
+		t.Errorf("The second skip gave %v", ready)
+	}
+	if ready, _ := push(r, 5); ready != nil {
+		t.Errorf("A skipped one came late %v", ready)
+	}
+	if ready, _ := push(r, 8); !reflect.DeepEqual(ready, []uint64{8}) {
+		t.Errorf("After skipping got %v", ready)
+	}
+}
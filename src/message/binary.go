@@ -0,0 +1,249 @@
+package message
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"reflect"
+)
+
+// First byte of every binary message. Text codecs never start with it
+const BINARY_MAGIC = 0xB1
+
+// Second byte, the protocol version the layout of the messages belongs
+// to. The fields have no names, so any change to a message is a new
+// protocol version and a message of another one is refused instead of
+// being read wrong. Binary is only agreed on with who speaks this one
+const BINARY_VERSION = VERSION_2
+
+// The binary codec writes the exported fields of a message in the order
+// they are declared, with no names:
+//   - strings and []byte: uvarint length and then the bytes
+//   - ints as varints, uints as uvarints, bools as one byte
+//   - slices: uvarint count and then each element
+//   - structs: their fields, except for time.Time and such that know how
+//     to marshal themselves, those go as length prefixed bytes
+//
+// xml.Name fields are skipped. Since every message starts with Base the
+// first thing after the magic byte and the version is always the Type
+type binaryCodec struct{}
+
+var xmlNameType = reflect.TypeOf(xml.Name{})
+var binaryMarshalerType = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+
+var errShortMessage = errors.New("Binary message is too short")
+var errBinaryVersion = errors.New("Binary message of a version we don't speak")
+
+func (binaryCodec) Name() string {
+	return CODEC_BINARY
+}
+
+func (binaryCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(BINARY_MAGIC)
+	buf.WriteByte(BINARY_VERSION)
+	err := encodeValue(&buf, reflect.Indirect(reflect.ValueOf(v)))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (binaryCodec) Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("Can only unmarshal into a pointer")
+	}
+	body, err := binaryBody(data)
+	if err != nil {
+		return err
+	}
+	return decodeValue(bytes.NewReader(body), rv.Elem())
+}
+
+func (binaryCodec) Kind(data []byte) (string, error) {
+	body, err := binaryBody(data)
+	if err != nil {
+		return "", err
+	}
+	b, err := readBytes(bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// binaryBody is what comes after the magic byte and the version
+func binaryBody(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != BINARY_MAGIC {
+		return nil, errors.New("Not a binary message")
+	}
+	if len(data) < 2 {
+		return nil, errShortMessage
+	}
+	if data[1] != BINARY_VERSION {
+		return nil, errBinaryVersion
+	}
+	return data[2:], nil
+}
+
+func encodeValue(buf *bytes.Buffer, v reflect.Value) error {
+	var tmp [binary.MaxVarintLen64]byte
+	if v.Type().Implements(binaryMarshalerType) && v.Kind() == reflect.Struct {
+		b, err := v.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		writeBytes(buf, b)
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		writeBytes(buf, []byte(v.String()))
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := binary.PutVarint(tmp[:], v.Int())
+		buf.Write(tmp[:n])
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n := binary.PutUvarint(tmp[:], v.Uint())
+		buf.Write(tmp[:n])
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			writeBytes(buf, v.Bytes())
+			return nil
+		}
+		n := binary.PutUvarint(tmp[:], uint64(v.Len()))
+		buf.Write(tmp[:n])
+		for i := 0; i < v.Len(); i++ {
+			err := encodeValue(buf, v.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" || f.Type == xmlNameType || f.Type.Kind() == reflect.Interface {
+				continue
+			}
+			err := encodeValue(buf, v.Field(i))
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New("Binary codec can't encode " + v.Type().String())
+	}
+	return nil
+}
+
+func decodeValue(r *bytes.Reader, v reflect.Value) error {
+	if v.Kind() == reflect.Struct && reflect.PtrTo(v.Type()).Implements(binaryMarshalerType) {
+		b, err := readBytes(r)
+		if err != nil {
+			return err
+		}
+		u, ok := v.Addr().Interface().(encoding.BinaryUnmarshaler)
+		if !ok {
+			return errors.New("Binary codec can't decode " + v.Type().String())
+		}
+		return u.UnmarshalBinary(b)
+	}
+	switch v.Kind() {
+	case reflect.String:
+		b, err := readBytes(r)
+		if err != nil {
+			return err
+		}
+		v.SetString(string(b))
+	case reflect.Bool:
+		b, err := r.ReadByte()
+		if err != nil {
+			return errShortMessage
+		}
+		v.SetBool(b != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := binary.ReadVarint(r)
+		if err != nil {
+			return errShortMessage
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return errShortMessage
+		}
+		v.SetUint(n)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := readBytes(r)
+			if err != nil {
+				return err
+			}
+			v.SetBytes(b)
+			return nil
+		}
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return errShortMessage
+		}
+		// Every element takes at least a byte
+		if n > uint64(r.Len()) {
+			return errShortMessage
+		}
+		s := reflect.MakeSlice(v.Type(), int(n), int(n))
+		for i := 0; i < int(n); i++ {
+			err := decodeValue(r, s.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" || f.Type == xmlNameType || f.Type.Kind() == reflect.Interface {
+				continue
+			}
+			err := decodeValue(r, v.Field(i))
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New("Binary codec can't decode " + v.Type().String())
+	}
+	return nil
+}
+
+func writeBytes(buf *bytes.Buffer, b []byte) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64(len(b)))
+	buf.Write(tmp[:n])
+	buf.Write(b)
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, errShortMessage
+	}
+	if n > uint64(r.Len()) {
+		return nil, errShortMessage
+	}
+	b := make([]byte, n)
+	_, err = r.Read(b)
+	if err != nil && n > 0 {
+		return nil, errShortMessage
+	}
+	return b, nil
+}
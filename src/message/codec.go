@@ -0,0 +1,182 @@
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"regexp"
+	"strconv"
+)
+
+const (
+	CODEC_XML    = "xml"
+	CODEC_JSON   = "json"
+	CODEC_BINARY = "binary"
+)
+
+// Codec is how messages are written to the wire. XML is what everybody
+// understands, the others are chosen at login
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	// Kind reads just the Type of the message, without decoding the rest
+	Kind(data []byte) (string, error)
+}
+
+var XML Codec = xmlCodec{}
+var JSON Codec = jsonCodec{}
+var Binary Codec = binaryCodec{}
+
+// DefaultCodec is used until both sides agree on something else
+var DefaultCodec = XML
+
+var codecs = map[string]Codec{
+	CODEC_XML:    XML,
+	CODEC_JSON:   JSON,
+	CODEC_BINARY: Binary,
+}
+
+func CodecByName(name string) (Codec, bool) {
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// NegotiateCodec picks the first codec of the list that we know. The
+// list goes from the most to the least wanted. Binary is only for the
+// protocol version its messages are laid out for
+func NegotiateCodec(names []string, version int) Codec {
+	for _, name := range names {
+		if name == CODEC_BINARY && version != BINARY_VERSION {
+			continue
+		}
+		if c, ok := codecs[name]; ok {
+			return c
+		}
+	}
+	return DefaultCodec
+}
+
+// DetectCodec tells the codec of a message by its first byte, so the
+// reader doesn't need to know what was negotiated
+func DetectCodec(data []byte) Codec {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	if len(data) == 0 {
+		return DefaultCodec
+	}
+	switch data[0] {
+	case '{':
+		return JSON
+	case BINARY_MAGIC:
+		return Binary
+	}
+	return XML
+}
+
+// IsBinary tells if a datagram isn't text, so no one should trim it
+func IsBinary(data []byte) bool {
+	return len(data) > 0 && (data[0] == BINARY_MAGIC || data[0] == FRAGMENT_MAGIC)
+}
+
+// Whatever proves who sent a message, a log is no place for it
+var xmlSecrets = regexp.MustCompile(`<(Token|Cookie|Session)>[^<]*</`)
+var jsonSecrets = regexp.MustCompile(`"(Token|Cookie|Session)":"(?:[^"\\]|\\.)*"`)
+
+// Redact gives data as it can go in a log, with the session token and
+// the cookie starred out. Binary messages only say how big they are
+func Redact(data []byte) string {
+	switch DetectCodec(data) {
+	case Binary:
+		return "(" + strconv.Itoa(len(data)) + " bytes of binary)"
+	case JSON:
+		return jsonSecrets.ReplaceAllString(string(data), `"$1":"***"`)
+	}
+	return xmlSecrets.ReplaceAllString(string(data), "<$1>***</")
+}
+
+///// XML
+type xmlCodec struct{}
+
+func (xmlCodec) Name() string {
+	return CODEC_XML
+}
+
+func (xmlCodec) Marshal(v interface{}) ([]byte, error) {
+	return xml.Marshal(v)
+}
+
+func (xmlCodec) Unmarshal(data []byte, v interface{}) error {
+	return xml.Unmarshal(data, v)
+}
+
+// Type is the first element under the root, so this stops early
+func (xmlCodec) Kind(data []byte) (string, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	depth := 0
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return "", err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 2 && t.Name.Local == "Type" {
+				var kind string
+				err := d.DecodeElement(&kind, &t)
+				return kind, err
+			}
+		case xml.EndElement:
+			depth--
+			if depth == 0 {
+				return "", errors.New("Message has no type")
+			}
+		}
+	}
+}
+
+///// JSON
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return CODEC_JSON
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// Kind walks the keys of the object until it finds Type, which is
+// usually the first one
+func (jsonCodec) Kind(data []byte) (string, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	tok, err := d.Token()
+	if err != nil {
+		return "", err
+	}
+	if tok != json.Delim('{') {
+		return "", errors.New("Message is not an object")
+	}
+	for d.More() {
+		key, err := d.Token()
+		if err != nil {
+			return "", err
+		}
+		if key == "Type" {
+			var kind string
+			err := d.Decode(&kind)
+			return kind, err
+		}
+		var skip json.RawMessage
+		err = d.Decode(&skip)
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", errors.New("Message has no type")
+}
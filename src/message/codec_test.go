@@ -0,0 +1,180 @@
+package message
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNegotiateCodec(t *testing.T) {
+	if c := NegotiateCodec([]string{"msgpack", CODEC_BINARY, CODEC_JSON}, BINARY_VERSION); c != Binary {
+		t.Errorf("Picked %s instead of the first one we know", c.Name())
+	}
+	if c := NegotiateCodec([]string{"msgpack"}, VERSION_2); c != DefaultCodec {
+		t.Errorf("Picked %s when we know none of them", c.Name())
+	}
+	// Old clients don't say anything
+	if c := NegotiateCodec(nil, VERSION_1); c != DefaultCodec {
+		t.Errorf("Picked %s for an old client", c.Name())
+	}
+	// Binary messages are laid out for one version
+	if c := NegotiateCodec([]string{CODEC_BINARY, CODEC_JSON}, BINARY_VERSION+1); c != JSON {
+		t.Errorf("Picked %s for another version", c.Name())
+	}
+}
+
+func TestDetectCodec(t *testing.T) {
+	login := NewLogin("alice")
+	for _, c := range []Codec{XML, JSON, Binary} {
+		b, err := c.Marshal(&login)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := DetectCodec(b); got != c {
+			t.Errorf("%s detected as %s", c.Name(), got.Name())
+		}
+	}
+	if got := DetectCodec([]byte("\r\n  {\"Type\":\"Login\"}")); got != JSON {
+		t.Errorf("JSON after blank lines detected as %s", got.Name())
+	}
+	if got := DetectCodec(nil); got != DefaultCodec {
+		t.Errorf("Nothing detected as %s", got.Name())
+	}
+}
+
+// The binary codec has no names, so everything has to come back where it was
+func TestBinaryRoundTrip(t *testing.T) {
+	dm := NewDirectMessage("bob", "héllo <there> & \"you\"\x00")
+	var gotDm UMessage
+	roundTrip(t, &dm, &gotDm)
+	if !reflect.DeepEqual(dm, gotDm) {
+		t.Errorf("Direct message is %+v, want %+v", gotDm, dm)
+	}
+
+	// Slices of structs, and an empty one
+	connected := NewSGetConnected([]string{"alice", "", "bob"})
+	var gotConnected SGetConnected
+	roundTrip(t, &connected, &gotConnected)
+	if !reflect.DeepEqual(connected.Users.ConnUsers, gotConnected.Users.ConnUsers) {
+		t.Errorf("Users are %v, want %v", gotConnected.Users.ConnUsers, connected.Users.ConnUsers)
+	}
+	none := NewSGetConnected(nil)
+	gotConnected = SGetConnected{}
+	roundTrip(t, &none, &gotConnected)
+	if len(gotConnected.Users.ConnUsers) != 0 {
+		t.Errorf("Nobody came back as %v", gotConnected.Users.ConnUsers)
+	}
+
+	// Times marshal themselves, durations are just ints and can go back
+	clock := NewClockSyncPetition(time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC))
+	var gotClock ClockSyncPetition
+	roundTrip(t, &clock, &gotClock)
+	if !gotClock.Time.Equal(clock.Time) {
+		t.Errorf("Time is %v, want %v", gotClock.Time, clock.Time)
+	}
+	offset := NewClockOffset(-1500 * time.Millisecond)
+	var gotOffset ClockOffset
+	roundTrip(t, &offset, &gotOffset)
+	if gotOffset.Offset != offset.Offset {
+		t.Errorf("Offset is %v, want %v", gotOffset.Offset, offset.Offset)
+	}
+
+	// Big numbers don't fit in a byte
+	gaps := NewGapRequest([]uint64{1, 300, 1 << 40})
+	var gotGaps GapRequest
+	roundTrip(t, &gaps, &gotGaps)
+	if !reflect.DeepEqual(gaps.Missing, gotGaps.Missing) {
+		t.Errorf("Missing is %v, want %v", gotGaps.Missing, gaps.Missing)
+	}
+}
+
+func roundTrip(t *testing.T, in interface{}, out interface{}) {
+	b, err := Binary.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kind, err := Binary.Kind(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := reflect.ValueOf(in).Elem().FieldByName("Type").String(); kind != want {
+		t.Errorf("Kind is %q, want %q", kind, want)
+	}
+	if err := Binary.Unmarshal(b, out); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Whatever comes from the network can't make us panic or allocate for
+// lengths it doesn't have
+func TestBinaryMalformed(t *testing.T) {
+	login := NewLogin("alice")
+	login.Codecs = []string{CODEC_BINARY, CODEC_XML}
+	whole, err := Binary.Marshal(&login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Login
+	for i := 0; i < len(whole); i++ {
+		if err := Binary.Unmarshal(whole[:i], &got); err == nil {
+			t.Errorf("Cut at %d of %d has no error", i, len(whole))
+		}
+	}
+	if err := Binary.Unmarshal(whole[1:], &got); err == nil {
+		t.Error("No magic byte has no error")
+	}
+	if err := Binary.Unmarshal([]byte{BINARY_MAGIC, BINARY_VERSION, 0xff, 0xff, 0xff, 0xff, 0x0f}, &got); err == nil {
+		t.Error("A string longer than the message has no error")
+	}
+	// Another version lays the fields out some other way
+	other := append([]byte{}, whole...)
+	other[1]++
+	if err := Binary.Unmarshal(other, &got); err != errBinaryVersion {
+		t.Errorf("Another version gave %v", err)
+	}
+	if _, err := Binary.Kind(other); err != errBinaryVersion {
+		t.Errorf("Kind of another version gave %v", err)
+	}
+	// The count of missing ones is the last thing before them
+	gaps := NewGapRequest([]uint64{1, 2})
+	b, err := Binary.Marshal(&gaps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	huge := append(append([]byte{}, b[:len(b)-3]...), 0xff, 0xff, 0xff, 0x7f)
+	var gotGaps GapRequest
+	if err := Binary.Unmarshal(huge, &gotGaps); err == nil {
+		t.Error("More missing ones than the message has no error")
+	}
+	if err := Binary.Unmarshal(whole, got); err == nil {
+		t.Error("Unmarshaling into a value has no error")
+	}
+	if _, err := Binary.Kind([]byte{BINARY_MAGIC, BINARY_VERSION, 10, 'L'}); err == nil {
+		t.Error("Kind of a cut type has no error")
+	}
+}
+
+// Nothing that lets someone take over a session goes in a log
+func TestRedact(t *testing.T) {
+	dm := NewDirectMessage("bob", `say "Token":"x" <Token>y</Token>`)
+	dm.Token, dm.Cookie = "the-token", "the-cookie"
+	res := NewLoginResponse(1, 1, CODEC_JSON, VERSION_2, nil, "the-session")
+	for _, c := range []Codec{XML, JSON, Binary} {
+		for _, m := range []interface{}{&dm, &res} {
+			b, err := c.Marshal(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := Redact(b)
+			for _, secret := range []string{"the-token", "the-cookie", "the-session"} {
+				if strings.Contains(got, secret) {
+					t.Errorf("%s has %s: %s", c.Name(), secret, got)
+				}
+			}
+			if c != Binary && m == &dm && !strings.Contains(got, "bob") {
+				t.Errorf("%s lost the rest: %s", c.Name(), got)
+			}
+		}
+	}
+}
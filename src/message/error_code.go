@@ -0,0 +1,51 @@
+package message
+
+// ErrorCode says what went wrong so the client can do something about it,
+// the text of the error is just for humans. Never change the numbers
+type ErrorCode int
+
+const (
+	ERR_UNKNOWN           ErrorCode = 0
+	ERR_NICK_TAKEN        ErrorCode = 1
+	ERR_UNKNOWN_RECIPIENT ErrorCode = 2
+	ERR_NOT_LOGGED_IN     ErrorCode = 3
+	ERR_BLOCKED           ErrorCode = 4
+	ERR_MALFORMED         ErrorCode = 5
+	ERR_RATE_LIMITED      ErrorCode = 6
+	ERR_VERSION           ErrorCode = 7
+	ERR_UNSUPPORTED       ErrorCode = 8  // Unknown type or capability that wasn't agreed
+	ERR_AUTH              ErrorCode = 9  // Wrong password for a registered nickname
+	ERR_QUEUE_FULL        ErrorCode = 10 // The recipient is offline and can't get more messages
+	ERR_NOT_IN_CHANNEL    ErrorCode = 11 // Only members can do that in the channel
+	ERR_NOT_OPERATOR      ErrorCode = 12 // Needs a higher role in the channel
+	ERR_BANNED            ErrorCode = 13 // Can't join the channel, a ban matches him
+	ERR_MUTED             ErrorCode = 14 // Can't talk in the channel now
+	ERR_INVITE_ONLY       ErrorCode = 15 // Can't join the channel without an invite
+)
+
+var errorCodeNames = map[ErrorCode]string{
+	ERR_UNKNOWN:           "unknown",
+	ERR_NICK_TAKEN:        "nickname taken",
+	ERR_UNKNOWN_RECIPIENT: "unknown recipient",
+	ERR_NOT_LOGGED_IN:     "not logged in",
+	ERR_BLOCKED:           "blocked",
+	ERR_MALFORMED:         "malformed",
+	ERR_RATE_LIMITED:      "rate limited",
+	ERR_VERSION:           "unsupported version",
+	ERR_UNSUPPORTED:       "unsupported",
+	ERR_AUTH:              "wrong password",
+	ERR_QUEUE_FULL:        "queue full",
+	ERR_NOT_IN_CHANNEL:    "not in channel",
+	ERR_NOT_OPERATOR:      "not an operator",
+	ERR_BANNED:            "banned",
+	ERR_MUTED:             "muted",
+	ERR_INVITE_ONLY:       "invite only",
+}
+
+func (c ErrorCode) String() string {
+	name, ok := errorCodeNames[c]
+	if !ok {
+		return errorCodeNames[ERR_UNKNOWN]
+	}
+	return name
+}
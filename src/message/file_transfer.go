@@ -11,30 +11,47 @@ const (
 )
 
 type FileMessage struct {
-	XMLName xml.Name `xml:"Root"`
+	XMLName xml.Name `xml:"Root" json:"-"`
 	Base
 	Kind     int    `xml:"Kind"`
+	From     string `xml:"From,omitempty" json:",omitempty"` // The server fills it in
 	To       string `xml:To`
 	Filename string `xml:"Id"`
 	Cont     string `xml:"Content"`
+	Order    uint64 `xml:"Order,omitempty"` // Chunks have to be written in order
+	// Cont can only be read by the one it's for
+	Encrypted bool `xml:"Encrypted,omitempty" json:",omitempty"`
+	// Each piece is signed like a direct message
+	SignedId   string `xml:"SignedId,omitempty" json:",omitempty"`
+	Signature  string `xml:"Signature,omitempty" json:",omitempty"`
+	SigningKey string `xml:"SigningKey,omitempty" json:",omitempty"`
 }
 
 func NewFileStart(to string, filename string) FileMessage {
-	base := Base{Type: FILE}
+	base := newBase(FILE)
 	f := FileMessage{Base: base, Kind: FILETRANSFER_START, To: to, Filename: filename}
 	return f
 }
 
 func NewFileSend(to string, filename string, payload []byte) FileMessage {
-	base := Base{Type: FILE}
+	base := newBase(FILE)
 	f := FileMessage{Base: base, Kind: FILETRANSFER_MID, To: to, Filename: filename, Cont: string(payload[:len(payload)])}
 	return f
 }
 
 func NewFileEnd(to string, filename string) FileMessage {
-	base := Base{Type: FILE}
+	base := newBase(FILE)
 	f := FileMessage{Base: base, Kind: FILETRANSFER_END, To: to, Filename: filename}
 	return f
 }
 
+// NewSFile is a piece of a file as the server passes it on, with nothing
+// of the sender's session and the id he signed it with
+func NewSFile(from string, f *FileMessage) FileMessage {
+	base := newBase(FILE)
+	s := FileMessage{Base: base, Kind: f.Kind, From: from, To: f.To, Filename: f.Filename, Cont: f.Cont, Encrypted: f.Encrypted}
+	s.SignedId, s.Signature, s.SigningKey = f.Id, f.Signature, f.SigningKey
+	return s
+}
+
 // TODO Need to add a different file for "from" and "to"
@@ -0,0 +1,211 @@
+package message
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Anything bigger than MAX_DATAGRAM is split in fragments, each one with
+// a small header so the other side can put them back together:
+//
+//	magic (1 byte) | set (4 bytes) | index (2 bytes) | total (2 bytes) | piece
+//
+// The set is a number the sender gives to all the fragments of a payload
+const (
+	FRAGMENT_MAGIC   = 0xF7
+	FRAGMENT_HEADER  = 9
+	MAX_DATAGRAM     = 1024
+	MAX_FRAGMENTS    = 1024
+	FRAGMENT_TIMEOUT = 5 * time.Second
+)
+
+var lastFragmentSet uint32
+
+// ErrTooBig is what Fragment says when a payload needs more fragments
+// than the other side would take back
+var ErrTooBig = errors.New("Message is too big to send")
+
+// Fragment splits payload in datagrams of at most max bytes. If it already
+// fits it goes as it is
+func Fragment(payload []byte, max int) ([][]byte, error) {
+	if len(payload) <= max {
+		return [][]byte{payload}, nil
+	}
+	size := max - FRAGMENT_HEADER
+	if size <= 0 {
+		return nil, errors.New("Datagrams too small for a fragment")
+	}
+	total := (len(payload) + size - 1) / size
+	// Reassemblers drop sets past MAX_FRAGMENTS, and the total has to fit
+	// in its 2 bytes
+	if total > MAX_FRAGMENTS || total > 0xffff {
+		return nil, ErrTooBig
+	}
+	set := atomic.AddUint32(&lastFragmentSet, 1)
+	fragments := make([][]byte, 0, total)
+	for i := 0; i < total; i++ {
+		end := (i + 1) * size
+		if end > len(payload) {
+			end = len(payload)
+		}
+		piece := payload[i*size : end]
+		f := make([]byte, FRAGMENT_HEADER+len(piece))
+		f[0] = FRAGMENT_MAGIC
+		binary.BigEndian.PutUint32(f[1:5], set)
+		binary.BigEndian.PutUint16(f[5:7], uint16(i))
+		binary.BigEndian.PutUint16(f[7:9], uint16(total))
+		copy(f[FRAGMENT_HEADER:], piece)
+		fragments = append(fragments, f)
+	}
+	return fragments, nil
+}
+
+func IsFragment(datagram []byte) bool {
+	return len(datagram) >= FRAGMENT_HEADER && datagram[0] == FRAGMENT_MAGIC
+}
+
+// Reassembler puts fragments back together. Sets are only unique for a
+// sender, so they are kept by sender. It isn't safe to use from several
+// goroutines, each reader has its own
+//
+// Anyone can send the first fragment of a set and never the rest, so what
+// can be waiting is limited for each sender and for everyone. Fragments
+// past the limits are dropped, their sets never finish and expire
+type Reassembler struct {
+	Timeout     time.Duration
+	SenderSets  int // Sets waiting for one sender
+	SenderBytes int
+	TotalSets   int // And for everyone
+	TotalBytes  int
+	sets        map[string]*fragmentSet
+	senders     map[string]*senderUse
+	bytes       int
+	lastExpire  time.Time
+}
+
+// Defaults of the limits. A sender can always have the biggest payload on
+// its way. Each part costs a bit more than its bytes, or tiny fragments
+// would get around the limits
+const (
+	REASSEMBLY_SENDER_SETS  = 16
+	REASSEMBLY_SENDER_BYTES = 2 * MAX_FRAGMENTS * MAX_DATAGRAM
+	REASSEMBLY_TOTAL_SETS   = 4096
+	REASSEMBLY_TOTAL_BYTES  = 64 << 20
+	REASSEMBLY_PART_COST    = 64
+)
+
+// Parts come in any order, they are only kept when they arrive
+type fragmentSet struct {
+	From    string
+	Parts   map[int][]byte
+	Total   int
+	Size    int
+	Cost    int // Size and what keeping the parts costs
+	Started time.Time
+}
+
+type senderUse struct {
+	Sets  int
+	Bytes int
+}
+
+func NewReassembler(timeout time.Duration) *Reassembler {
+	return &Reassembler{
+		Timeout:     timeout,
+		SenderSets:  REASSEMBLY_SENDER_SETS,
+		SenderBytes: REASSEMBLY_SENDER_BYTES,
+		TotalSets:   REASSEMBLY_TOTAL_SETS,
+		TotalBytes:  REASSEMBLY_TOTAL_BYTES,
+		sets:        make(map[string]*fragmentSet),
+		senders:     make(map[string]*senderUse),
+	}
+}
+
+// Add gives back the whole payload once all of its fragments are in. A
+// datagram that isn't a fragment comes back as it is
+func (r *Reassembler) Add(from string, datagram []byte, now time.Time) ([]byte, bool) {
+	if now.Sub(r.lastExpire) > r.Timeout {
+		r.Expire(now)
+	}
+	if !IsFragment(datagram) {
+		return datagram, true
+	}
+	set := binary.BigEndian.Uint32(datagram[1:5])
+	index := int(binary.BigEndian.Uint16(datagram[5:7]))
+	total := int(binary.BigEndian.Uint16(datagram[7:9]))
+	if total == 0 || total > MAX_FRAGMENTS || index >= total {
+		return nil, false
+	}
+	size := len(datagram) - FRAGMENT_HEADER
+	if size == 0 {
+		return nil, false
+	}
+	cost := size + REASSEMBLY_PART_COST
+	use, ok := r.senders[from]
+	if !ok {
+		use = &senderUse{}
+	}
+	if use.Bytes+cost > r.SenderBytes || r.bytes+cost > r.TotalBytes {
+		return nil, false
+	}
+	key := from + "/" + strconv.FormatUint(uint64(set), 10)
+	s, ok := r.sets[key]
+	if !ok {
+		if use.Sets >= r.SenderSets || len(r.sets) >= r.TotalSets {
+			return nil, false
+		}
+		s = &fragmentSet{From: from, Parts: make(map[int][]byte), Total: total, Started: now}
+		r.sets[key] = s
+		r.senders[from] = use
+		use.Sets++
+	}
+	if s.Total != total || s.Parts[index] != nil {
+		// Repeated or doesn't match the rest of the set
+		return nil, false
+	}
+	piece := make([]byte, size)
+	copy(piece, datagram[FRAGMENT_HEADER:])
+	s.Parts[index] = piece
+	s.Size += size
+	s.Cost += cost
+	use.Bytes += cost
+	r.bytes += cost
+	if len(s.Parts) < total {
+		return nil, false
+	}
+	r.drop(key, s)
+	payload := make([]byte, 0, s.Size)
+	for i := 0; i < total; i++ {
+		payload = append(payload, s.Parts[i]...)
+	}
+	return payload, true
+}
+
+// drop forgets a set, finished or not
+func (r *Reassembler) drop(key string, s *fragmentSet) {
+	delete(r.sets, key)
+	r.bytes -= s.Cost
+	use := r.senders[s.From]
+	use.Sets--
+	use.Bytes -= s.Cost
+	if use.Sets == 0 {
+		delete(r.senders, s.From)
+	}
+}
+
+// Expire drops the sets that have been waiting for too long, their missing
+// fragments aren't coming. Returns how many were dropped
+func (r *Reassembler) Expire(now time.Time) int {
+	r.lastExpire = now
+	dropped := 0
+	for key, s := range r.sets {
+		if now.Sub(s.Started) > r.Timeout {
+			r.drop(key, s)
+			dropped++
+		}
+	}
+	return dropped
+}
@@ -0,0 +1,241 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func payload(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+// fragment makes up a fragment of a set
+func fragment(set uint32, index, total int, piece []byte) []byte {
+	f := make([]byte, FRAGMENT_HEADER, FRAGMENT_HEADER+len(piece))
+	f[0] = FRAGMENT_MAGIC
+	binary.BigEndian.PutUint32(f[1:5], set)
+	binary.BigEndian.PutUint16(f[5:7], uint16(index))
+	binary.BigEndian.PutUint16(f[7:9], uint16(total))
+	return append(f, piece...)
+}
+
+func mustFragment(t *testing.T, p []byte) [][]byte {
+	t.Helper()
+	fragments, err := Fragment(p, MAX_DATAGRAM)
+	if err != nil {
+		t.Fatal("Couldn't fragment", err)
+	}
+	return fragments
+}
+
+func TestFragmentFits(t *testing.T) {
+	p := payload(MAX_DATAGRAM)
+	fragments := mustFragment(t, p)
+	if len(fragments) != 1 || !bytes.Equal(fragments[0], p) {
+		t.Fatalf("A payload of exactly %d bytes went in %d fragments", MAX_DATAGRAM, len(fragments))
+	}
+	if IsFragment(fragments[0]) {
+		t.Error("A payload that fits is taken as a fragment")
+	}
+}
+
+func TestFragment(t *testing.T) {
+	p := payload(3*MAX_DATAGRAM + 1)
+	fragments := mustFragment(t, p)
+	// The header takes some room, so three full datagrams aren't enough
+	if len(fragments) != 4 {
+		t.Fatalf("Went in %d fragments, want 4", len(fragments))
+	}
+	set := binary.BigEndian.Uint32(fragments[0][1:5])
+	var back []byte
+	for i, f := range fragments {
+		if len(f) > MAX_DATAGRAM || !IsFragment(f) {
+			t.Errorf("Fragment %d has %d bytes", i, len(f))
+		}
+		if s := binary.BigEndian.Uint32(f[1:5]); s != set {
+			t.Errorf("Fragment %d is of set %d, the first one of %d", i, s, set)
+		}
+		index, total := binary.BigEndian.Uint16(f[5:7]), binary.BigEndian.Uint16(f[7:9])
+		if int(index) != i || total != 4 {
+			t.Errorf("Fragment %d says it's %d of %d", i, index, total)
+		}
+		back = append(back, f[FRAGMENT_HEADER:]...)
+	}
+	if !bytes.Equal(back, p) {
+		t.Error("The pieces aren't the payload")
+	}
+	if next := mustFragment(t, p); binary.BigEndian.Uint32(next[0][1:5]) == set {
+		t.Error("Two payloads got the same set")
+	}
+}
+
+func TestFragmentTooBig(t *testing.T) {
+	size := MAX_DATAGRAM - FRAGMENT_HEADER
+	if fragments, err := Fragment(payload(MAX_FRAGMENTS*size), MAX_DATAGRAM); err != nil || len(fragments) != MAX_FRAGMENTS {
+		t.Errorf("The biggest payload went in %d fragments, error %v", len(fragments), err)
+	}
+	// One more byte and the other side would drop it
+	if _, err := Fragment(payload(MAX_FRAGMENTS*size+1), MAX_DATAGRAM); err != ErrTooBig {
+		t.Errorf("A payload of %d fragments gave %v", MAX_FRAGMENTS+1, err)
+	}
+	if _, err := Fragment(payload(10), FRAGMENT_HEADER); err == nil {
+		t.Error("Datagrams with no room for a piece have no error")
+	}
+}
+
+func TestReassembler(t *testing.T) {
+	now := time.Now()
+	want := payload(5000)
+	fragments := mustFragment(t, want)
+	r := NewReassembler(time.Second)
+
+	// Backwards, and the last one twice
+	last := fragments[len(fragments)-1]
+	var got []byte
+	wholes := 0
+	for i := len(fragments) - 1; i >= 0; i-- {
+		if i == len(fragments)-2 {
+			r.Add("a", last, now)
+		}
+		if whole, ok := r.Add("a", fragments[i], now); ok {
+			got = whole
+			wholes++
+		}
+	}
+	if wholes != 1 || !bytes.Equal(got, want) {
+		t.Errorf("Got %d payloads, the last one of %d bytes", wholes, len(got))
+	}
+	if len(r.sets) != 0 {
+		t.Errorf("%d sets left", len(r.sets))
+	}
+
+	// Whatever isn't a fragment comes as it is
+	if whole, ok := r.Add("a", []byte("<Root/>"), now); !ok || string(whole) != "<Root/>" {
+		t.Errorf("Got %q", whole)
+	}
+}
+
+// Two senders numbering their sets the same don't mix
+func TestReassemblerSenders(t *testing.T) {
+	now := time.Now()
+	r := NewReassembler(time.Second)
+	r.Add("a", fragment(1, 0, 2, []byte("from ")), now)
+	r.Add("b", fragment(1, 0, 2, []byte("to ")), now)
+	if whole, ok := r.Add("b", fragment(1, 1, 2, []byte("b")), now); !ok || string(whole) != "to b" {
+		t.Errorf("b got %q", whole)
+	}
+	if whole, ok := r.Add("a", fragment(1, 1, 2, []byte("a")), now); !ok || string(whole) != "from a" {
+		t.Errorf("a got %q", whole)
+	}
+}
+
+func TestReassemblerRejects(t *testing.T) {
+	now := time.Now()
+	r := NewReassembler(time.Second)
+	for _, f := range [][]byte{
+		fragment(1, 0, 0, []byte("x")),
+		fragment(2, 0, MAX_FRAGMENTS+1, []byte("x")),
+		fragment(3, 2, 2, []byte("x")),
+	} {
+		if whole, ok := r.Add("a", f, now); ok {
+			t.Errorf("Got %q", whole)
+		}
+	}
+	if len(r.sets) != 0 {
+		t.Errorf("Kept %d sets of bad fragments", len(r.sets))
+	}
+	// A fragment that says the set is bigger than it is doesn't finish it
+	r.Add("a", fragment(4, 0, 2, []byte("x")), now)
+	if whole, ok := r.Add("a", fragment(4, 1, 3, []byte("y")), now); ok {
+		t.Errorf("Got %q", whole)
+	}
+}
+
+func TestReassemblerExpire(t *testing.T) {
+	now := time.Now()
+	r := NewReassembler(time.Second)
+	r.Add("a", fragment(1, 0, 2, []byte("old ")), now)
+	r.Add("b", fragment(1, 0, 2, []byte("new ")), now.Add(500*time.Millisecond))
+	if dropped := r.Expire(now.Add(1200 * time.Millisecond)); dropped != 1 {
+		t.Errorf("Dropped %d sets, want 1", dropped)
+	}
+	// The rest of the expired one starts over and never finishes
+	if whole, ok := r.Add("a", fragment(1, 1, 2, []byte("a")), now.Add(1300*time.Millisecond)); ok {
+		t.Errorf("a got %q", whole)
+	}
+	if whole, ok := r.Add("b", fragment(1, 1, 2, []byte("b")), now.Add(1300*time.Millisecond)); !ok || string(whole) != "new b" {
+		t.Errorf("b got %q", whole)
+	}
+}
+
+// Sets that never finish can't take more than the limits, and what they
+// took is given back when they finish or expire
+func TestReassemblerLimits(t *testing.T) {
+	now := time.Now()
+	piece := payload(100)
+	cost := len(piece) + REASSEMBLY_PART_COST
+
+	r := NewReassembler(time.Second)
+	r.SenderSets = 2
+	r.Add("a", fragment(1, 0, 2, piece), now)
+	r.Add("a", fragment(2, 0, 2, piece), now)
+	r.Add("a", fragment(3, 0, 2, piece), now)
+	if len(r.sets) != 2 {
+		t.Errorf("a has %d sets waiting, the limit is 2", len(r.sets))
+	}
+	if _, ok := r.Add("a", fragment(3, 1, 2, piece), now); ok {
+		t.Error("A set over the limit finished")
+	}
+	r.Add("b", fragment(1, 0, 2, piece), now)
+	if len(r.sets) != 3 {
+		t.Error("b is limited by what a sent")
+	}
+	// Once one of them finishes a has room again
+	if _, ok := r.Add("a", fragment(1, 1, 2, piece), now); !ok {
+		t.Fatal("A set under the limit didn't finish")
+	}
+	r.Add("a", fragment(3, 0, 2, piece), now)
+	if _, ok := r.Add("a", fragment(3, 1, 2, piece), now); !ok {
+		t.Error("a can't send a new set after one finished")
+	}
+
+	// Bytes count the parts that are in, not the whole set
+	r = NewReassembler(time.Second)
+	r.SenderBytes = 3 * cost
+	r.TotalBytes = 5 * cost
+	r.Add("a", fragment(1, 0, 4, piece), now)
+	r.Add("a", fragment(1, 1, 4, piece), now)
+	r.Add("a", fragment(1, 2, 4, piece), now)
+	if _, ok := r.Add("a", fragment(1, 3, 4, piece), now); ok {
+		t.Error("A set bigger than the bytes of a sender finished")
+	}
+	r.Add("b", fragment(1, 0, 3, piece), now)
+	r.Add("b", fragment(1, 1, 3, piece), now)
+	r.Add("c", fragment(1, 0, 2, piece), now)
+	if r.bytes != 5*cost {
+		t.Errorf("%d bytes kept, the limit is %d", r.bytes, 5*cost)
+	}
+
+	// Tiny pieces still cost, and empty ones aren't kept at all
+	r = NewReassembler(time.Second)
+	r.TotalSets = 1
+	if _, ok := r.Add("a", fragment(1, 0, 2, nil), now); ok || len(r.sets) != 0 {
+		t.Error("An empty piece opened a set")
+	}
+	r.Add("a", fragment(1, 0, 2, []byte("x")), now)
+	r.Add("b", fragment(1, 0, 2, []byte("x")), now)
+	if len(r.sets) != 1 || r.bytes != 1+REASSEMBLY_PART_COST {
+		t.Errorf("%d sets and %d bytes kept", len(r.sets), r.bytes)
+	}
+
+	r.Expire(now.Add(2 * time.Second))
+	if len(r.sets) != 0 || len(r.senders) != 0 || r.bytes != 0 {
+		t.Errorf("After expiring there are %d sets, %d senders and %d bytes", len(r.sets), len(r.senders), r.bytes)
+	}
+}
@@ -1,8 +1,13 @@
 package message
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/xml"
 	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,6 +26,28 @@ const (
 	LOGIN_RES   = "LoginResponse"
 	VOTE        = "Vote"
 	COORDINATOR = "Coordinator"
+	ACK         = "Ack"
+	GAP         = "Gap"
+	REGISTER    = "Register"
+	PUBLISH_KEY = "PublishKey"
+	KEY_REQ     = "KeyRequest"
+	KEY_RES     = "KeyResponse"
+	CHALLENGE   = "Challenge"
+	RECEIPT     = "Receipt"
+	HISTORY_REQ = "HistoryRequest"
+	HISTORY_RES = "HistoryResponse"
+	SEARCH      = "Search"
+	SEARCH_RES  = "SearchResponse"
+	JOIN        = "Join"
+	PART        = "Part"
+	TOPIC       = "Topic"
+	LIST        = "List"
+	LIST_RES    = "ChannelList"
+	KICK        = "Kick"
+	BAN         = "Ban"
+	MUTE        = "Mute"
+	INVITE      = "Invite"
+	MODE        = "Mode"
 )
 
 type Type int
@@ -41,57 +68,206 @@ const (
 	LOGIN_RES_T   Type = iota
 	VOTE_T        Type = iota
 	COORDINATOR_T Type = iota
+	ACK_T         Type = iota
+	GAP_T         Type = iota
+	REGISTER_T    Type = iota
+	PUBLISH_KEY_T Type = iota
+	KEY_REQ_T     Type = iota
+	KEY_RES_T     Type = iota
+	CHALLENGE_T   Type = iota
+	RECEIPT_T     Type = iota
+	HISTORY_REQ_T Type = iota
+	HISTORY_RES_T Type = iota
+	SEARCH_T      Type = iota
+	SEARCH_RES_T  Type = iota
+	JOIN_T        Type = iota
+	PART_T        Type = iota
+	TOPIC_T       Type = iota
+	LIST_T        Type = iota
+	LIST_RES_T    Type = iota
+	KICK_T        Type = iota
+	BAN_T         Type = iota
+	MUTE_T        Type = iota
+	INVITE_T      Type = iota
+	MODE_T        Type = iota
 )
 
+// Every message carries an id assigned by whoever created it, so the
+// other side can tell exactly which message it is confirming. Seq is
+// the counter the id was built from, and it only grows for a sender.
+// Token is the session the server gave the client at login, so he is
+// still himself if his address changes
 type Base struct {
-	Type string `xml:"Type"`
+	Type  string `xml:"Type"`
+	Id    string `xml:"MsgId,omitempty" json:",omitempty"`
+	Seq   uint64 `xml:"Seq,omitempty" json:",omitempty"`
+	Token string `xml:"Token,omitempty" json:",omitempty"`
+	// Cookie proves the address, see Challenge
+	Cookie string `xml:"Cookie,omitempty" json:",omitempty"`
 }
 
-// Message sent from the client when he wants to login
+// MessageId lets the senders get the id of any message, since all
+// of them embed Base
+func (b Base) MessageId() string {
+	return b.Id
+}
+
+// Instance is the part of the id that tells which process made it, its
+// seq counts from 1 again in a new one
+func (b Base) Instance() string {
+	i := strings.LastIndex(b.Id, "-")
+	if i < 0 {
+		return ""
+	}
+	return b.Id[:i]
+}
+
+// Identified is satisfied by every message
+type Identified interface {
+	MessageId() string
+}
+
+// SetToken is for pointers to messages, the client signs everything
+// with his session before sending it
+func (b *Base) SetToken(token string) {
+	b.Token = token
+}
+
+// Tokened is satisfied by a pointer to any message
+type Tokened interface {
+	SetToken(token string)
+}
+
+// Ids are "<instance>-<seq>", the instance part is random so two
+// processes won't hand out the same ids
+var instance string
+var lastSeq uint64
+
+func init() {
+	b := make([]byte, 4)
+	_, err := rand.Read(b)
+	if err != nil {
+		// Not random, but good enough to tell processes apart
+		instance = fmt.Sprintf("%x", time.Now().UnixNano())
+		return
+	}
+	instance = hex.EncodeToString(b)
+}
+
+func newBase(t string) Base {
+	seq := atomic.AddUint64(&lastSeq, 1)
+	return Base{Type: t, Id: fmt.Sprintf("%s-%d", instance, seq), Seq: seq}
+}
+
+// Message sent from the client when he wants to login. Codecs,
+// versions and capabilities are the ones he has, the server answers
+// with the ones it picked. Password is only needed for registered
+// nicknames
 type Login struct {
-	XMLName xml.Name `xml:"Root"`
+	XMLName xml.Name `xml:"Root" json:"-"`
+	Base
+	Nickname     string   `xml:"Nickname"`
+	Codecs       []string `xml:"Codecs>Codec"`
+	Versions     []int    `xml:"Versions>Version"`
+	Capabilities []string `xml:"Capabilities>Capability"`
+	Password     string   `xml:"Password,omitempty" json:",omitempty"`
+}
+
+// HasPassword tells if messages of kind may carry a password, those
+// shouldn't be written to any log
+func HasPassword(kind string) bool {
+	return kind == LOGIN || kind == REGISTER
+}
+
+// Register creates an account for a nickname, from then on logging in
+// with it needs the password
+type Register struct {
+	XMLName xml.Name `xml:"Root" json:"-"`
 	Base
 	Nickname string `xml:"Nickname"`
+	Password string `xml:"Password"`
+}
+
+// Challenge is the answer to a Login or Register without a good cookie,
+// and to a session that shows up from a new address. Sending it again
+// with this one proves we can reach whoever sent it, before the server
+// keeps anything or sends him anything big
+type Challenge struct {
+	XMLName xml.Name `xml:"Root" json:"-"`
+	Base
+	Ref string `xml:"Ref"` // The cookie goes in Base
+}
+
+// SetCookie is for pointers to messages, logins and registers always
+// carry one and anything else only when it was challenged
+func (b *Base) SetCookie(cookie string) {
+	b.Cookie = cookie
+}
+
+// Cookied is satisfied by a pointer to any message
+type Cookied interface {
+	SetCookie(cookie string)
 }
 
 type LoginResponse struct {
-	XMLName xml.Name `xml:"Root"`
+	XMLName xml.Name `xml:"Root" json:"-"`
 	Base
-	Address int `xml:"address"`
+	Address      int      `xml:"address"`
+	Order        uint64   `xml:"Order"` // First order the server will use in this session
+	Codec        string   `xml:"Codec"`
+	Version      int      `xml:"Version"`
+	Capabilities []string `xml:"Capabilities>Capability"`
+	Session      string   `xml:"Session,omitempty" json:",omitempty"` // Token for the rest of the messages
+	Channel      string   `xml:"Channel,omitempty" json:",omitempty"` // Where broadcasts without a channel go, we are in it
 }
 
-// Message a user sends to server. It covers both
-// Broadcast and direct message
+// Message a user sends to server. It covers both Broadcast and direct
+// message. A broadcast goes to the members of Channel, or of the default
+// one if it's empty. An Encrypted message can only be read by the one it's
+// for, the server relays it as it is. So is the Signature, done with
+// SigningKey, both in base64
 type UMessage struct {
-	XMLName xml.Name `xml:"Root"`
+	XMLName xml.Name `xml:"Root" json:"-"`
 	Base
-	To      string `xml:"To"`
-	Message string `xml:"Message"`
+	To         string `xml:"To"`
+	Channel    string `xml:"Channel,omitempty" json:",omitempty"`
+	Message    string `xml:"Message"`
+	Encrypted  bool   `xml:"Encrypted,omitempty" json:",omitempty"`
+	Signature  string `xml:"Signature,omitempty" json:",omitempty"`
+	SigningKey string `xml:"SigningKey,omitempty" json:",omitempty"`
 }
 
-// Message the server will sent to a user
+// Message the server will sent to a user. Order is given by the
+// server for each recipient, so he can show them in the same order
+// they were sent
 type SMessage struct {
-	XMLName xml.Name `xml:"Root"`
+	XMLName xml.Name `xml:"Root" json:"-"`
 	Base
-	From    string `xml:"From"`
-	Message string `xml:"Message"`
+	From       string `xml:"From"`
+	Channel    string `xml:"Channel,omitempty" json:",omitempty"` // Of a broadcast
+	Message    string `xml:"Message"`
+	Order      uint64 `xml:"Order,omitempty"`
+	Encrypted  bool   `xml:"Encrypted,omitempty" json:",omitempty"`
+	SignedId   string `xml:"SignedId,omitempty" json:",omitempty"` // The id the sender gave it, he signed it
+	Signature  string `xml:"Signature,omitempty" json:",omitempty"`
+	SigningKey string `xml:"SigningKey,omitempty" json:",omitempty"`
 }
 
 // When the user request connected users, he will
 // only specify that as type. Hence no need for more fields
 type UGetConnected struct {
-	XMLName xml.Name `xml:"Root"`
+	XMLName xml.Name `xml:"Root" json:"-"`
 	Base
 }
 
 type SGetConnected struct {
 	Base
-	XMLName xml.Name `xml:"Root"`
+	XMLName xml.Name `xml:"Root" json:"-"`
 	Users   Users
 }
 
 type Users struct {
-	XMLName   xml.Name
+	XMLName   xml.Name      `json:"-"`
 	ConnUsers []GetConnUser `xml:"User"`
 }
 
@@ -101,28 +277,36 @@ type GetConnUser struct {
 
 // Since user will only specify exit no extra fields are needed
 type UExit struct {
-	XMLName xml.Name `xml:"Root"`
+	XMLName xml.Name `xml:"Root" json:"-"`
 	Base
 }
 
 type Block struct {
-	XMLName xml.Name `xml:"Root"`
+	XMLName xml.Name `xml:"Root" json:"-"`
 	Base
-	Blocker string
+	Blocker string // The server takes whoever sent it instead
 	Blocked string
 }
 
+// ErrorMessage tells the client what went wrong. Ref is the id of the
+// message that caused it, if any. When a login is rejected because of
+// the version it says which ones the server speaks
 type ErrorMessage struct {
-	XMLName xml.Name `xml:"Root"`
+	XMLName xml.Name `xml:"Root" json:"-"`
 	Base
-	Message string `xml:"Message"`
+	Code     ErrorCode `xml:"Code"`
+	Ref      string    `xml:"Ref,omitempty" json:",omitempty"`
+	Message  string    `xml:"Message"`
+	Versions []int     `xml:"Versions>Version,omitempty"`
+	// For ERR_RATE_LIMITED, milliseconds until it's worth trying again
+	RetryAfter int64 `xml:"RetryAfter,omitempty" json:",omitempty"`
 }
 
 // ClockMessage is send by the server
 // so clients will respond with
 // the offset from this time
 type ClockSyncPetition struct {
-	XMLName xml.Name `xml:"Root"`
+	XMLName xml.Name `xml:"Root" json:"-"`
 	Base
 	Time time.Time `xml:"Time"`
 }
@@ -131,30 +315,261 @@ type ClockSyncPetition struct {
 // saying "Im n duration ahead/behind you", and server
 // respons with this message to make adjustments
 type ClockOffset struct {
-	XMLName xml.Name `xml:"Root"`
+	XMLName xml.Name `xml:"Root" json:"-"`
 	Base
 	Offset time.Duration `xml:"offset"`
 }
 
 type AddressMessage struct {
-	XMLName xml.Name `xml:"Root"`
+	XMLName xml.Name `xml:"Root" json:"-"`
 	Base
 	Address int `xml:"Address"`
 }
 
 // Election system
 type VoteMessage struct {
-	XMLName xml.Name `xml:"Root"`
+	XMLName xml.Name `xml:"Root" json:"-"`
 	Base
 	Number int `xml:"Number"` // Because it can just be anything
 }
 
 type CoordinatorMessage struct {
-	XMLName xml.Name `xml:"Root"`
+	XMLName xml.Name `xml:"Root" json:"-"`
 	Base
 	Address string `xml:"Address"` // The new address to conect to
 }
 
+// GapRequest is sent by a client that got ordered messages with
+// holes in between, asking for the ones he is missing
+type GapRequest struct {
+	XMLName xml.Name `xml:"Root" json:"-"`
+	Base
+	Missing []uint64 `xml:"Missing>Order"`
+}
+
+// PublishKey gives the server the public key other clients use to
+// encrypt what they send us. Keys go in base64
+type PublishKey struct {
+	XMLName xml.Name `xml:"Root" json:"-"`
+	Base
+	Key string `xml:"Key"`
+}
+
+// KeyRequest asks the server for the public key of a user
+type KeyRequest struct {
+	XMLName xml.Name `xml:"Root" json:"-"`
+	Base
+	Nickname string `xml:"Nickname"`
+}
+
+// HistoryRequest asks for what was said before. With is who the direct
+// messages were with, a #channel, or empty for the default channel. It
+// gives the last Limit messages before the one with id Before and before
+// the time Until, if they are set
+type HistoryRequest struct {
+	XMLName xml.Name `xml:"Root" json:"-"`
+	Base
+	With   string    `xml:"With,omitempty" json:",omitempty"`
+	Limit  int       `xml:"Limit"`
+	Before string    `xml:"Before,omitempty" json:",omitempty"`
+	Until  time.Time `xml:"Until"`
+}
+
+// HistoryResponse has the messages oldest first. More says there are
+// older ones, the id of the first one is where to ask from
+type HistoryResponse struct {
+	XMLName xml.Name `xml:"Root" json:"-"`
+	Base
+	With    string         `xml:"With,omitempty" json:",omitempty"`
+	Entries []HistoryEntry `xml:"Entry"`
+	More    bool           `xml:"More"`
+}
+
+// HistoryEntry is a broadcast or a direct message as the server got it.
+// An encrypted one can only be read by To
+type HistoryEntry struct {
+	Id         string    `xml:"Id"`
+	Time       time.Time `xml:"Time"`
+	Kind       string    `xml:"Kind"` // BROAD or DM
+	From       string    `xml:"From"`
+	To         string    `xml:"To,omitempty" json:",omitempty"`
+	Channel    string    `xml:"Channel,omitempty" json:",omitempty"` // Of a broadcast
+	Message    string    `xml:"Message"`
+	Encrypted  bool      `xml:"Encrypted,omitempty" json:",omitempty"`
+	SignedId   string    `xml:"SignedId,omitempty" json:",omitempty"`
+	Signature  string    `xml:"Signature,omitempty" json:",omitempty"`
+	SigningKey string    `xml:"SigningKey,omitempty" json:",omitempty"`
+}
+
+// Search looks for the broadcasts of our channels and our own direct
+// messages that have every word of Query, and every "quoted phrase" as it
+// is. From, Since and Until narrow it down if they are set. Results come
+// newest first, Before is the id of the last one we got to see the next
+// page
+type Search struct {
+	XMLName xml.Name `xml:"Root" json:"-"`
+	Base
+	Query  string    `xml:"Query"`
+	From   string    `xml:"From,omitempty" json:",omitempty"`
+	Since  time.Time `xml:"Since"`
+	Until  time.Time `xml:"Until"`
+	Limit  int       `xml:"Limit"`
+	Before string    `xml:"Before,omitempty" json:",omitempty"`
+}
+
+type SearchResponse struct {
+	XMLName xml.Name `xml:"Root" json:"-"`
+	Base
+	Query   string         `xml:"Query"`
+	Results []HistoryEntry `xml:"Result"`
+	More    bool           `xml:"More"`
+}
+
+// Join puts us in a channel, it's made if nobody was in it. The server
+// answers with its Topic
+type Join struct {
+	XMLName xml.Name `xml:"Root" json:"-"`
+	Base
+	Channel string `xml:"Channel"`
+}
+
+// Part takes us out of a channel
+type Part struct {
+	XMLName xml.Name `xml:"Root" json:"-"`
+	Base
+	Channel string `xml:"Channel"`
+}
+
+// Topic changes what a channel is about, or asks for it if Topic is
+// empty. The server sends it to whoever joins and to every member when it
+// changes, By is who set it
+type Topic struct {
+	XMLName xml.Name `xml:"Root" json:"-"`
+	Base
+	Channel string `xml:"Channel"`
+	Topic   string `xml:"Topic"`
+	By      string `xml:"By,omitempty" json:",omitempty"`
+}
+
+// ListChannels asks for the channels there are
+type ListChannels struct {
+	XMLName xml.Name `xml:"Root" json:"-"`
+	Base
+}
+
+type ChannelList struct {
+	XMLName xml.Name `xml:"Root" json:"-"`
+	Base
+	Channels []ChannelInfo `xml:"Channel"`
+}
+
+// ChannelInfo is a channel as it shows in the list. Members counts the
+// ones online
+type ChannelInfo struct {
+	Name    string `xml:"Name"`
+	Topic   string `xml:"Topic"`
+	Members int    `xml:"Members"`
+	Modes   string `xml:"Modes,omitempty" json:",omitempty"`
+}
+
+// Modes of a channel, and the roles that can be given in it, for Mode
+const (
+	MODE_INVITE_ONLY = "i" // Only who was invited can join
+	MODE_MODERATED   = "m" // Only voiced users and up can talk
+	MODE_OPERATOR    = "o"
+	MODE_VOICE       = "v"
+)
+
+// The messages below are for the operators of a channel. The server tells
+// everyone in it what was done, with By set to who did it
+
+// Kick takes Nickname out of Channel, he can join again
+type Kick struct {
+	XMLName xml.Name `xml:"Root" json:"-"`
+	Base
+	Channel  string `xml:"Channel"`
+	Nickname string `xml:"Nickname"`
+	Reason   string `xml:"Reason,omitempty" json:",omitempty"`
+	By       string `xml:"By,omitempty" json:",omitempty"`
+}
+
+// Ban keeps whoever matches Mask out of Channel, or lets them back if
+// Remove is set. A mask is a nickname, nickname@address or @address, *
+// matches anything and the address can be a range like @10.0.0.0/8
+type Ban struct {
+	XMLName xml.Name `xml:"Root" json:"-"`
+	Base
+	Channel string `xml:"Channel"`
+	Mask    string `xml:"Mask"`
+	Remove  bool   `xml:"Remove,omitempty" json:",omitempty"`
+	By      string `xml:"By,omitempty" json:",omitempty"`
+}
+
+// Mute keeps Nickname quiet in Channel for a while, or until Remove
+type Mute struct {
+	XMLName xml.Name `xml:"Root" json:"-"`
+	Base
+	Channel  string        `xml:"Channel"`
+	Nickname string        `xml:"Nickname"`
+	For      time.Duration `xml:"For"` // The server picks if it's 0
+	Remove   bool          `xml:"Remove,omitempty" json:",omitempty"`
+	By       string        `xml:"By,omitempty" json:",omitempty"`
+}
+
+// Invite lets Nickname join Channel once even if it's invite only. Only
+// he is told
+type Invite struct {
+	XMLName xml.Name `xml:"Root" json:"-"`
+	Base
+	Channel  string `xml:"Channel"`
+	Nickname string `xml:"Nickname"`
+	By       string `xml:"By,omitempty" json:",omitempty"`
+}
+
+// Mode sets (+) or clears (-) a mode of Channel, like +i, or gives and
+// takes a role from Nickname, like +o or -v. An empty Mode asks for them,
+// the answer has every mode set and Bans
+type Mode struct {
+	XMLName xml.Name `xml:"Root" json:"-"`
+	Base
+	Channel  string   `xml:"Channel"`
+	Mode     string   `xml:"Mode"`
+	Nickname string   `xml:"Nickname,omitempty" json:",omitempty"`
+	By       string   `xml:"By,omitempty" json:",omitempty"`
+	Bans     []string `xml:"Bans>Ban" json:",omitempty"`
+}
+
+// What happened to a message that waited for someone offline
+const (
+	RECEIPT_DELIVERED = "delivered"
+	RECEIPT_EXPIRED   = "expired"
+)
+
+// Receipt tells the sender of a message that had to wait for To if he
+// got it or it expired. Ref is the id it was sent with
+type Receipt struct {
+	XMLName xml.Name `xml:"Root" json:"-"`
+	Base
+	Ref    string `xml:"Ref"`
+	To     string `xml:"To"`
+	Status string `xml:"Status"`
+}
+
+// KeyResponse is the public key of a user, empty if he didn't publish one
+type KeyResponse struct {
+	XMLName xml.Name `xml:"Root" json:"-"`
+	Base
+	Nickname string `xml:"Nickname"`
+	Key      string `xml:"Key"`
+}
+
+// Ack confirms that the messages with the given ids got to the other side
+type Ack struct {
+	XMLName xml.Name `xml:"Root" json:"-"`
+	Base
+	Ids []string `xml:"Ids>Id"`
+}
+
 // This type will decode an incoming message
 // The UserPackage will hold the actual values
 type UserMessage struct {
@@ -174,17 +589,35 @@ type ClientToClientMessage struct {
 
 // Client-to-server
 type UserPackage struct {
+	Header        Base // Type, id and sequence of whatever came in
 	Block         *Block
 	Login         *Login
+	Register      *Register
 	UMessage      *UMessage
 	UGetConnected *UGetConnected
 	UExit         *UExit
 	File          *FileMessage
 	Clock         *ClockOffset
+	Gap           *GapRequest
+	PublishKey    *PublishKey
+	KeyRequest    *KeyRequest
+	History       *HistoryRequest
+	Search        *Search
+	Join          *Join
+	Part          *Part
+	Topic         *Topic
+	List          *ListChannels
+	Kick          *Kick
+	Ban           *Ban
+	Mute          *Mute
+	Invite        *Invite
+	Mode          *Mode
+	Ack           *Ack
 }
 
 // Server-to-client
 type ServerPackage struct {
+	Header    Base
 	Direct    *SMessage
 	Connected *SGetConnected
 	Block     *Block
@@ -194,6 +627,83 @@ type ServerPackage struct {
 	Offset    *ClockOffset
 	Address   *AddressMessage
 	Login     *LoginResponse
+	Key       *KeyResponse
+	Challenge *Challenge
+	Receipt   *Receipt
+	History   *HistoryResponse
+	Search    *SearchResponse
+	Topic     *Topic
+	Channels  *ChannelList
+	Kick      *Kick
+	Ban       *Ban
+	Mute      *Mute
+	Invite    *Invite
+	Mode      *Mode
+	Ack       *Ack
+}
+
+// Message is the one message in the package, as the pointer the server
+// sent it as
+func (p *ServerPackage) Message() interface{} {
+	switch {
+	case p.Direct != nil:
+		return p.Direct
+	case p.Connected != nil:
+		return p.Connected
+	case p.Block != nil:
+		return p.Block
+	case p.Error != nil:
+		return p.Error
+	case p.File != nil:
+		return p.File
+	case p.Clock != nil:
+		return p.Clock
+	case p.Offset != nil:
+		return p.Offset
+	case p.Address != nil:
+		return p.Address
+	case p.Login != nil:
+		return p.Login
+	case p.Key != nil:
+		return p.Key
+	case p.Challenge != nil:
+		return p.Challenge
+	case p.Receipt != nil:
+		return p.Receipt
+	case p.History != nil:
+		return p.History
+	case p.Search != nil:
+		return p.Search
+	case p.Topic != nil:
+		return p.Topic
+	case p.Channels != nil:
+		return p.Channels
+	case p.Kick != nil:
+		return p.Kick
+	case p.Ban != nil:
+		return p.Ban
+	case p.Mute != nil:
+		return p.Mute
+	case p.Invite != nil:
+		return p.Invite
+	case p.Mode != nil:
+		return p.Mode
+	case p.Ack != nil:
+		return p.Ack
+	}
+	return nil
+}
+
+// Order gives the order the server put on the message, 0 if it
+// isn't one of the ordered ones
+func (p *ServerPackage) Order() uint64 {
+	switch {
+	case p.Direct != nil:
+		return p.Direct.Order
+	case p.File != nil:
+		return p.File.Order
+	}
+	return 0
 }
 
 // Client-to-client
@@ -202,329 +712,350 @@ type UserToUserPackage struct {
 	CoordinatorMessage *CoordinatorMessage
 }
 
+// headed is every message, they all embed Base
+type headed interface {
+	header() Base
+}
+
+func (b Base) header() Base {
+	return b
+}
+
+// decodeAs unmarshals msg into v, which already is the struct for kind
+func decodeAs(c Codec, msg []byte, kind string, v headed) (Base, error) {
+	err := c.Unmarshal(msg, v)
+	if err != nil {
+		return Base{}, errors.New("Couldn't decode the message: " + kind + " malformed")
+	}
+	return v.header(), nil
+}
+
+// The decoders find out the codec and the type of the message and then
+// unmarshal it only once, straight into its struct
 func DecodeClientToClientMessage(msg []byte) (Type, *UserToUserPackage, error) {
-	var m ClientToClientMessage
-	err := xml.Unmarshal(msg, &m)
+	c := DetectCodec(msg)
+	kind, err := c.Kind(msg)
 	if err != nil {
 		return UNKNOWN_T, nil, err
 	}
-	switch m.Type {
+	var uu UserToUserPackage
+	var v headed
+	var t Type
+	switch kind {
 	case VOTE:
-		var v VoteMessage
-		err := xml.Unmarshal(msg, &v)
-		if err != nil {
-			return UNKNOWN_T, nil, errors.New("Couldn't decode the message: Broadcast or direct message malformed")
-		}
-		uu := UserToUserPackage{
-			VoteMessage: &v,
-		}
-		return VOTE_T, &uu, nil
+		uu.VoteMessage = &VoteMessage{}
+		v, t = uu.VoteMessage, VOTE_T
 	case COORDINATOR:
-		var v CoordinatorMessage
-		err := xml.Unmarshal(msg, &v)
-		if err != nil {
-			return UNKNOWN_T, nil, errors.New("Couldn't decode the message: Broadcast or direct message malformed")
-		}
-		uu := UserToUserPackage{
-			CoordinatorMessage: &v,
-		}
-		return COORDINATOR_T, &uu, nil
+		uu.CoordinatorMessage = &CoordinatorMessage{}
+		v, t = uu.CoordinatorMessage, COORDINATOR_T
+	default:
+		return UNKNOWN_T, nil, errors.New("Couldn't decode the message: No matching type")
 	}
-	return UNKNOWN_T, nil, errors.New("Couldn't decode the message: No matching type")
+	_, err = decodeAs(c, msg, kind, v)
+	if err != nil {
+		return UNKNOWN_T, nil, err
+	}
+	return t, &uu, nil
 }
 
 // Decode message FROM the server
 func DecodeServerMessage(msg []byte) (Type, *ServerPackage, error) {
-	var m ServerMessage
-	err := xml.Unmarshal(msg, &m)
+	c := DetectCodec(msg)
+	kind, err := c.Kind(msg)
 	if err != nil {
 		return UNKNOWN_T, nil, err
 	}
-	switch m.Type {
+	var sp ServerPackage
+	var v headed
+	var t Type
+	switch kind {
 	case LOGIN_RES:
-		var b LoginResponse
-		err := xml.Unmarshal(msg, &b)
-		if err != nil {
-			return UNKNOWN_T, nil, errors.New("Couldn't decode the message: Broadcast or direct message malformed")
-		}
-		mp := ServerPackage{
-			Login: &b,
-		}
-		return LOGIN_RES_T, &mp, nil
-
+		sp.Login = &LoginResponse{}
+		v, t = sp.Login, LOGIN_RES_T
 	case BROAD, DM:
-		var b SMessage
-		err := xml.Unmarshal(msg, &b)
-		if err != nil {
-			return UNKNOWN_T, nil, errors.New("Couldn't decode the message: Broadcast or direct message malformed")
-		}
-		mp := ServerPackage{
-			Direct:    &b,
-			Connected: nil,
-			Error:     nil,
-		}
-		if m.Type == BROAD {
-			return BROAD_T, &mp, nil
+		sp.Direct = &SMessage{}
+		v, t = sp.Direct, DM_T
+		if kind == BROAD {
+			t = BROAD_T
 		}
-		return DM_T, &mp, nil
 	case GET_CONN:
-		var u SGetConnected
-		err := xml.Unmarshal(msg, &u)
-		if err != nil {
-			return UNKNOWN_T, nil, errors.New("Couldn't decode the message: Get connected malformed")
-		}
-		mp := ServerPackage{
-			Direct:    nil,
-			Connected: &u,
-			Error:     nil,
-		}
-		return GET_CONN_T, &mp, nil
-
+		sp.Connected = &SGetConnected{}
+		v, t = sp.Connected, GET_CONN_T
 	// TODO think this isn't used
 	case BLOCK:
-		var b Block
-		err := xml.Unmarshal(msg, &b)
-		if err != nil {
-			return UNKNOWN_T, nil, errors.New("Couldn't decode the message: Block message malformed")
-		}
-		mp := ServerPackage{
-			Block: &b,
-		}
-		return BLOCK_T, &mp, nil
-
+		sp.Block = &Block{}
+		v, t = sp.Block, BLOCK_T
 	case FILE:
-		var f FileMessage
-		err := xml.Unmarshal(msg, &f)
-		if err != nil {
-			return UNKNOWN_T, nil, errors.New("Couldn't decode the message: File message malformed")
-		}
-		mp := ServerPackage{
-			File: &f,
-		}
-
-		return FILE_T, &mp, nil
-
+		sp.File = &FileMessage{}
+		v, t = sp.File, FILE_T
 	case CLOCK:
-		var c ClockSyncPetition
-		err := xml.Unmarshal(msg, &c)
-		if err != nil {
-			return UNKNOWN_T, nil, errors.New("Couldn't decode the message: File message malformed")
-		}
-		mp := ServerPackage{
-			Clock: &c,
-		}
-
-		return CLOCK_T, &mp, nil
-
+		sp.Clock = &ClockSyncPetition{}
+		v, t = sp.Clock, CLOCK_T
 	case OFFSET:
-		var c ClockOffset
-		err := xml.Unmarshal(msg, &c)
-		if err != nil {
-			return UNKNOWN_T, nil, errors.New("Couldn't decode the message: File message malformed")
-		}
-		mp := ServerPackage{
-			Offset: &c,
-		}
-
-		return OFFSET_T, &mp, nil
-
+		sp.Offset = &ClockOffset{}
+		v, t = sp.Offset, OFFSET_T
 	case ADDRESS:
-		var a AddressMessage
-		err := xml.Unmarshal(msg, &a)
-		if err != nil {
-			return UNKNOWN_T, nil, errors.New("Couldn't decode the message: File message malformed")
-		}
-		sp := ServerPackage{
-			Address: &a,
-		}
-
-		return ADDRESS_T, &sp, nil
-
+		sp.Address = &AddressMessage{}
+		v, t = sp.Address, ADDRESS_T
+	case ACK:
+		sp.Ack = &Ack{}
+		v, t = sp.Ack, ACK_T
 	case ERROR:
-		var u ErrorMessage
-		err := xml.Unmarshal(msg, &u)
-		if err != nil {
-			return UNKNOWN_T, nil, errors.New("Couldn't decode the message: Exit message malformed")
-		}
-		mp := ServerPackage{
-			Direct:    nil,
-			Connected: nil,
-			Error:     &u,
-		}
-		return ERROR_T, &mp, nil
+		sp.Error = &ErrorMessage{}
+		v, t = sp.Error, ERROR_T
+	case KEY_RES:
+		sp.Key = &KeyResponse{}
+		v, t = sp.Key, KEY_RES_T
+	case CHALLENGE:
+		sp.Challenge = &Challenge{}
+		v, t = sp.Challenge, CHALLENGE_T
+	case RECEIPT:
+		sp.Receipt = &Receipt{}
+		v, t = sp.Receipt, RECEIPT_T
+	case HISTORY_RES:
+		sp.History = &HistoryResponse{}
+		v, t = sp.History, HISTORY_RES_T
+	case SEARCH_RES:
+		sp.Search = &SearchResponse{}
+		v, t = sp.Search, SEARCH_RES_T
+	case TOPIC:
+		sp.Topic = &Topic{}
+		v, t = sp.Topic, TOPIC_T
+	case LIST_RES:
+		sp.Channels = &ChannelList{}
+		v, t = sp.Channels, LIST_RES_T
+	case KICK:
+		sp.Kick = &Kick{}
+		v, t = sp.Kick, KICK_T
+	case BAN:
+		sp.Ban = &Ban{}
+		v, t = sp.Ban, BAN_T
+	case MUTE:
+		sp.Mute = &Mute{}
+		v, t = sp.Mute, MUTE_T
+	case INVITE:
+		sp.Invite = &Invite{}
+		v, t = sp.Invite, INVITE_T
+	case MODE:
+		sp.Mode = &Mode{}
+		v, t = sp.Mode, MODE_T
 	default:
 		return UNKNOWN_T, nil, errors.New("Couldn't decode the message: No matching type")
 	}
+	sp.Header, err = decodeAs(c, msg, kind, v)
+	if err != nil {
+		return UNKNOWN_T, nil, err
+	}
+	return t, &sp, nil
 }
 
-// temp function
+// DecodeHeader reads only the Base of a message, whatever its type is.
+// It's for types this package doesn't know about
+func DecodeHeader(msg []byte) (Base, error) {
+	var h struct {
+		Base
+	}
+	err := DetectCodec(msg).Unmarshal(msg, &h)
+	if err != nil {
+		return Base{}, errors.New("Couldn't decode the message: malformed header")
+	}
+	return h.Base, nil
+}
+
+// Decode message FROM a client
 func DecodeUserMessage(msg []byte) (Type, *UserPackage, error) {
-	var m UserMessage
-	err := xml.Unmarshal(msg, &m)
+	c := DetectCodec(msg)
+	kind, err := c.Kind(msg)
 	if err != nil {
 		return UNKNOWN_T, nil, err
 	}
-	switch m.Type {
+	var up UserPackage
+	var v headed
+	var t Type
+	switch kind {
 	case LOGIN:
-		var l Login
-		err := xml.Unmarshal(msg, &l)
-		if err != nil {
-			return UNKNOWN_T, nil, errors.New("Couldn't decode the message: Login malformed")
-		}
-		up := UserPackage{
-			Login:         &l,
-			UMessage:      nil,
-			UGetConnected: nil,
-			UExit:         nil,
-		}
-		return LOGIN_T, &up, nil
+		up.Login = &Login{}
+		v, t = up.Login, LOGIN_T
 	case BROAD, DM:
-		var b UMessage
-		err := xml.Unmarshal(msg, &b)
-		if err != nil {
-			return UNKNOWN_T, nil, errors.New("Couldn't decode the message: Broadcast or direct message malformed")
-		}
-		up := UserPackage{
-			Login:         nil,
-			UMessage:      &b,
-			UGetConnected: nil,
-			UExit:         nil,
+		up.UMessage = &UMessage{}
+		v, t = up.UMessage, DM_T
+		if kind == BROAD {
+			t = BROAD_T
 		}
-		if m.Type == BROAD {
-			return BROAD_T, &up, nil
-		}
-		return DM_T, &up, nil
 	case GET_CONN:
-		var u UGetConnected
-		err := xml.Unmarshal(msg, &u)
-		if err != nil {
-			return UNKNOWN_T, nil, errors.New("Couldn't decode the message: Get connected malformed")
-		}
-		up := UserPackage{
-			Login:         nil,
-			UMessage:      nil,
-			UGetConnected: &u,
-			UExit:         nil,
-		}
-		return GET_CONN_T, &up, nil
-
+		up.UGetConnected = &UGetConnected{}
+		v, t = up.UGetConnected, GET_CONN_T
 	case BLOCK:
-		var b Block
-		err := xml.Unmarshal(msg, &b)
-		if err != nil {
-			return UNKNOWN_T, nil, errors.New("Couldn't decode the message: Block message malformed")
-		}
-		up := UserPackage{
-			Block: &b,
-		}
-		return BLOCK_T, &up, nil
-
+		up.Block = &Block{}
+		v, t = up.Block, BLOCK_T
 	case FILE:
-		var f FileMessage
-		err := xml.Unmarshal(msg, &f)
-		if err != nil {
-			return UNKNOWN_T, nil, errors.New("Couldn't decode the message: File message malformed")
-		}
-		up := UserPackage{
-			File: &f,
-		}
-
-		return FILE_T, &up, nil
-
+		up.File = &FileMessage{}
+		v, t = up.File, FILE_T
+	case GAP:
+		up.Gap = &GapRequest{}
+		v, t = up.Gap, GAP_T
 	case OFFSET:
-		var c ClockOffset
-		err := xml.Unmarshal(msg, &c)
-		if err != nil {
-			return UNKNOWN_T, nil, errors.New("Couldn't decode the message: File message malformed")
-		}
-		up := UserPackage{
-			Clock: &c,
-		}
-
-		return OFFSET_T, &up, nil
-
+		up.Clock = &ClockOffset{}
+		v, t = up.Clock, OFFSET_T
+	case ACK:
+		up.Ack = &Ack{}
+		v, t = up.Ack, ACK_T
 	case EXIT:
-		var u UExit
-		err := xml.Unmarshal(msg, &u)
-		if err != nil {
-			return UNKNOWN_T, nil, errors.New("Couldn't decode the message: Exit message malformed")
-		}
-		up := UserPackage{
-			Login:         nil,
-			UMessage:      nil,
-			UGetConnected: nil,
-			UExit:         &u,
-		}
-		return EXIT_T, &up, nil
+		up.UExit = &UExit{}
+		v, t = up.UExit, EXIT_T
+	case REGISTER:
+		up.Register = &Register{}
+		v, t = up.Register, REGISTER_T
+	case PUBLISH_KEY:
+		up.PublishKey = &PublishKey{}
+		v, t = up.PublishKey, PUBLISH_KEY_T
+	case KEY_REQ:
+		up.KeyRequest = &KeyRequest{}
+		v, t = up.KeyRequest, KEY_REQ_T
+	case HISTORY_REQ:
+		up.History = &HistoryRequest{}
+		v, t = up.History, HISTORY_REQ_T
+	case SEARCH:
+		up.Search = &Search{}
+		v, t = up.Search, SEARCH_T
+	case JOIN:
+		up.Join = &Join{}
+		v, t = up.Join, JOIN_T
+	case PART:
+		up.Part = &Part{}
+		v, t = up.Part, PART_T
+	case TOPIC:
+		up.Topic = &Topic{}
+		v, t = up.Topic, TOPIC_T
+	case LIST:
+		up.List = &ListChannels{}
+		v, t = up.List, LIST_T
+	case KICK:
+		up.Kick = &Kick{}
+		v, t = up.Kick, KICK_T
+	case BAN:
+		up.Ban = &Ban{}
+		v, t = up.Ban, BAN_T
+	case MUTE:
+		up.Mute = &Mute{}
+		v, t = up.Mute, MUTE_T
+	case INVITE:
+		up.Invite = &Invite{}
+		v, t = up.Invite, INVITE_T
+	case MODE:
+		up.Mode = &Mode{}
+		v, t = up.Mode, MODE_T
 	default:
 		return UNKNOWN_T, nil, errors.New("Couldn't decode the message: No matching type")
 	}
+	up.Header, err = decodeAs(c, msg, kind, v)
+	if err != nil {
+		return UNKNOWN_T, nil, err
+	}
+	return t, &up, nil
 }
 
 ///// Client calls
 func NewLogin(nickname string) Login {
-	base := Base{Type: LOGIN}
-	login := Login{Base: base, Nickname: nickname}
+	base := newBase(LOGIN)
+	login := Login{Base: base, Nickname: nickname, Versions: Versions, Capabilities: Capabilities}
 	return login
 }
 
+func NewRegister(nickname string, password string) Register {
+	return Register{Base: newBase(REGISTER), Nickname: nickname, Password: password}
+}
+
 func NewBroadcast(msg string) UMessage {
-	base := Base{Type: BROAD}
+	base := newBase(BROAD)
 	message := UMessage{Base: base, To: "", Message: msg}
 	return message
 }
 
+// NewChannelMessage is a broadcast for the members of channel
+func NewChannelMessage(channel string, msg string) UMessage {
+	message := NewBroadcast(msg)
+	message.Channel = channel
+	return message
+}
+
 func NewDirectMessage(to string, msg string) UMessage {
-	base := Base{Type: DM}
+	base := newBase(DM)
 	message := UMessage{Base: base, To: to, Message: msg}
 	return message
 }
 
 func NewUGetConnected() UGetConnected {
-	base := Base{Type: GET_CONN}
+	base := newBase(GET_CONN)
 	getConn := UGetConnected{Base: base}
 	return getConn
 }
 
 func NewExit() UExit {
-	base := Base{Type: EXIT}
+	base := newBase(EXIT)
 	exit := UExit{Base: base}
 	return exit
 }
 
 func NewBlock(who string, blocking string) Block {
-	base := Base{Type: BLOCK}
+	base := newBase(BLOCK)
 	bm := Block{Base: base, Blocker: who, Blocked: blocking}
 	return bm
 }
 
+func NewPublishKey(key string) PublishKey {
+	return PublishKey{Base: newBase(PUBLISH_KEY), Key: key}
+}
+
+func NewKeyRequest(nickname string) KeyRequest {
+	return KeyRequest{Base: newBase(KEY_REQ), Nickname: nickname}
+}
+
+func NewJoin(channel string) Join {
+	return Join{Base: newBase(JOIN), Channel: channel}
+}
+
+func NewPart(channel string) Part {
+	return Part{Base: newBase(PART), Channel: channel}
+}
+
+func NewListChannels() ListChannels {
+	return ListChannels{Base: newBase(LIST)}
+}
+
 func NewClockSyncPetition(t time.Time) ClockSyncPetition {
-	base := Base{Type: CLOCK}
+	base := newBase(CLOCK)
 	cm := ClockSyncPetition{Base: base, Time: t}
 	return cm
 }
 
 func NewClockOffset(t time.Duration) ClockOffset {
-	base := Base{Type: OFFSET}
+	base := newBase(OFFSET)
 	co := ClockOffset{Base: base, Offset: t}
 	return co
 }
 
+func NewGapRequest(missing []uint64) GapRequest {
+	base := newBase(GAP)
+	g := GapRequest{Base: base, Missing: missing}
+	return g
+}
+
 ///// Server calls
 func NewSBroadcast(from string, msg string) SMessage {
-	base := Base{Type: BROAD}
+	base := newBase(BROAD)
 	message := SMessage{Base: base, From: from, Message: msg}
 	return message
 }
 
 func NewSDirectMessage(from string, msg string) SMessage {
-	base := Base{Type: DM}
+	base := newBase(DM)
 	message := SMessage{Base: base, From: from, Message: msg}
 	return message
 }
 
 func NewSGetConnected(ids []string) SGetConnected {
-	base := Base{Type: GET_CONN}
+	base := newBase(GET_CONN)
 	users := make([]GetConnUser, len(ids))
 	for i, id := range ids {
 		users[i] = GetConnUser{Id: id}
@@ -534,36 +1065,109 @@ func NewSGetConnected(ids []string) SGetConnected {
 	return getConn
 }
 
-func NewErrorMessage(msg string) ErrorMessage {
-	base := Base{Type: ERROR}
-	message := ErrorMessage{Base: base, Message: msg}
+func NewErrorMessage(code ErrorCode, ref string, msg string) ErrorMessage {
+	base := newBase(ERROR)
+	message := ErrorMessage{Base: base, Code: code, Ref: ref, Message: msg}
+	return message
+}
+
+func NewVersionErrorMessage(ref string, versions []int) ErrorMessage {
+	base := newBase(ERROR)
+	message := ErrorMessage{Base: base, Code: ERR_VERSION, Ref: ref, Message: "No protocol version in common", Versions: versions}
+	return message
+}
+
+func NewRateLimitErrorMessage(ref string, msg string, retryAfter time.Duration) ErrorMessage {
+	base := newBase(ERROR)
+	message := ErrorMessage{Base: base, Code: ERR_RATE_LIMITED, Ref: ref, Message: msg, RetryAfter: int64(retryAfter / time.Millisecond)}
 	return message
 }
 
 func NewAddressMessage(addr int) AddressMessage {
-	base := Base{Type: ADDRESS}
+	base := newBase(ADDRESS)
 	message := AddressMessage{Base: base, Address: addr}
 	return message
 }
 
-func NewLoginResponse(addr int) LoginResponse {
-	base := Base{Type: LOGIN_RES}
-	message := LoginResponse{Base: base, Address: addr}
+func NewLoginResponse(addr int, order uint64, codec string, version int, caps []string, session string) LoginResponse {
+	base := newBase(LOGIN_RES)
+	message := LoginResponse{Base: base, Address: addr, Order: order, Codec: codec, Version: version, Capabilities: caps, Session: session}
 	return message
 }
 
+func NewKeyResponse(nickname string, key string) KeyResponse {
+	return KeyResponse{Base: newBase(KEY_RES), Nickname: nickname, Key: key}
+}
+
+func NewHistoryRequest(with string, limit int, before string) HistoryRequest {
+	return HistoryRequest{Base: newBase(HISTORY_REQ), With: with, Limit: limit, Before: before}
+}
+
+func NewHistoryResponse(with string, entries []HistoryEntry, more bool) HistoryResponse {
+	return HistoryResponse{Base: newBase(HISTORY_RES), With: with, Entries: entries, More: more}
+}
+
+func NewSearch(query string, from string, since time.Time, until time.Time, limit int, before string) Search {
+	return Search{Base: newBase(SEARCH), Query: query, From: from, Since: since, Until: until, Limit: limit, Before: before}
+}
+
+func NewSearchResponse(query string, results []HistoryEntry, more bool) SearchResponse {
+	return SearchResponse{Base: newBase(SEARCH_RES), Query: query, Results: results, More: more}
+}
+
+// NewTopic is sent by both, the client leaves by empty
+func NewTopic(channel string, topic string, by string) Topic {
+	return Topic{Base: newBase(TOPIC), Channel: channel, Topic: topic, By: by}
+}
+
+func NewChannelList(channels []ChannelInfo) ChannelList {
+	return ChannelList{Base: newBase(LIST_RES), Channels: channels}
+}
+
+// The moderation messages are sent by both, the client leaves by empty
+
+func NewKick(channel string, nickname string, reason string, by string) Kick {
+	return Kick{Base: newBase(KICK), Channel: channel, Nickname: nickname, Reason: reason, By: by}
+}
+
+func NewBan(channel string, mask string, remove bool, by string) Ban {
+	return Ban{Base: newBase(BAN), Channel: channel, Mask: mask, Remove: remove, By: by}
+}
+
+func NewMute(channel string, nickname string, d time.Duration, remove bool, by string) Mute {
+	return Mute{Base: newBase(MUTE), Channel: channel, Nickname: nickname, For: d, Remove: remove, By: by}
+}
+
+func NewInvite(channel string, nickname string, by string) Invite {
+	return Invite{Base: newBase(INVITE), Channel: channel, Nickname: nickname, By: by}
+}
+
+func NewMode(channel string, mode string, nickname string, by string) Mode {
+	return Mode{Base: newBase(MODE), Channel: channel, Mode: mode, Nickname: nickname, By: by}
+}
+
+func NewReceipt(ref string, to string, status string) Receipt {
+	return Receipt{Base: newBase(RECEIPT), Ref: ref, To: to, Status: status}
+}
+
+// NewChallenge has no id, it isn't acked and it has to be small
+func NewChallenge(ref string, cookie string) Challenge {
+	return Challenge{Base: Base{Type: CHALLENGE, Cookie: cookie}, Ref: ref}
+}
+
 func NewVoteMessage(num int) VoteMessage {
-	base := Base{Type: VOTE}
+	base := newBase(VOTE)
 	message := VoteMessage{Base: base, Number: num}
 	return message
 }
 func NewCoordinatorMessage(addr string) CoordinatorMessage {
-	base := Base{Type: COORDINATOR}
+	base := newBase(COORDINATOR)
 	message := CoordinatorMessage{Base: base, Address: addr}
 	return message
 }
 
-func IsConfirmation(msg []byte) bool {
-	// TODO This will handle the messages from the other user
-	return string(msg) == "OK"
+func NewAck(ids ...string) Ack {
+	base := newBase(ACK)
+	message := Ack{Base: base, Ids: ids}
+	return message
 }
@@ -0,0 +1,63 @@
+package message
+
+// Protocol versions. 1 is the original one, no ids and a bare "OK" as
+// confirmation. 2 has message ids, acks, ordering and codecs
+const (
+	VERSION_1 = 1
+	VERSION_2 = 2
+)
+
+// Capabilities are the optional parts of the protocol. Both sides list
+// what they can do at login and only use what they have in common
+const (
+	CAP_ACK     = "ack"     // Confirms messages from the server
+	CAP_ORDER   = "order"   // Shows messages in order and asks for the missing ones
+	CAP_CODEC   = "codec"   // Can talk something that isn't XML
+	CAP_SESSION = "session" // Is known by a token and not by his address
+	CAP_RECEIPT = "receipt" // Wants to know when his messages for someone offline get there
+)
+
+// What this build speaks, newest first
+var Versions = []int{VERSION_2, VERSION_1}
+var Capabilities = []string{CAP_ACK, CAP_ORDER, CAP_CODEC, CAP_SESSION, CAP_RECEIPT}
+
+// NegotiateVersion picks the highest version both lists have. Someone who
+// doesn't say anything is an old client, so he speaks version 1
+func NegotiateVersion(theirs []int, ours []int) (int, bool) {
+	if len(theirs) == 0 {
+		theirs = []int{VERSION_1}
+	}
+	best := 0
+	for _, t := range theirs {
+		for _, o := range ours {
+			if t == o && t > best {
+				best = t
+			}
+		}
+	}
+	return best, best != 0
+}
+
+// CommonCapabilities keeps the capabilities in both lists
+func CommonCapabilities(theirs []string, ours []string) []string {
+	common := make([]string, 0, len(ours))
+	for _, t := range theirs {
+		for _, o := range ours {
+			if t == o {
+				common = append(common, t)
+				break
+			}
+		}
+	}
+	return common
+}
+
+// HasCapability tells if the list has c
+func HasCapability(caps []string, c string) bool {
+	for _, have := range caps {
+		if have == c {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package secure
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// End to end encryption between two clients. The server relays the
+// messages but can't read them:
+//
+//	sender public key (32) | nonce (12) | ciphertext and tag
+//
+// The key comes out of the static keys of both sides, so anyone can seal
+// for someone whose public key he has. The sender key goes with the
+// message, its fingerprint is how users tell if it's who it says
+const e2eInfo = "GoUDP e2e v1"
+
+const E2E_OVERHEAD = KEY_SIZE + 12 + 16
+
+var ErrBadKey = errors.New("That isn't a public key")
+
+// Identity is the key pair of a client. The key it signs with comes out
+// of the same secret, see sign.go
+type Identity struct {
+	private *ecdh.PrivateKey
+	signing ed25519.PrivateKey
+}
+
+func NewIdentity() (*Identity, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return newIdentity(private)
+}
+
+// LoadIdentity reads the identity in path, or makes one and saves it there
+// if there isn't any. The same identity keeps the same fingerprint
+func LoadIdentity(path string) (*Identity, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		id, err := NewIdentity()
+		if err != nil {
+			return nil, err
+		}
+		// Only we can read it
+		err = ioutil.WriteFile(path, []byte(hex.EncodeToString(id.private.Bytes())), 0600)
+		if err != nil {
+			return nil, err
+		}
+		return id, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, err
+	}
+	private, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	return newIdentity(private)
+}
+
+func (id *Identity) Public() []byte {
+	return id.private.PublicKey().Bytes()
+}
+
+func (id *Identity) Fingerprint() string {
+	return Fingerprint(id.Public())
+}
+
+// Fingerprint is short enough for two people to read it to each other
+func Fingerprint(public []byte) string {
+	sum := sha256.Sum256(public)
+	h := hex.EncodeToString(sum[:16])
+	groups := make([]string, 0, len(h)/4)
+	for i := 0; i < len(h); i += 4 {
+		groups = append(groups, h[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+// SealFor encrypts plain so only the owner of theirs can read it
+func (id *Identity) SealFor(theirs []byte, plain []byte) ([]byte, error) {
+	aead, err := id.e2eKey(theirs, id.Public(), theirs)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, KEY_SIZE+aead.NonceSize(), E2E_OVERHEAD+len(plain))
+	copy(out, id.Public())
+	_, err = io.ReadFull(rand.Reader, out[KEY_SIZE:])
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, out[KEY_SIZE:], plain, nil), nil
+}
+
+// Open decrypts something sealed for us. It also gives the public key of
+// whoever sealed it
+func (id *Identity) Open(sealed []byte) ([]byte, []byte, error) {
+	if len(sealed) < E2E_OVERHEAD {
+		return nil, nil, ErrMalformed
+	}
+	sender := sealed[:KEY_SIZE]
+	aead, err := id.e2eKey(sender, sender, id.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := sealed[KEY_SIZE : KEY_SIZE+aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, sealed[KEY_SIZE+aead.NonceSize():], nil)
+	if err != nil {
+		return nil, nil, ErrAuth
+	}
+	return plain, append([]byte{}, sender...), nil
+}
+
+// e2eKey is the key between us and theirs for messages from one to the
+// other, both keys go in the salt so each direction has its own
+func (id *Identity) e2eKey(theirs []byte, from []byte, to []byte) (cipher.AEAD, error) {
+	public, err := ecdh.X25519().NewPublicKey(theirs)
+	if err != nil {
+		return nil, ErrBadKey
+	}
+	shared, err := id.private.ECDH(public)
+	if err != nil {
+		return nil, ErrBadKey
+	}
+	salt := append(append([]byte{}, from...), to...)
+	key, err := hkdf.Key(sha256.New, shared, salt, e2eInfo, KEY_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(key)
+}
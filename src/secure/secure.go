@@ -0,0 +1,290 @@
+package secure
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Sealed datagrams go under the codecs, the whole marshaled message is
+// encrypted before it's split in fragments. Every datagram of this package
+// starts with the magic byte and its kind:
+//
+//	HELLO:   magic | kind | client public key (32)
+//	WELCOME: magic | kind | key id (8) | server public key (32) | signing key (32) | signature (64)
+//	DATA:    magic | kind | key id (8) | seq (8) | ciphertext and tag
+//
+// The client says HELLO with a fresh X25519 key, the server answers with its
+// own and the id it will know the session by. The server signs both keys and
+// the id with the long-term key of its identity, so nobody in between can
+// answer in its place if the client knows that key. Both sides get a key for each
+// direction out of the shared secret with HKDF. DATA is AES-GCM with the
+// header as additional data and the seq as nonce, a seq is never used
+// twice for a key and the receiver rejects the ones it already saw
+const (
+	MAGIC = 0xE5
+
+	HELLO   = 1
+	WELCOME = 2
+	DATA    = 3
+
+	KEY_SIZE    = 32
+	KEY_ID_SIZE = 8
+	WELCOME_LEN = 2 + KEY_ID_SIZE + 2*KEY_SIZE + ed25519.SignatureSize
+	HEADER      = 2 + KEY_ID_SIZE + 8
+	OVERHEAD    = HEADER + 16 // Header and the GCM tag
+	WINDOW      = 64          // How far back an out of order datagram can be
+)
+
+const kdfInfo = "GoUDP secure v1"
+const welcomeInfo = "GoUDP secure v1 welcome"
+
+var ErrMalformed = errors.New("Malformed secure datagram")
+var ErrAuth = errors.New("Secure datagram failed authentication")
+var ErrReplay = errors.New("Secure datagram was already received")
+
+// IsSecure tells if the datagram belongs to this package
+func IsSecure(b []byte) bool {
+	return len(b) >= 2 && b[0] == MAGIC
+}
+
+// Kind is HELLO, WELCOME or DATA
+func Kind(b []byte) byte {
+	if !IsSecure(b) {
+		return 0
+	}
+	return b[1]
+}
+
+// KeyId is the session a DATA datagram belongs to
+func KeyId(b []byte) (uint64, bool) {
+	if Kind(b) != DATA || len(b) < HEADER {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(b[2:10]), true
+}
+
+// ****** Handshake  ****** //
+
+// KeyExchange is the client side of the handshake
+type KeyExchange struct {
+	private *ecdh.PrivateKey
+}
+
+func NewKeyExchange() (*KeyExchange, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyExchange{private: private}, nil
+}
+
+// Hello is the datagram that starts the handshake
+func (k *KeyExchange) Hello() []byte {
+	b := []byte{MAGIC, HELLO}
+	return append(b, k.private.PublicKey().Bytes()...)
+}
+
+// Finish takes the WELCOME of the server and gives the session and the key
+// the server signed it with. The signature is checked here, whether that
+// key is the one of our server is for the caller to tell
+func (k *KeyExchange) Finish(welcome []byte) (*Session, []byte, error) {
+	if Kind(welcome) != WELCOME || len(welcome) != WELCOME_LEN {
+		return nil, nil, ErrMalformed
+	}
+	id := binary.BigEndian.Uint64(welcome[2:10])
+	theirs, err := ecdh.X25519().NewPublicKey(welcome[10 : 10+KEY_SIZE])
+	if err != nil {
+		return nil, nil, ErrMalformed
+	}
+	signing := welcome[10+KEY_SIZE : 10+2*KEY_SIZE]
+	signature := welcome[10+2*KEY_SIZE:]
+	if !Verify(signing, transcript(k.private.PublicKey().Bytes(), welcome[2:10+KEY_SIZE]), signature) {
+		return nil, nil, ErrAuth
+	}
+	s, err := newSession(k.private, theirs, id, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, append([]byte{}, signing...), nil
+}
+
+// Accept is the server side of the handshake. It gives the session for the
+// client who sent hello and the WELCOME to answer him with, signed by server
+func Accept(hello []byte, server *Identity) (*Session, []byte, error) {
+	if Kind(hello) != HELLO || len(hello) != 2+KEY_SIZE {
+		return nil, nil, ErrMalformed
+	}
+	theirs, err := ecdh.X25519().NewPublicKey(hello[2:])
+	if err != nil {
+		return nil, nil, ErrMalformed
+	}
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	var idBytes [KEY_ID_SIZE]byte
+	_, err = rand.Read(idBytes[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	id := binary.BigEndian.Uint64(idBytes[:])
+	s, err := newSession(private, theirs, id, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	welcome := make([]byte, 0, WELCOME_LEN)
+	welcome = append(welcome, MAGIC, WELCOME)
+	welcome = append(welcome, idBytes[:]...)
+	welcome = append(welcome, private.PublicKey().Bytes()...)
+	signature := server.Sign(transcript(hello[2:], welcome[2:]))
+	welcome = append(welcome, server.SigningKey()...)
+	welcome = append(welcome, signature...)
+	return s, welcome, nil
+}
+
+// transcript is what the server signs: the key of the client, and the id
+// and key of the server. A WELCOME can't be used for another HELLO
+func transcript(client []byte, idAndKey []byte) []byte {
+	b := make([]byte, 0, len(welcomeInfo)+KEY_SIZE+KEY_ID_SIZE+KEY_SIZE)
+	b = append(b, welcomeInfo...)
+	b = append(b, client...)
+	return append(b, idAndKey...)
+}
+
+// ****** Session  ****** //
+
+// Session seals what we send and opens what we get. It can be used from
+// several goroutines
+type Session struct {
+	id      uint64
+	send    cipher.AEAD
+	receive cipher.AEAD
+	seq     uint64 // Last one we sent, atomic
+
+	// Replay window, highest seq we got and a bit for each of the
+	// WINDOW before it
+	mutex   sync.Mutex
+	highest uint64
+	seen    uint64
+}
+
+func newSession(ours *ecdh.PrivateKey, theirs *ecdh.PublicKey, id uint64, client bool) (*Session, error) {
+	shared, err := ours.ECDH(theirs)
+	if err != nil {
+		return nil, err
+	}
+	// Both public keys go in the salt, so the keys are tied to this handshake
+	clientKey, serverKey := ours.PublicKey().Bytes(), theirs.Bytes()
+	if !client {
+		clientKey, serverKey = serverKey, clientKey
+	}
+	salt := append(append([]byte{}, clientKey...), serverKey...)
+	var info [KEY_ID_SIZE]byte
+	binary.BigEndian.PutUint64(info[:], id)
+	keys, err := hkdf.Key(sha256.New, shared, salt, kdfInfo+string(info[:]), 2*KEY_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	toServer, err := newAEAD(keys[:KEY_SIZE])
+	if err != nil {
+		return nil, err
+	}
+	toClient, err := newAEAD(keys[KEY_SIZE:])
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{id: id, send: toServer, receive: toClient}
+	if !client {
+		s.send, s.receive = toClient, toServer
+	}
+	return s, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Id is what the server knows the session by
+func (s *Session) Id() uint64 {
+	return s.id
+}
+
+// Seal encrypts a message into a DATA datagram. Each call uses the next seq,
+// so the same message sealed twice looks different
+func (s *Session) Seal(plain []byte) []byte {
+	seq := atomic.AddUint64(&s.seq, 1)
+	out := make([]byte, HEADER, HEADER+len(plain)+s.send.Overhead())
+	out[0], out[1] = MAGIC, DATA
+	binary.BigEndian.PutUint64(out[2:10], s.id)
+	binary.BigEndian.PutUint64(out[10:18], seq)
+	return s.send.Seal(out, nonce(seq), plain, out[:HEADER])
+}
+
+// Open checks and decrypts a DATA datagram. Anything that was tampered
+// with, isn't for this session or was already opened is rejected
+func (s *Session) Open(sealed []byte) ([]byte, error) {
+	id, ok := KeyId(sealed)
+	if !ok || id != s.id {
+		return nil, ErrMalformed
+	}
+	seq := binary.BigEndian.Uint64(sealed[10:18])
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.fresh(seq) {
+		return nil, ErrReplay
+	}
+	plain, err := s.receive.Open(nil, nonce(seq), sealed[HEADER:], sealed[:HEADER])
+	if err != nil {
+		return nil, ErrAuth
+	}
+	// Only authentic datagrams move the window
+	s.mark(seq)
+	return plain, nil
+}
+
+// fresh tells if seq wasn't seen and isn't too old to tell
+func (s *Session) fresh(seq uint64) bool {
+	if seq == 0 {
+		return false
+	}
+	if seq > s.highest {
+		return true
+	}
+	behind := s.highest - seq
+	return behind < WINDOW && s.seen&(1<<behind) == 0
+}
+
+func (s *Session) mark(seq uint64) {
+	if seq > s.highest {
+		ahead := seq - s.highest
+		if ahead >= WINDOW {
+			s.seen = 0
+		} else {
+			s.seen <<= ahead
+		}
+		s.seen |= 1
+		s.highest = seq
+		return
+	}
+	s.seen |= 1 << (s.highest - seq)
+}
+
+// nonce is the seq, each direction has its own key so they can't collide
+func nonce(seq uint64) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[4:], seq)
+	return n
+}
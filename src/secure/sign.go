@@ -0,0 +1,138 @@
+package secure
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Clients sign what they send with Ed25519, so whoever gets it can tell
+// it's from them even if the server is lying. The signing key is derived
+// from the identity, there's only one secret to keep
+const signInfo = "GoUDP signing v1"
+
+func newIdentity(private *ecdh.PrivateKey) (*Identity, error) {
+	seed, err := hkdf.Key(sha256.New, private.Bytes(), nil, signInfo, ed25519.SeedSize)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{private: private, signing: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// SigningKey is the public key others verify our signatures with
+func (id *Identity) SigningKey() []byte {
+	return id.signing.Public().(ed25519.PublicKey)
+}
+
+func (id *Identity) Sign(payload []byte) []byte {
+	return ed25519.Sign(id.signing, payload)
+}
+
+// Verify tells if signature is from the owner of key
+func Verify(key []byte, payload []byte, signature []byte) bool {
+	if len(key) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(key), payload, signature)
+}
+
+// ****** Keys pinned on first use  ****** //
+
+// The first key we see from someone is the one we trust for him. A
+// different one later means someone else is using his name
+type PinResult int
+
+const (
+	PIN_NEW      PinResult = iota // We didn't know him, now this is his key
+	PIN_MATCH                     // Same key as always
+	PIN_MISMATCH                  // Not the key we have for him
+)
+
+// Pins are the keys we trust for each nickname. They are written to path
+// when they change, without a path they only live in memory. They can be
+// used from several goroutines
+type Pins struct {
+	path  string
+	mutex sync.Mutex
+	keys  map[string]string // Nickname to base64 key
+}
+
+func NewPins() *Pins {
+	return &Pins{keys: make(map[string]string)}
+}
+
+// LoadPins reads the pins in path, there are none if it doesn't exist yet
+func LoadPins(path string) (*Pins, error) {
+	p := NewPins()
+	p.path = path
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &p.keys)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Check compares key with the one pinned for nick, pinning it if there
+// wasn't any
+func (p *Pins) Check(nick string, key []byte) (PinResult, error) {
+	encoded := base64.StdEncoding.EncodeToString(key)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	pinned, ok := p.keys[nick]
+	if ok && pinned == encoded {
+		return PIN_MATCH, nil
+	}
+	if ok {
+		return PIN_MISMATCH, nil
+	}
+	p.keys[nick] = encoded
+	return PIN_NEW, p.save()
+}
+
+// Forget drops the key of nick, the next one we see is pinned. It's for
+// when he really changed his key
+func (p *Pins) Forget(nick string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.keys, nick)
+	return p.save()
+}
+
+// save writes the pins to a new file and puts it in place of the old one
+func (p *Pins) save() error {
+	if p.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(p.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p.path), filepath.Base(p.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), p.path)
+}
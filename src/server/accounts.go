@@ -0,0 +1,298 @@
+package server
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"message"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	PBKDF2_ITERATIONS = 100000
+	SALT_SIZE         = 16
+	HASH_SIZE         = 32
+	MIN_PASSWORD      = 6
+	HASH_WORKERS      = 2  // Passwords hashed at the same time
+	HASH_QUEUE        = 32 // Waiting for a worker, the ones after them are turned away
+	AUTH_FAILURES     = 5  // Wrong passwords for a nickname before it's locked
+	AUTH_LOCKOUT      = time.Minute
+)
+
+var errAccountExists = errors.New("That nickname is already registered")
+var errShortPassword = errors.New("The password is too short")
+var errBusy = errors.New("The server is busy with other passwords, try again later")
+var errLocked = errors.New("Too many wrong passwords for that nickname, try again later")
+
+// Account is a registered nickname. The password is never kept, only
+// its salted hash
+type Account struct {
+	Nickname   string
+	Salt       []byte
+	Hash       []byte
+	Iterations int
+	Created    time.Time
+}
+
+// Check tells if password is the one the account was registered with
+func (a *Account) Check(password string) bool {
+	hash, err := hashPassword(password, a.Salt, a.Iterations)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(hash, a.Hash) == 1
+}
+
+func hashPassword(password string, salt []byte, iterations int) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, password, salt, iterations, HASH_SIZE)
+}
+
+// accounts are the registered nicknames. They are written to path every
+// time one is added, so they survive the server. Without a path they
+// only live in memory
+type accounts struct {
+	path   string
+	byNick map[string]*Account
+}
+
+func loadAccounts(path string) (*accounts, error) {
+	a := &accounts{path: path, byNick: make(map[string]*Account)}
+	if path == "" {
+		return a, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		// Nobody registered yet
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []*Account
+	err = json.Unmarshal(b, &list)
+	if err != nil {
+		return nil, err
+	}
+	for _, acc := range list {
+		a.byNick[acc.Nickname] = acc
+	}
+	return a, nil
+}
+
+func (a *accounts) Get(nickname string) (*Account, bool) {
+	acc, ok := a.byNick[nickname]
+	return acc, ok
+}
+
+// newAccount hashes password for nickname. It takes a while on purpose,
+// so it's done off the event loop
+func newAccount(nickname string, password string) (*Account, error) {
+	if len(password) < MIN_PASSWORD {
+		return nil, errShortPassword
+	}
+	salt := make([]byte, SALT_SIZE)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := hashPassword(password, salt, PBKDF2_ITERATIONS)
+	if err != nil {
+		return nil, err
+	}
+	return &Account{
+		Nickname:   nickname,
+		Salt:       salt,
+		Hash:       hash,
+		Iterations: PBKDF2_ITERATIONS,
+		Created:    time.Now(),
+	}, nil
+}
+
+// Add registers acc, if nobody registered its nickname before
+func (a *accounts) Add(acc *Account) error {
+	if _, ok := a.byNick[acc.Nickname]; ok {
+		return errAccountExists
+	}
+	a.byNick[acc.Nickname] = acc
+	err := a.save()
+	if err != nil {
+		// Nobody can log in with an account we'll forget
+		delete(a.byNick, acc.Nickname)
+		return err
+	}
+	return nil
+}
+
+// save writes every account to a new file and then puts it in place of
+// the old one, so a crash never leaves half a file
+func (a *accounts) save() error {
+	if a.path == "" {
+		return nil
+	}
+	list := make([]*Account, 0, len(a.byNick))
+	for _, acc := range a.byNick {
+		list = append(list, acc)
+	}
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(a.path), filepath.Base(a.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), a.path)
+}
+
+// ****** Hashing off the event loop  ****** //
+
+// PBKDF2 takes long on purpose, in the event loop it would stop everybody
+// while it runs. The workers hash and the result comes back to the loop,
+// which picks up the request where it left it
+
+// hashJob is a password to hash for a request. With an account it's
+// checked against it, without one it's a new account for Nickname
+type hashJob struct {
+	Request  *Request
+	Nickname string
+	Password string
+	Account  *Account
+}
+
+// hashResult is the account that was checked or made, or why not
+type hashResult struct {
+	Request *Request
+	Account *Account
+	Err     error
+}
+
+func (j hashJob) do() hashResult {
+	if j.Account == nil {
+		acc, err := newAccount(j.Nickname, j.Password)
+		return hashResult{Request: j.Request, Account: acc, Err: err}
+	}
+	if !j.Account.Check(j.Password) {
+		return hashResult{Request: j.Request, Err: errWrongPassword}
+	}
+	return hashResult{Request: j.Request, Account: j.Account}
+}
+
+func hashWorker(ctx context.Context, jobs <-chan hashJob, results chan<- hashResult) {
+	for {
+		select {
+		case j := <-jobs:
+			r := j.do()
+			select {
+			case results <- r:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// hash hands j to the workers, unless they already have too much to do
+func (s *Server) hash(j hashJob) error {
+	select {
+	case s.hashJobs <- j:
+		return nil
+	default:
+		log.Println("[Server] Too many passwords to hash, turning away", j.Nickname)
+		return errBusy
+	}
+}
+
+// hashed gets a result back to whoever asked for it
+func (s *Server) hashed(r hashResult) {
+	switch r.Request.Type {
+	case message.LOGIN_T:
+		s.passwordChecked(r)
+	case message.REGISTER_T:
+		s.accountMade(r)
+	}
+}
+
+// ****** Wrong passwords  ****** //
+
+// authFailures are the wrong passwords for a nickname. The ones being
+// checked count too, or they could all be sent before the first is wrong
+type authFailures struct {
+	Checking    int
+	Failed      int
+	LockedUntil time.Time
+	Last        time.Time
+}
+
+// canTry tells if someone can try a password for nick now, and if so
+// counts it until checked says how it went
+func (s *Server) canTry(nick string, now time.Time) (bool, time.Duration) {
+	f, ok := s.authFailures[nick]
+	if !ok {
+		f = &authFailures{}
+		s.authFailures[nick] = f
+	}
+	if now.Before(f.LockedUntil) {
+		return false, f.LockedUntil.Sub(now)
+	}
+	if f.Checking+f.Failed >= AUTH_FAILURES {
+		// Only so many guesses at once, the ones being checked are done soon
+		return false, time.Second
+	}
+	f.Checking++
+	f.Last = now
+	return true, 0
+}
+
+// checked counts how a password for nick went. Too many wrong ones lock
+// the nickname for a while, the right one forgets them
+func (s *Server) checked(nick string, right bool, now time.Time) {
+	f, ok := s.authFailures[nick]
+	if !ok {
+		return
+	}
+	if f.Checking > 0 {
+		f.Checking--
+	}
+	f.Last = now
+	if right {
+		f.Failed = 0
+		return
+	}
+	f.Failed++
+	if f.Failed >= AUTH_FAILURES {
+		log.Println("[Server] Too many wrong passwords for", nick, "locking it")
+		f.Failed = 0
+		f.LockedUntil = now.Add(AUTH_LOCKOUT)
+	}
+}
+
+// forgetFailures drops the nicknames nobody tried for a while
+func (s *Server) forgetFailures(now time.Time) {
+	for nick, f := range s.authFailures {
+		if f.Checking == 0 && now.After(f.LockedUntil) && now.Sub(f.Last) >= AUTH_LOCKOUT {
+			delete(s.authFailures, nick)
+		}
+	}
+}
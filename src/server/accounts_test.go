@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bytes"
+	"client"
+	"io/ioutil"
+	"message"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitError is the next error c gets, failing if it isn't code
+func waitError(t *testing.T, c *client.Client, code message.ErrorCode) *message.ErrorMessage {
+	t.Helper()
+	e := waitEvent(t, c, client.ERROR_E, 5*time.Second)
+	if e.Error.Code != code {
+		t.Fatalf("Got error %v %q, want %v", e.Error.Code, e.Error.Message, code)
+	}
+	return e.Error
+}
+
+func TestAccounts(t *testing.T) {
+	s := startServer(t, Config{})
+	// The login right after the register waits for the account
+	alice := dialServer(t, s, client.Config{})
+	alice.Register("alice", "secret1")
+	waitEvent(t, alice, client.LOGIN_E, 5*time.Second)
+
+	bob := dialServer(t, s, client.Config{})
+	bob.LoginWithPassword("alice", "not it")
+	waitError(t, bob, message.ERR_AUTH)
+	bob.Login("alice")
+	waitError(t, bob, message.ERR_AUTH)
+	// Right password, but she's online
+	bob.LoginWithPassword("alice", "secret1")
+	waitError(t, bob, message.ERR_NICK_TAKEN)
+	// Register logs in too, each one gets a client of its own so the
+	// errors of those logins don't get mixed up
+	carol := dialServer(t, s, client.Config{})
+	carol.Register("alice", "another one")
+	waitError(t, carol, message.ERR_NICK_TAKEN)
+	dave := dialServer(t, s, client.Config{})
+	dave.Register("dave", "short")
+	waitError(t, dave, message.ERR_AUTH)
+
+	alice.Quit()
+	erin := dialServer(t, s, client.Config{})
+	erin.LoginWithPassword("alice", "secret1")
+	waitEvent(t, erin, client.LOGIN_E, 5*time.Second)
+}
+
+// Accounts outlive the server, and what's written is the salted hash and
+// never the password
+func TestAccountsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "accounts.json")
+
+	s := startServer(t, Config{Accounts: path})
+	alice := dialServer(t, s, client.Config{})
+	alice.Register("alice", "secret1")
+	waitEvent(t, alice, client.LOGIN_E, 5*time.Second)
+	s.Stop()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("secret1")) {
+		t.Error("The password is in the file")
+	}
+	acc, err := loadAccounts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, ok := acc.Get("alice")
+	if !ok || a.Iterations != PBKDF2_ITERATIONS || len(a.Salt) != SALT_SIZE {
+		t.Fatalf("Read back %+v", a)
+	}
+	if !a.Check("secret1") || a.Check("secret2") {
+		t.Error("The hash doesn't tell the password")
+	}
+	// Same password, another salt
+	other, err := newAccount("bob", "secret1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(other.Hash, a.Hash) {
+		t.Error("Two accounts with the same password have the same hash")
+	}
+
+	s = startServer(t, Config{Accounts: path})
+	back := dialServer(t, s, client.Config{})
+	back.LoginWithPassword("alice", "secret1")
+	waitEvent(t, back, client.LOGIN_E, 5*time.Second)
+	guest := dialServer(t, s, client.Config{})
+	guest.Login("alice")
+	waitError(t, guest, message.ERR_AUTH)
+}
+
+// A nickname that gets too many wrong passwords is locked for a while,
+// the right one included
+func TestWrongPasswordsLock(t *testing.T) {
+	s := startServer(t, Config{})
+	alice := dialServer(t, s, client.Config{})
+	alice.Register("alice", "secret1")
+	waitEvent(t, alice, client.LOGIN_E, 5*time.Second)
+	alice.Quit()
+
+	mallory := dialServer(t, s, client.Config{})
+	for i := 0; i < AUTH_FAILURES; i++ {
+		mallory.LoginWithPassword("alice", "guess")
+		waitError(t, mallory, message.ERR_AUTH)
+	}
+	mallory.LoginWithPassword("alice", "secret1")
+	e := waitError(t, mallory, message.ERR_RATE_LIMITED)
+	if wait := time.Duration(e.RetryAfter) * time.Millisecond; wait <= 0 || wait > AUTH_LOCKOUT {
+		t.Errorf("Told to wait %v", wait)
+	}
+}
+
+func TestAuthFailures(t *testing.T) {
+	s := New(Config{})
+	now := time.Now()
+	// Guesses that are still being checked count
+	for i := 0; i < AUTH_FAILURES; i++ {
+		if ok, _ := s.canTry("alice", now); !ok {
+			t.Fatal("Couldn't try password", i)
+		}
+	}
+	if ok, _ := s.canTry("alice", now); ok {
+		t.Fatal("Tried more at once than the limit")
+	}
+	for i := 0; i < AUTH_FAILURES; i++ {
+		s.checked("alice", false, now)
+	}
+	if ok, wait := s.canTry("alice", now); ok || wait != AUTH_LOCKOUT {
+		t.Errorf("After the last wrong one got %v and %v", ok, wait)
+	}
+	// The right one forgets the wrong ones before it
+	for i := 0; i < AUTH_FAILURES-1; i++ {
+		s.canTry("bob", now)
+		s.checked("bob", false, now)
+	}
+	s.canTry("bob", now)
+	s.checked("bob", true, now)
+	if ok, _ := s.canTry("bob", now); !ok {
+		t.Error("bob is locked after the right password")
+	}
+	s.checked("bob", true, now)
+
+	later := now.Add(AUTH_LOCKOUT)
+	if ok, _ := s.canTry("alice", later); !ok {
+		t.Fatal("Still locked after the lockout")
+	}
+	s.checked("alice", true, later)
+	s.forgetFailures(later)
+	if _, ok := s.authFailures["bob"]; ok {
+		t.Error("Kept bob, nobody tried him in a while")
+	}
+	if _, ok := s.authFailures["alice"]; !ok {
+		t.Error("Forgot alice right after she tried")
+	}
+}
+
+// Past what the workers can take the password isn't even looked at
+func TestHashBusy(t *testing.T) {
+	s := New(Config{})
+	s.hashJobs = make(chan hashJob)
+	if err := s.hash(hashJob{Nickname: "alice"}); err != errBusy {
+		t.Errorf("Nobody to hash gave %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"log"
+	"message"
+	"sort"
+	"time"
+	"unicode"
+)
+
+// ****** Channels  ****** //
+
+// Broadcasts go to the members of a channel. Everyone joins the default one
+// when he logs in, so a broadcast without a channel still gets to
+// everybody. Channels are only in memory, one is gone when the last member
+// parts but the default one is always there. Members that go offline stay
+// in their channels, they just don't get what's said until they are back
+const (
+	DEFAULT_CHANNEL  = "#general"
+	MAX_CHANNEL_NAME = 50
+	MAX_TOPIC        = 300
+)
+
+type Channel struct {
+	Name    string
+	Topic   string
+	TopicBy string
+	Members map[string]*User // By alias
+
+	// Moderation, see moderation.go
+	Roles      map[string]Role // Of the members that aren't plain members
+	InviteOnly bool
+	Moderated  bool
+	Bans       []string
+	Invited    map[string]bool      // Can join once even if it's invite only
+	Muted      map[string]time.Time // Until when
+}
+
+func newChannel(name string) *Channel {
+	return &Channel{
+		Name:    name,
+		Members: make(map[string]*User),
+		Roles:   make(map[string]Role),
+		Invited: make(map[string]bool),
+		Muted:   make(map[string]time.Time),
+	}
+}
+
+// validChannel tells if name can be a channel, "#" and something without
+// spaces
+func validChannel(name string) bool {
+	if len(name) < 2 || len(name) > MAX_CHANNEL_NAME || name[0] != '#' {
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || r == ',' {
+			return false
+		}
+	}
+	return true
+}
+
+// join puts the user in the channel, making it if it isn't there. Who
+// makes it owns it
+func (s *Server) join(usr *User, name string) *Channel {
+	ch, ok := s.channels[name]
+	if !ok {
+		log.Println("[Server] Channel", name, "made by", usr.Alias)
+		ch = newChannel(name)
+		ch.setRole(usr.Alias, ROLE_OWNER)
+		s.channels[name] = ch
+	}
+	ch.Members[usr.Alias] = usr
+	usr.Channels[name] = ch
+	return ch
+}
+
+// part takes the user out of the channel, the last one out closes it
+func (s *Server) part(usr *User, ch *Channel) {
+	delete(ch.Members, usr.Alias)
+	delete(ch.Roles, usr.Alias)
+	delete(usr.Channels, ch.Name)
+	if len(ch.Members) == 0 && ch.Name != s.config.DefaultChannel {
+		log.Println("[Server] Channel", ch.Name, "is empty, closing it")
+		delete(s.channels, ch.Name)
+	}
+}
+
+// joinDefault puts a user that just logged in in the default channel,
+// unless he is banned from it or it's invite only and he wasn't invited.
+// The operators of the config are operators in it if they logged in with
+// their password
+func (s *Server) joinDefault(usr *User, registered bool) {
+	ch := s.channels[s.config.DefaultChannel]
+	if ch.banned(usr) {
+		log.Println("[Server]", usr.Alias, "is banned from", ch.Name)
+		return
+	}
+	// Members from before it was invite only stay
+	if _, in := ch.Members[usr.Alias]; !in && ch.InviteOnly && !ch.Invited[usr.Alias] {
+		log.Println("[Server]", usr.Alias, "wasn't invited to", ch.Name)
+		return
+	}
+	s.join(usr, ch.Name)
+	delete(ch.Invited, usr.Alias)
+	if registered && s.isOperator(usr.Alias) && ch.role(usr.Alias) < ROLE_OPERATOR {
+		ch.setRole(usr.Alias, ROLE_OPERATOR)
+	}
+}
+
+func (s *Server) isOperator(alias string) bool {
+	for _, op := range s.config.Operators {
+		if op == alias {
+			return true
+		}
+	}
+	return false
+}
+
+// partAll takes a user that is going away for good out of everywhere
+func (s *Server) partAll(usr *User) {
+	for _, ch := range usr.Channels {
+		s.part(usr, ch)
+	}
+}
+
+// memberOf finds the channel of the request among the ones the user is
+// in, the default one if name is empty. If he isn't there he is told so
+// and it's nil
+func (s *Server) memberOf(m *Request, name string) *Channel {
+	name = s.channelName(name)
+	ch, ok := m.User.Channels[name]
+	if !ok {
+		s.Error(m, message.ERR_NOT_IN_CHANNEL, "You aren't in "+name)
+		return nil
+	}
+	return ch
+}
+
+func (s *Server) joinHandler(m *Request) {
+	name := m.Content.Join.Channel
+	if !validChannel(name) {
+		s.Error(m, message.ERR_MALFORMED, "Channel names start with # and have no spaces")
+		return
+	}
+	ch := s.join(m.User, name)
+	delete(ch.Invited, m.User.Alias)
+	log.Println("[Server]", m.User.Alias, "joined", name)
+	// Joining twice only gets the topic again
+	t := message.NewTopic(ch.Name, ch.Topic, ch.TopicBy)
+	s.Reply(m, &t)
+}
+
+func (s *Server) partHandler(m *Request) {
+	ch := s.memberOf(m, m.Content.Part.Channel)
+	if ch == nil {
+		return
+	}
+	log.Println("[Server]", m.User.Alias, "left", ch.Name)
+	s.part(m.User, ch)
+}
+
+// topicHandler gives the topic of a channel, or changes it and tells every
+// member
+func (s *Server) topicHandler(m *Request) {
+	req := m.Content.Topic
+	ch := s.memberOf(m, req.Channel)
+	if ch == nil {
+		return
+	}
+	if req.Topic == "" {
+		t := message.NewTopic(ch.Name, ch.Topic, ch.TopicBy)
+		s.Reply(m, &t)
+		return
+	}
+	if len(req.Topic) > MAX_TOPIC {
+		s.Error(m, message.ERR_MALFORMED, "That topic is too long")
+		return
+	}
+	ch.Topic, ch.TopicBy = req.Topic, m.User.Alias
+	log.Println("[Server]", m.User.Alias, "set the topic of", ch.Name)
+	t := message.NewTopic(ch.Name, ch.Topic, ch.TopicBy)
+	s.tellChannel(ch, &t)
+}
+
+// listHandler gives every channel with how many are online in it
+func (s *Server) listHandler(m *Request) {
+	channels := make([]message.ChannelInfo, 0, len(s.channels))
+	for _, ch := range s.channels {
+		online := 0
+		for _, usr := range ch.Members {
+			if usr.Online {
+				online++
+			}
+		}
+		channels = append(channels, message.ChannelInfo{Name: ch.Name, Topic: ch.Topic, Members: online, Modes: ch.modes()})
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].Name < channels[j].Name })
+	res := message.NewChannelList(channels)
+	s.Reply(m, &res)
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"client"
+	"message"
+	"testing"
+	"time"
+)
+
+func TestChannels(t *testing.T) {
+	s := startServer(t, Config{})
+	alice := loginAs(t, s, "alice", client.Config{})
+	bob := loginAs(t, s, "bob", client.Config{})
+	carol := loginAs(t, s, "carol", client.Config{})
+	alice.Join("#go")
+	waitEvent(t, alice, client.TOPIC_E, 2*time.Second)
+	bob.Join("#go")
+	waitEvent(t, bob, client.TOPIC_E, 2*time.Second)
+
+	// Only the members get it, and everyone gets what goes to the default
+	alice.BroadcastTo("#go", "in go")
+	e := waitEvent(t, bob, client.BROADCAST_E, 2*time.Second)
+	if e.Channel != "#go" || e.Message != "in go" {
+		t.Errorf("Got %q in %q", e.Message, e.Channel)
+	}
+	alice.Broadcast("everyone")
+	e = waitEvent(t, carol, client.BROADCAST_E, 2*time.Second)
+	if e.Channel != DEFAULT_CHANNEL || e.Message != "everyone" {
+		t.Errorf("carol got %q in %q", e.Message, e.Channel)
+	}
+
+	bob.Topic("#go", "gophers")
+	for _, c := range []*client.Client{alice, bob} {
+		e = waitEvent(t, c, client.TOPIC_E, 2*time.Second)
+		if e.Channel != "#go" || e.Message != "gophers" || e.From != "bob" {
+			t.Errorf("Got topic %q of %q by %q", e.Message, e.Channel, e.From)
+		}
+	}
+	carol.Topic("#go", "not hers")
+	waitError(t, carol, message.ERR_NOT_IN_CHANNEL)
+	carol.Join("bad name")
+	waitError(t, carol, message.ERR_MALFORMED)
+
+	alice.ListChannels()
+	e = waitEvent(t, alice, client.CHANNELS_E, 2*time.Second)
+	if len(e.Channels) != 2 || e.Channels[0].Name != DEFAULT_CHANNEL || e.Channels[0].Members != 3 ||
+		e.Channels[1].Name != "#go" || e.Channels[1].Members != 2 || e.Channels[1].Topic != "gophers" {
+		t.Errorf("Got channels %+v", e.Channels)
+	}
+
+	// The last one out closes it
+	bob.Part("#go")
+	sent(t, bob)
+	alice.Part("#go")
+	alice.ListChannels()
+	e = waitEvent(t, alice, client.CHANNELS_E, 2*time.Second)
+	if len(e.Channels) != 1 || e.Channels[0].Name != DEFAULT_CHANNEL {
+		t.Errorf("Got channels %+v", e.Channels)
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"log"
+	"message"
+	"net"
+	"time"
+)
+
+type clockMessage struct {
+	User       *net.UDPAddr
+	Offset     *time.Duration
+	Timestamp  *time.Time
+	ServerTime *time.Time
+}
+
+// ****** Server time  ****** //
+// These run in the event loop, like everything else that touches the users
+
+// sendTimeRequest asks everyone for their clock. What comes back in the
+// next period/2 is averaged in adjustClocks
+func (s *Server) sendTimeRequest() {
+	s.areWeGettingClocks = true
+	s.userClocks = s.userClocks[:0]
+	// For server time is always time.Now, since he
+	// doesn't adjust his clock
+	m := message.NewClockSyncPetition(time.Now())
+	log.Println("[Server] Sending time to user", m)
+	for _, u := range s.connections {
+		s.sendMessageToUser(u, &m)
+	}
+}
+
+// adjustClocks stops getting clocks and sends everyone how far they are
+// from the average
+func (s *Server) adjustClocks() {
+	log.Println("[Server] Stop recieving time")
+	s.areWeGettingClocks = false
+	// Sanity check, if no one is here return
+	if len(s.connections) == 0 {
+		return
+	}
+	var sumOfClocks int64
+	var computedCloks int64
+	for _, c := range s.userClocks {
+		// FIXME
+		// Calculate average
+		// TODO Probably should check for overflow
+		log.Println("[Server] ", c)
+		if c.Timestamp == nil {
+			continue
+		}
+		sumOfClocks += c.Timestamp.Unix()
+		computedCloks++
+	}
+	if computedCloks == 0 {
+		return
+	}
+	average := sumOfClocks / computedCloks
+	log.Println("[Server] Clock average", average)
+	// Create new time object and send to users
+	// "0" since we don't have nanoseconds
+	averageTime := time.Unix(average, 0)
+
+	// Then send that average to all users that need to adjust their clocks
+	for i, u := range s.userClocks {
+		// This gives me an offset.
+		// FIXME
+		if u.Timestamp == nil {
+			continue
+		}
+		adjustment := averageTime.Sub(*u.Timestamp)
+		m := message.NewClockOffset(adjustment)
+		log.Println("[Server] Adjustment for user", i, adjustment)
+		log.Println("[Server] Becasue user has", *u.Timestamp)
+		// Get user reference
+		usr, ok := s.connections[u.User.String()]
+		if !ok {
+			log.Println("[Server] error sending message to user with address", u.User.String())
+			continue
+		}
+		s.sendMessageToUser(usr, &m)
+	}
+
+	// Finally, clear slice
+	s.userClocks = s.userClocks[:0]
+}
+
+// sendAddresses tells everyone where the others are, for when a new
+// server has to be elected
+func (s *Server) sendAddresses() {
+	log.Println("[Server] Sending address")
+	for _, usr := range s.connections {
+		for _, u := range s.connections {
+			if usr == u {
+				continue
+			}
+			log.Println("[Server]Sending address to", usr.Alias)
+			addr := u.Address.Port
+			m := message.NewAddressMessage(addr)
+			s.sendMessageToUser(usr, &m)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"log"
+	"message"
+	"net"
+	"time"
+)
+
+// Anyone can write any source address on a datagram. Before a Login or a
+// Register does anything the server answers with a Challenge carrying a
+// cookie, and only goes on when the same message comes back with it. Only
+// who is really at that address can see the cookie, and the challenge is
+// never bigger than what came so it's no use for amplification. A session
+// that moves to a new address is challenged the same way before anything
+// goes there.
+//
+// Cookies aren't kept anywhere, they are an HMAC of the address and the
+// current period. One from the last period is still good
+const (
+	COOKIE_PERIOD = 30 * time.Second
+	COOKIE_SIZE   = 16
+)
+
+func newCookieSecret() []byte {
+	b := make([]byte, sha256.Size)
+	_, err := rand.Read(b)
+	if err != nil {
+		// Without randomness cookies could be guessed
+		panic("Can't make a cookie secret: " + err.Error())
+	}
+	return b
+}
+
+// cookie for who in the period of now
+func (s *Server) cookie(who *net.UDPAddr, now time.Time) string {
+	return s.cookieFor(who, now.UnixNano()/int64(COOKIE_PERIOD))
+}
+
+func (s *Server) cookieFor(who *net.UDPAddr, period int64) string {
+	mac := hmac.New(sha256.New, s.cookieSecret)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(period))
+	mac.Write(b[:])
+	mac.Write([]byte(who.String()))
+	return hex.EncodeToString(mac.Sum(nil)[:COOKIE_SIZE])
+}
+
+func (s *Server) validCookie(cookie string, who *net.UDPAddr, now time.Time) bool {
+	if cookie == "" {
+		return false
+	}
+	period := now.UnixNano() / int64(COOKIE_PERIOD)
+	for _, p := range []int64{period, period - 1} {
+		if hmac.Equal([]byte(cookie), []byte(s.cookieFor(who, p))) {
+			return true
+		}
+	}
+	return false
+}
+
+// needsCookie tells if a message has to prove its address first. If it
+// does it's answered with the challenge
+func (s *Server) needsCookie(t message.Type, p *message.UserPackage, m Message) bool {
+	if t != message.LOGIN_T && t != message.REGISTER_T {
+		return false
+	}
+	if s.proved(p.Header, m) {
+		return false
+	}
+	s.challenge(p.Header, m)
+	return true
+}
+
+// proved tells if the message has a good cookie for where it came from
+func (s *Server) proved(header message.Base, m Message) bool {
+	if s.validCookie(header.Cookie, m.Sender, m.Timestamp) {
+		return true
+	}
+	// Old clients don't know about cookies
+	return header.Cookie == "" && s.config.LegacyLogin
+}
+
+// challenge asks for the message again with a cookie. The challenge is
+// never bigger than what came, or a spoofed address would get more from
+// us than the one spoofing it sent
+func (s *Server) challenge(header message.Base, m Message) {
+	log.Println("[Server] Challenging", header.Type, "from", m.Sender)
+	challenge := message.NewChallenge(header.Id, s.cookie(m.Sender, m.Timestamp))
+	// In whatever he wrote, XML could make it bigger than what came
+	b, err := message.DetectCodec(m.Content).Marshal(&challenge)
+	if err != nil {
+		log.Println("[Server] Error marshaling challenge", err)
+		return
+	}
+	if len(b) > len(m.Content) {
+		log.Println("[Server] Not challenging", m.Sender, "it's too small a message")
+		return
+	}
+	s.sendMessage(m.Sender, b)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"message"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCookiePeriods(t *testing.T) {
+	s := New(Config{})
+	now := time.Now()
+	alice := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	bob := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10}
+	cookie := s.cookie(alice, now)
+	if !s.validCookie(cookie, alice, now) {
+		t.Error("The cookie we just gave isn't good")
+	}
+	if !s.validCookie(cookie, alice, now.Add(COOKIE_PERIOD)) {
+		t.Error("A cookie of the last period isn't good")
+	}
+	if s.validCookie(cookie, alice, now.Add(2*COOKIE_PERIOD)) {
+		t.Error("A cookie of two periods ago is still good")
+	}
+	if s.validCookie(cookie, bob, now) {
+		t.Error("A cookie is good for another address")
+	}
+	if s.validCookie("", alice, now) {
+		t.Error("No cookie is good")
+	}
+	// Another server can't tell ours
+	if New(Config{}).validCookie(cookie, alice, now) {
+		t.Error("A cookie is good for another server")
+	}
+}
+
+// nextAnswer is what the server says next on conn, nil if nothing came
+func nextAnswer(t *testing.T, conn *net.UDPConn) (int, *message.ServerPackage) {
+	t.Helper()
+	got := readRaw(conn, time.Second)
+	if got == nil {
+		return 0, nil
+	}
+	_, p, err := message.DecodeServerMessage(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(got), p
+}
+
+// Nothing but a challenge until the login comes back with the cookie of
+// the address it came from
+func TestLoginCookie(t *testing.T) {
+	s := startServer(t, Config{})
+	alice := rawConn(t, s)
+	login := message.NewLogin("alice")
+	b := marshalLogin(t, "alice")
+	alice.Write(b)
+	size, p := nextAnswer(t, alice)
+	if p == nil || p.Challenge == nil {
+		t.Fatalf("A login without a cookie got %+v", p)
+	}
+	if size > len(b) {
+		t.Errorf("The challenge has %d bytes, the login %d", size, len(b))
+	}
+	cookie := p.Challenge.Cookie
+
+	// Someone else can't use it
+	mallory := rawConn(t, s)
+	login.SetCookie(cookie)
+	b, err := message.XML.Marshal(&login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mallory.Write(b)
+	if _, p = nextAnswer(t, mallory); p == nil || p.Challenge == nil {
+		t.Fatalf("A login with the cookie of someone else got %+v", p)
+	}
+
+	alice.Write(b)
+	// The ack may come before
+	for {
+		_, p = nextAnswer(t, alice)
+		if p == nil || p.Login != nil {
+			break
+		}
+	}
+	if p == nil || p.Login.Session == "" {
+		t.Fatal("No login response with the cookie")
+	}
+}
+
+// Old clients are let in without one if the server says so
+func TestLegacyLogin(t *testing.T) {
+	s := startServer(t, Config{LegacyLogin: true})
+	conn := rawConn(t, s)
+	conn.Write(marshalLogin(t, "alice"))
+	for {
+		_, p := nextAnswer(t, conn)
+		if p == nil || p.Challenge != nil {
+			t.Fatalf("A login without a cookie got %+v", p)
+		}
+		if p.Login != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"errors"
+	"message"
+	"net"
+	"time"
+)
+
+// Request is a message from a client on its way to its handler
+type Request struct {
+	Kind      string               // Type of the message as it came
+	Type      message.Type         // UNKNOWN_T for kinds the message package doesn't know
+	Content   *message.UserPackage // nil for those too, use Decode
+	Header    message.Base
+	Raw       []byte
+	Codec     message.Codec // What the client wrote it in
+	Sender    *net.UDPAddr
+	Timestamp time.Time
+	User      *User // nil if he didn't login
+
+	checked  bool // The password in it is right, the hash workers said so
+	rejected bool // Refused with an error, it isn't acked
+}
+
+// Decode unmarshals the message into v, for message types the message
+// package doesn't know about
+func (r *Request) Decode(v interface{}) error {
+	return r.Codec.Unmarshal(r.Raw, v)
+}
+
+// Handler deals with one kind of message. Handlers run in the event loop,
+// one at a time, so they can use the server without locking
+type Handler func(s *Server, r *Request)
+
+// Middleware wraps a handler to do something before or after it, or to
+// not call it at all
+type Middleware func(next Handler) Handler
+
+// Handle registers the handler for a kind of message, replacing the one
+// before. Handlers and middleware have to be set before Start
+func (s *Server) Handle(kind string, h Handler) {
+	s.handlers[kind] = h
+}
+
+// Use adds middleware around every handler. The first one added is the
+// first one to see the request
+func (s *Server) Use(m ...Middleware) {
+	s.middleware = append(s.middleware, m...)
+}
+
+// buildRoutes wraps each handler in the middleware, it's done once at Start
+func (s *Server) buildRoutes() {
+	s.routes = make(map[string]Handler, len(s.handlers))
+	for kind, h := range s.handlers {
+		for i := len(s.middleware) - 1; i >= 0; i-- {
+			h = s.middleware[i](h)
+		}
+		s.routes[kind] = h
+	}
+}
+
+// registerHandlers sets what the server does for the messages it knows
+func (s *Server) registerHandlers() {
+	s.Handle(message.LOGIN, (*Server).loginHandler)
+	s.Handle(message.REGISTER, (*Server).registerHandler)
+	s.Handle(message.BROAD, (*Server).broadcastHandler)
+	s.Handle(message.DM, (*Server).directMessageHandler)
+	s.Handle(message.GET_CONN, (*Server).getConnectedHandler)
+	s.Handle(message.BLOCK, (*Server).blockHandler)
+	s.Handle(message.FILE, (*Server).fileHandler)
+	s.Handle(message.OFFSET, (*Server).clockHandler)
+	s.Handle(message.EXIT, (*Server).exitHandler)
+	s.Handle(message.GAP, (*Server).gapHandler)
+	s.Handle(message.PUBLISH_KEY, (*Server).publishKeyHandler)
+	s.Handle(message.KEY_REQ, (*Server).keyRequestHandler)
+	s.Handle(message.HISTORY_REQ, (*Server).historyHandler)
+	s.Handle(message.SEARCH, (*Server).searchHandler)
+	s.Handle(message.JOIN, (*Server).joinHandler)
+	s.Handle(message.PART, (*Server).partHandler)
+	s.Handle(message.TOPIC, (*Server).topicHandler)
+	s.Handle(message.LIST, (*Server).listHandler)
+	s.Handle(message.KICK, (*Server).kickHandler)
+	s.Handle(message.BAN, (*Server).banHandler)
+	s.Handle(message.MUTE, (*Server).muteHandler)
+	s.Handle(message.INVITE, (*Server).inviteHandler)
+	s.Handle(message.MODE, (*Server).modeHandler)
+
+	limits := DefaultLimits()
+	if s.config.Limits != nil {
+		limits = *s.config.Limits
+	}
+	// Flooders are stopped before anything else is done for them
+	s.Use(Recover, Logging, Flood(limits), RequireLogin(message.LOGIN, message.REGISTER, message.EXIT), RequireCapability(requiredCapability), Moderate)
+}
+
+// Messages that only make sense if they were negotiated at login
+var requiredCapability = map[string]string{
+	message.GAP: message.CAP_ORDER,
+}
+
+// ****** For handlers  ****** //
+// These can only be called from a handler, like everything else that
+// touches the users
+
+// Reply sends msg to whoever sent the request
+func (s *Server) Reply(r *Request, msg interface{}) error {
+	if r.User != nil {
+		return s.sendMessageToUser(r.User, msg)
+	}
+	m, err := s.codecFor(r.Sender).Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.sendMessage(r.Sender, m)
+}
+
+// SendTo sends msg to a user, he gets it when he logs in if he isn't now
+func (s *Server) SendTo(alias string, msg interface{}) error {
+	usr, ok := s.users[alias]
+	if !ok {
+		return errUnknownUser
+	}
+	return s.sendMessageToUser(usr, msg)
+}
+
+// Error tells whoever sent the request what went wrong with it. The error
+// is his answer, the request isn't acked
+func (s *Server) Error(r *Request, code message.ErrorCode, text string) {
+	r.rejected = true
+	s.sendError(r.Sender, code, r.Header.Id, text)
+}
+
+// dispatch hands the request to its handler
+func (s *Server) dispatch(r *Request) {
+	h, ok := s.routes[r.Kind]
+	if !ok {
+		s.Error(r, message.ERR_UNSUPPORTED, "Couldn't match type to any know type")
+		return
+	}
+	h(s, r)
+}
+
+// isCustom tells if there's a handler for a kind the message package
+// can't decode
+func (s *Server) isCustom(kind string) bool {
+	_, ok := s.routes[kind]
+	return ok
+}
+
+var errUnknownUser = errors.New("That user doesn't exist")
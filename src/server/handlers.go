@@ -0,0 +1,338 @@
+package server
+
+import (
+	"log"
+	"message"
+	"strings"
+	"time"
+)
+
+// ****** Server handlers  ****** //
+// ackHandler forgets the messages the user confirmed
+func (s *Server) ackHandler(usr *User, ack *message.Ack) {
+	if usr == nil || !usr.can(message.CAP_ACK) {
+		return
+	}
+	for _, id := range ack.Ids {
+		u, ok := usr.Unacked[id]
+		if !ok {
+			continue
+		}
+		delete(usr.Unacked, id)
+		if u.Queued {
+			s.delivered(usr, id)
+		}
+	}
+}
+
+func (s *Server) loginHandler(m *Request) {
+	login := m.Content.Login
+	_, ok := message.NegotiateVersion(login.Versions, message.Versions)
+	if !ok {
+		log.Println("[Server] Rejecting", m.Sender, "speaks versions", login.Versions)
+		errMsg := message.NewVersionErrorMessage(m.Content.Header.Id, message.Versions)
+		s.sendErrorMessage(m.Sender, &errMsg)
+		m.rejected = true
+		return
+	}
+	usr, ok := s.isUserConnected(m.Sender)
+	if ok {
+		// User is already connected, meanning he already picked an alias
+		// don't do anything.
+		// Maybe this could be an error, but it seems to much
+		log.Println("[Server] User already connected", usr)
+	} else {
+		// Means we haven't seen him before
+		s.login(m)
+	}
+}
+
+// login registers the connection of the user. Registered nicknames need
+// their password first, it's checked off the event loop and the request
+// comes back to here once it's right
+func (s *Server) login(m *Request) {
+	login := m.Content.Login
+	if waiting, ok := s.registering[login.Nickname]; ok {
+		// He may be the one registering it, and if not he needs the password
+		s.registering[login.Nickname] = append(waiting, m)
+		return
+	}
+	account, hasAccount := s.accounts.Get(login.Nickname)
+	if hasAccount && !m.checked {
+		ok, wait := s.canTry(login.Nickname, m.Timestamp)
+		if !ok {
+			log.Println("[Server] Not checking another password for", login.Nickname, "from", m.Sender)
+			s.rateLimited(m, wait, errLocked.Error())
+			return
+		}
+		err := s.hash(hashJob{Request: m, Nickname: login.Nickname, Password: login.Password, Account: account})
+		if err != nil {
+			// It won't be checked after all
+			s.authFailures[login.Nickname].Checking--
+			s.rateLimited(m, time.Second, err.Error())
+		}
+		return
+	}
+	log.Println("[Server] Registring new connection", m.Sender)
+	err := s.registerUser(m.Sender, login)
+	if err == errLoginTaken {
+		s.Error(m, message.ERR_NICK_TAKEN, err.Error())
+	} else if err == errChannelNick {
+		s.Error(m, message.ERR_MALFORMED, err.Error())
+	} else if err != nil {
+		s.Error(m, message.ERR_UNKNOWN, err.Error())
+	}
+}
+
+// passwordChecked is where a login goes on once its password was hashed
+func (s *Server) passwordChecked(r hashResult) {
+	m := r.Request
+	nick := m.Content.Login.Nickname
+	s.checked(nick, r.Err == nil, time.Now())
+	if r.Err != nil {
+		log.Println("[Server] Wrong password for", nick, "from", m.Sender)
+		s.Error(m, message.ERR_AUTH, r.Err.Error())
+		return
+	}
+	// Things may have moved while it was hashed, he goes through it all again
+	m.checked = true
+	s.loginHandler(m)
+}
+
+// registerHandler creates an account. Whoever registers still has to login
+// with it, unless he already is that guest. The password is hashed off the
+// event loop, accountMade adds the account once it is
+func (s *Server) registerHandler(m *Request) {
+	if !s.canRegister(m) {
+		return
+	}
+	reg := m.Content.Register
+	err := s.hash(hashJob{Request: m, Nickname: reg.Nickname, Password: reg.Password})
+	if err != nil {
+		s.rateLimited(m, time.Second, err.Error())
+		return
+	}
+	// Logins for it wait until it's there, or they'd be a guest
+	s.registering[reg.Nickname] = nil
+}
+
+// canRegister tells if the nickname can be registered by whoever sent m,
+// if not he gets why
+func (s *Server) canRegister(m *Request) bool {
+	reg := m.Content.Register
+	if reg.Nickname == "" {
+		s.Error(m, message.ERR_MALFORMED, "The nickname can't be empty")
+		return false
+	}
+	if strings.HasPrefix(reg.Nickname, "#") {
+		s.Error(m, message.ERR_MALFORMED, errChannelNick.Error())
+		return false
+	}
+	usr, ok := s.users[reg.Nickname]
+	if ok && usr.Online && usr != m.User {
+		// A guest is using it right now, he has to register it himself
+		s.Error(m, message.ERR_NICK_TAKEN, errLoginTaken.Error())
+		return false
+	}
+	if _, taken := s.accounts.Get(reg.Nickname); taken {
+		s.Error(m, message.ERR_NICK_TAKEN, errAccountExists.Error())
+		return false
+	}
+	if _, taken := s.registering[reg.Nickname]; taken {
+		s.Error(m, message.ERR_NICK_TAKEN, errAccountExists.Error())
+		return false
+	}
+	if len(reg.Password) < MIN_PASSWORD {
+		s.Error(m, message.ERR_AUTH, errShortPassword.Error())
+		return false
+	}
+	return true
+}
+
+// accountMade adds the account the workers made for a register, then the
+// logins that waited for it go on
+func (s *Server) accountMade(r hashResult) {
+	m := r.Request
+	reg := m.Content.Register
+	waiting := s.registering[reg.Nickname]
+	delete(s.registering, reg.Nickname)
+	defer func() {
+		for _, login := range waiting {
+			s.loginHandler(login)
+		}
+	}()
+	if r.Err != nil {
+		log.Println("[Server] Couldn't register", reg.Nickname, r.Err)
+		s.Error(m, message.ERR_UNKNOWN, "Couldn't register, try again later")
+		return
+	}
+	// Someone may have taken it while it was hashed
+	if !s.canRegister(m) {
+		return
+	}
+	usr, ok := s.users[reg.Nickname]
+	if ok && usr != m.User {
+		// An offline guest had it. Whoever logs in with the password is
+		// the owner from now on and nothing of the guest is his
+		s.startOver(usr)
+	}
+	err := s.accounts.Add(r.Account)
+	if err != nil {
+		log.Println("[Server] Couldn't register", reg.Nickname, err)
+		s.Error(m, message.ERR_UNKNOWN, "Couldn't register, try again later")
+		return
+	}
+	log.Println("[Server] Registered", reg.Nickname)
+}
+
+// publishKeyHandler keeps the key others encrypt for the user with
+func (s *Server) publishKeyHandler(m *Request) {
+	m.User.PublicKey = m.Content.PublishKey.Key
+	log.Println("[Server]", m.User.Alias, "published a key")
+}
+
+// keyRequestHandler gives the key of a user, empty if we don't have any
+func (s *Server) keyRequestHandler(m *Request) {
+	nick := m.Content.KeyRequest.Nickname
+	key := ""
+	if usr, ok := s.users[nick]; ok {
+		key = usr.PublicKey
+	}
+	msg := message.NewKeyResponse(nick, key)
+	s.Reply(m, &msg)
+}
+
+func (s *Server) broadcastHandler(m *Request) {
+	um := m.Content.UMessage
+	if um.Encrypted {
+		// Nobody but one user could read it
+		s.Error(m, message.ERR_MALFORMED, "Only direct messages can be encrypted")
+		return
+	}
+	ch := s.memberOf(m, um.Channel)
+	if ch == nil {
+		return
+	}
+	// Create a broadcastMessage
+	msg := message.NewSBroadcast(m.User.Alias, um.Message)
+	msg.Channel = ch.Name
+	msg.SignedId, msg.Signature, msg.SigningKey = um.Id, um.Signature, um.SigningKey
+	log.Println("[Server] ", msg)
+	s.remember(ch.Name, historyEntry(&msg, ""))
+	s.sendBroadcast(ch, &msg)
+}
+
+func (s *Server) directMessageHandler(m *Request) {
+	dm := m.Content.UMessage
+	// Get the alias of the sender
+	alias := m.User.Alias
+	// Create new message
+	msg := message.NewSDirectMessage(alias, dm.Message)
+	// We can't read it if it's encrypted, it goes as it is. So does the
+	// signature, it's for him to check
+	msg.Encrypted = dm.Encrypted
+	msg.SignedId, msg.Signature, msg.SigningKey = dm.Id, dm.Signature, dm.SigningKey
+
+	// Get a reference to the user we are sending the message
+	reciever, ok := s.users[dm.To]
+	if !ok {
+		s.sendError(m.Sender, message.ERR_UNKNOWN_RECIPIENT, m.Content.Header.Id, "The user "+dm.To+" doesn't exist!")
+		return
+	}
+	if isBlocked(reciever, alias) {
+		s.sendError(m.Sender, message.ERR_BLOCKED, m.Content.Header.Id, dm.To+" blocked you")
+		return
+	}
+
+	s.remember(dmConversation(alias, dm.To), historyEntry(&msg, dm.To))
+	// send it! If he isn't there the sender gets a receipt later
+	s.sendFrom(reciever, &msg, &origin{From: alias, Ref: m.Content.Header.Id, Receipt: true})
+}
+
+func (s *Server) getConnectedHandler(m *Request) {
+	// Get all the alias of connected users
+	// TODO This is probably very expensive, maybe should keep a cache of this
+	// but maybe is not worthy
+	connectedUsers := make([]string, len(s.connections))
+	i := 0
+	for _, usr := range s.connections {
+		connectedUsers[i] = usr.Alias
+		i++
+	}
+
+	// Make the response
+	msg := message.NewSGetConnected(connectedUsers)
+
+	// Send it!
+	s.sendMessageToUser(m.User, &msg)
+}
+
+func (s *Server) blockHandler(m *Request) {
+	block := m.Content.Block
+	// Whoever sent it is who blocks, never somebody else
+	s.blockUser(m.User.Alias, block.Blocked)
+}
+
+func (s *Server) fileHandler(m *Request) {
+	alias := m.User.Alias
+	fm := m.Content.File
+	// Get a reference to the user we are sending the message
+	reciever, ok := s.users[fm.To]
+	if !ok {
+		s.sendError(m.Sender, message.ERR_UNKNOWN_RECIPIENT, m.Content.Header.Id, "The user "+fm.To+" doesn't exist!")
+		return
+	}
+	if isBlocked(reciever, alias) {
+		s.sendError(m.Sender, message.ERR_BLOCKED, m.Content.Header.Id, fm.To+" blocked you")
+		return
+	}
+	// A new one, what he sent has his session in it
+	msg := message.NewSFile(alias, fm)
+	// Only the end of the file gets a receipt, a receipt for each piece
+	// would be too much
+	o := &origin{From: alias, Ref: fm.Id, Receipt: fm.Kind == message.FILETRANSFER_END}
+	s.sendFrom(reciever, &msg, o)
+}
+
+// gapHandler sends again the ordered messages a user says he is missing,
+// as long as we still have them
+func (s *Server) gapHandler(m *Request) {
+	usr := m.User
+	for _, order := range m.Content.Gap.Missing {
+		sent := usr.Sent[order%ORDER_HISTORY]
+		if sent.Order != order {
+			log.Println("[Server] Don't have message", order, "for", usr.Alias, "anymore")
+			continue
+		}
+		s.sendMessage(usr.Address, sent.Bytes)
+	}
+}
+
+func (s *Server) clockHandler(m *Request) {
+	offsetM := m.Content.Clock
+	log.Println("Server got", offsetM.Offset)
+	if !s.areWeGettingClocks {
+		// Ignore value
+		log.Println("Clock handler rejected message")
+		return
+	}
+	log.Println("Clock handler accepted message")
+	serverTime := time.Now()
+	timestamp := serverTime.Add(offsetM.Offset)
+	message := clockMessage{
+		User:       m.Sender,
+		Offset:     &offsetM.Offset,
+		Timestamp:  &timestamp,
+		ServerTime: &serverTime,
+	}
+	s.userClocks = append(s.userClocks, message)
+}
+
+func (s *Server) exitHandler(m *Request) {
+	if m.User == nil {
+		return
+	}
+	// I guess that's it
+	s.endSession(m.User)
+	s.disconnectUser(m.User.Address)
+}
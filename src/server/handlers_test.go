@@ -0,0 +1,45 @@
+package server
+
+import (
+	"client"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// loginAs dials s and logs in with nick, the client is ready to use
+func loginAs(t *testing.T, s *Server, nick string, config client.Config) *client.Client {
+	t.Helper()
+	c := dialServer(t, s, config)
+	c.Login(nick)
+	waitEvent(t, c, client.LOGIN_E, 2*time.Second)
+	return c
+}
+
+// A file is passed on as a new message, nothing of the session of whoever
+// sent it goes with it
+func TestFileHasNoSession(t *testing.T) {
+	s := startServer(t, Config{})
+	alice := loginAs(t, s, "alice", client.Config{})
+	bob := loginAs(t, s, "bob", client.Config{})
+
+	f, err := ioutil.TempFile("", "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("what alice sends")
+	f.Close()
+	go alice.SendFile("bob", f.Name())
+
+	for kinds := 0; kinds < 3; kinds++ {
+		e := waitEvent(t, bob, client.FILE_E, 2*time.Second)
+		if e.From != "alice" {
+			t.Errorf("File from %q", e.From)
+		}
+		if e.File.Token != "" || e.File.Cookie != "" {
+			t.Fatalf("Piece %d came with the token %q and cookie %q", e.File.Kind, e.File.Token, e.File.Cookie)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"message"
+	"store"
+	"time"
+)
+
+// Broadcasts and direct messages are kept in the store, so whoever comes
+// late can ask what was said. Each channel is a conversation named like
+// it, and so are the direct messages between two users. Each one keeps
+// store.MAX_HISTORY of them. Files aren't kept
+const (
+	HISTORY_PAGE     = 20  // Messages in a page if the client doesn't say
+	MAX_HISTORY_PAGE = 100 // And the most he can ask for at once
+)
+
+// dmConversation is the same for both of them
+func dmConversation(a string, b string) string {
+	if b < a {
+		a, b = b, a
+	}
+	return "dm\x00" + a + "\x00" + b
+}
+
+// remember adds a message to the history of its conversation
+func (s *Server) remember(conversation string, h message.HistoryEntry) {
+	b, err := json.Marshal(h)
+	if err == nil {
+		err = s.store.AddHistory(conversation, store.Entry{Id: h.Id, Time: h.Time, Data: b})
+	}
+	if err != nil {
+		log.Println("[Server] Couldn't keep", h.Id, "in the history", err)
+		return
+	}
+	s.index.add(conversation, h)
+}
+
+// historyEntry is what we remember of a message
+func historyEntry(msg *message.SMessage, to string) message.HistoryEntry {
+	return message.HistoryEntry{
+		Id:         msg.Id,
+		Time:       time.Now(),
+		Kind:       msg.Type,
+		From:       msg.From,
+		To:         to,
+		Channel:    msg.Channel,
+		Message:    msg.Message,
+		Encrypted:  msg.Encrypted,
+		SignedId:   msg.SignedId,
+		Signature:  msg.Signature,
+		SigningKey: msg.SigningKey,
+	}
+}
+
+// historyHandler gives a page of the broadcasts of a channel he is in, or
+// of the direct messages between the user and someone else. What comes
+// from users he blocked is left out
+func (s *Server) historyHandler(m *Request) {
+	req := m.Content.History
+	usr := m.User
+	direct := req.With != "" && req.With[0] != '#'
+	var conversation string
+	if !direct {
+		ch := s.memberOf(m, req.With)
+		if ch == nil {
+			return
+		}
+		conversation = ch.Name
+	} else {
+		if _, ok := s.users[req.With]; !ok {
+			s.Error(m, message.ERR_UNKNOWN_RECIPIENT, "The user "+req.With+" doesn't exist!")
+			return
+		}
+		conversation = dmConversation(usr.Alias, req.With)
+	}
+	limit := req.Limit
+	if limit <= 0 {
+		limit = HISTORY_PAGE
+	}
+	if limit > MAX_HISTORY_PAGE {
+		limit = MAX_HISTORY_PAGE
+	}
+	stored, err := s.store.History(conversation)
+	if err != nil {
+		log.Println("[Server] Couldn't read the history of", usr.Alias, err)
+		s.Error(m, message.ERR_UNKNOWN, "Couldn't read the history, try again later")
+		return
+	}
+	entries := make([]message.HistoryEntry, 0, len(stored))
+	found := false
+	for _, e := range stored {
+		if e.Id == req.Before {
+			found = true
+			break
+		}
+		if !req.Until.IsZero() && !e.Time.Before(req.Until) {
+			break
+		}
+		if direct && e.Time.Before(usr.Joined) {
+			// Said to whoever had the nickname before him
+			continue
+		}
+		var h message.HistoryEntry
+		err := json.Unmarshal(e.Data, &h)
+		if err != nil {
+			log.Println("[Server] Skipping a broken history entry", e.Id, err)
+			continue
+		}
+		if isBlocked(usr, h.From) {
+			continue
+		}
+		entries = append(entries, h)
+	}
+	if req.Before != "" && !found {
+		// It's too old, there's nothing before it we still have
+		entries = entries[:0]
+	}
+	more := len(entries) > limit
+	if more {
+		entries = entries[len(entries)-limit:]
+	}
+	res := message.NewHistoryResponse(req.With, entries, more)
+	s.Reply(m, &res)
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"client"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// said are the messages of a page of history
+func said(items []client.HistoryItem) []string {
+	var texts []string
+	for _, h := range items {
+		texts = append(texts, h.Message)
+	}
+	return texts
+}
+
+// Pages go back from the oldest one we have, and leave out whoever we
+// blocked
+func TestHistoryPaging(t *testing.T) {
+	s := startServer(t, Config{})
+	alice := loginAs(t, s, "alice", client.Config{})
+	bob := loginAs(t, s, "bob", client.Config{})
+	for i := 0; i < 5; i++ {
+		alice.Broadcast(fmt.Sprint(i))
+	}
+	for i := 0; i < 5; i++ {
+		waitEvent(t, bob, client.BROADCAST_E, 2*time.Second)
+	}
+
+	before := ""
+	for _, want := range []struct {
+		said string
+		more bool
+	}{
+		{"[3 4]", true},
+		{"[1 2]", true},
+		{"[0]", false},
+	} {
+		bob.History("", 2, before)
+		e := waitEvent(t, bob, client.HISTORY_E, 2*time.Second)
+		if got := fmt.Sprint(said(e.History)); got != want.said || e.MoreHistory != want.more {
+			t.Fatalf("Page before %q has %s and more %v, want %s and %v", before, got, e.MoreHistory, want.said, want.more)
+		}
+		before = e.History[0].Id
+	}
+
+	alice.DirectMessage("bob", "just for you")
+	waitEvent(t, bob, client.DM_E, 2*time.Second)
+	bob.History("alice", 0, "")
+	e := waitEvent(t, bob, client.HISTORY_E, 2*time.Second)
+	if got := fmt.Sprint(said(e.History)); got != "[just for you]" || e.MoreHistory {
+		t.Errorf("History with alice has %s and more %v", got, e.MoreHistory)
+	}
+
+	bob.Block("alice")
+	bob.History("", 0, "")
+	e = waitEvent(t, bob, client.HISTORY_E, 2*time.Second)
+	if len(e.History) != 0 {
+		t.Errorf("Got %v from alice after blocking her", said(e.History))
+	}
+	// She still sees what she said
+	alice.History("", 0, "")
+	e = waitEvent(t, alice, client.HISTORY_E, 2*time.Second)
+	if got := fmt.Sprint(said(e.History)); got != "[0 1 2 3 4]" {
+		t.Errorf("alice's history has %s", got)
+	}
+}
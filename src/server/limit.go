@@ -0,0 +1,238 @@
+package server
+
+import (
+	"log"
+	"message"
+	"time"
+)
+
+// Limit is a token bucket. Rate tokens come back each second, up to Burst,
+// and each message takes one
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Limits says how much each kind of message can be sent. Kinds that aren't
+// there use the one for "", and if there isn't one they have no limit
+type Limits map[string]Limit
+
+// LimitConfig is what Flood enforces. PerSession counts the messages of
+// each logged in user, wherever he sends them from, and PerAddress the
+// messages from each IP, logged in or not.
+//
+// Every message over a limit is a strike. After Strikes of them the
+// offender is muted for MuteFor, and a user muted DisconnectAfter times
+// is thrown out
+type LimitConfig struct {
+	PerSession      Limits
+	PerAddress      Limits
+	Strikes         int
+	MuteFor         time.Duration
+	DisconnectAfter int
+}
+
+// DefaultLimits leave normal use alone. Files go in many small pieces and
+// many users can share an IP, so those get more room
+func DefaultLimits() LimitConfig {
+	return LimitConfig{
+		PerSession: Limits{
+			"":              {Rate: 10, Burst: 20},
+			message.BROAD:   {Rate: 2, Burst: 5},
+			message.FILE:    {Rate: 100, Burst: 200},
+			message.KEY_REQ: {Rate: 5, Burst: 10},
+			// They go through a lot of messages
+			message.HISTORY_REQ: {Rate: 2, Burst: 10},
+			message.SEARCH:      {Rate: 1, Burst: 5},
+			// Each one can make a channel
+			message.JOIN: {Rate: 1, Burst: 10},
+		},
+		PerAddress: Limits{
+			"":               {Rate: 200, Burst: 400},
+			message.LOGIN:    {Rate: 5, Burst: 50},
+			message.REGISTER: {Rate: 1, Burst: 5},
+		},
+		Strikes:         10,
+		MuteFor:         30 * time.Second,
+		DisconnectAfter: 3,
+	}
+}
+
+const (
+	LIMIT_SWEEP_EVERY = 10000            // Requests between looking for old buckets
+	LIMIT_IDLE        = 10 * time.Minute // A bucket nobody used for this long is forgotten
+)
+
+type bucket struct {
+	Tokens float64
+	Last   time.Time
+}
+
+// take refills the bucket for the time that passed and takes a token if
+// there's one. If there isn't it says how long until there is
+func (b *bucket) take(l Limit, now time.Time) (bool, time.Duration) {
+	if b.Last.IsZero() {
+		b.Tokens = float64(l.Burst)
+	} else {
+		b.Tokens += now.Sub(b.Last).Seconds() * l.Rate
+		if b.Tokens > float64(l.Burst) {
+			b.Tokens = float64(l.Burst)
+		}
+	}
+	b.Last = now
+	if b.Tokens >= 1 {
+		b.Tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.Tokens) / l.Rate * float64(time.Second))
+}
+
+// Someone who went over a limit
+type offender struct {
+	Strikes    int
+	Mutes      int
+	MutedUntil time.Time
+	Last       time.Time
+}
+
+// limiter is the state of Flood. Only the event loop gets here, no need
+// to lock
+type limiter struct {
+	config    LimitConfig
+	buckets   map[string]*bucket
+	offenders map[string]*offender
+	requests  int
+}
+
+// Flood applies the limits to every request. Whoever goes over them gets
+// ERR_RATE_LIMITED with how long to wait
+func Flood(config LimitConfig) Middleware {
+	l := &limiter{
+		config:    config,
+		buckets:   make(map[string]*bucket),
+		offenders: make(map[string]*offender),
+	}
+	return func(next Handler) Handler {
+		return func(s *Server, r *Request) {
+			if l.allow(s, r) {
+				next(s, r)
+			}
+		}
+	}
+}
+
+func (l *limiter) allow(s *Server, r *Request) bool {
+	now := r.Timestamp
+	l.requests++
+	if l.requests%LIMIT_SWEEP_EVERY == 0 {
+		l.sweep(now)
+	}
+	address := "address " + r.Sender.IP.String()
+	session := ""
+	if r.User != nil {
+		session = "user " + r.User.Alias
+	}
+	// Someone muted is told until when, the error is no bigger than the
+	// ack he'd get otherwise. He can still leave
+	if r.Kind != message.EXIT {
+		for _, who := range []string{session, address} {
+			if until, ok := l.mutedUntil(who, now); ok {
+				log.Println("[Server] Refusing", r.Kind, "from muted", r.Sender)
+				s.rateLimited(r, until.Sub(now), "You are muted for flooding")
+				return false
+			}
+		}
+	}
+	if session != "" {
+		ok, wait := l.take(session, l.config.PerSession, r.Kind, now)
+		if !ok {
+			l.reject(s, r, session, wait, "Too many "+r.Kind+" messages")
+			return false
+		}
+	}
+	ok, wait := l.take(address, l.config.PerAddress, r.Kind, now)
+	if !ok {
+		l.reject(s, r, address, wait, "Too many "+r.Kind+" messages from your address")
+		return false
+	}
+	return true
+}
+
+// mutedUntil tells if who is muted, and until when
+func (l *limiter) mutedUntil(who string, now time.Time) (time.Time, bool) {
+	o, ok := l.offenders[who]
+	if !ok || !now.Before(o.MutedUntil) {
+		return time.Time{}, false
+	}
+	return o.MutedUntil, true
+}
+
+// take takes a token from the bucket of who for kind, if it has a limit
+func (l *limiter) take(who string, limits Limits, kind string, now time.Time) (bool, time.Duration) {
+	limit, ok := limits[kind]
+	if !ok {
+		limit, ok = limits[""]
+		// Kinds without their own limit share the bucket
+		kind = ""
+	}
+	if !ok || limit.Rate <= 0 {
+		return true, 0
+	}
+	key := who + " " + kind
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{}
+		l.buckets[key] = b
+	}
+	return b.take(limit, now)
+}
+
+// reject counts a message over the limit as a strike, and mutes or throws
+// out whoever keeps doing it
+func (l *limiter) reject(s *Server, r *Request, who string, wait time.Duration, text string) {
+	o, ok := l.offenders[who]
+	if !ok {
+		o = &offender{}
+		l.offenders[who] = o
+	}
+	o.Last = r.Timestamp
+	o.Strikes++
+	if l.config.Strikes <= 0 || o.Strikes < l.config.Strikes {
+		s.rateLimited(r, wait, text+", wait "+wait.Round(time.Millisecond).String())
+		return
+	}
+	o.Strikes = 0
+	o.Mutes++
+	o.MutedUntil = r.Timestamp.Add(l.config.MuteFor)
+	log.Println("[Server] Muting", who, "for", l.config.MuteFor)
+	if r.User != nil && who == "user "+r.User.Alias && l.config.DisconnectAfter > 0 && o.Mutes >= l.config.DisconnectAfter {
+		log.Println("[Server] Throwing out", r.User.Alias, "for flooding")
+		o.Mutes = 0
+		s.rateLimited(r, l.config.MuteFor, "You were disconnected for flooding")
+		s.endSession(r.User)
+		s.disconnectUser(r.User.Address)
+		return
+	}
+	s.rateLimited(r, l.config.MuteFor, "You are muted for flooding")
+}
+
+// sweep forgets the buckets and offenders nobody used for a while
+func (l *limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.Last) > LIMIT_IDLE {
+			delete(l.buckets, key)
+		}
+	}
+	for who, o := range l.offenders {
+		if now.Sub(o.Last) > LIMIT_IDLE && now.After(o.MutedUntil) {
+			delete(l.offenders, who)
+		}
+	}
+}
+
+// rateLimited tells whoever sent the request to slow down
+func (s *Server) rateLimited(r *Request, wait time.Duration, text string) {
+	r.rejected = true
+	msg := message.NewRateLimitErrorMessage(r.Header.Id, text, wait)
+	s.sendErrorMessage(r.Sender, &msg)
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"client"
+	"message"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	start := time.Now()
+	var b bucket
+	l := Limit{Rate: 2, Burst: 3}
+	// It starts full
+	for i := 0; i < 3; i++ {
+		if ok, _ := b.take(l, start); !ok {
+			t.Fatalf("Token %d of a full bucket wasn't there", i)
+		}
+	}
+	if ok, wait := b.take(l, start); ok || wait != 500*time.Millisecond {
+		t.Errorf("Empty bucket gave %v and a wait of %v", ok, wait)
+	}
+	// Half a token came back, the wait is for the other half
+	if ok, wait := b.take(l, start.Add(250*time.Millisecond)); ok || wait != 250*time.Millisecond {
+		t.Errorf("Half a token gave %v and a wait of %v", ok, wait)
+	}
+	if ok, _ := b.take(l, start.Add(500*time.Millisecond)); !ok {
+		t.Error("No token after waiting for it")
+	}
+	// A long quiet time doesn't go past the burst
+	later := start.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		b.take(l, later)
+	}
+	if ok, _ := b.take(l, later); ok {
+		t.Error("Got more than the burst after a long wait")
+	}
+}
+
+func TestLimiterKinds(t *testing.T) {
+	now := time.Now()
+	l := &limiter{buckets: make(map[string]*bucket), offenders: make(map[string]*offender)}
+	limits := Limits{
+		"":              {Rate: 1, Burst: 2},
+		message.BROAD:   {Rate: 1, Burst: 1},
+		message.KEY_REQ: {Rate: 0},
+	}
+	if ok, _ := l.take("user alice", limits, message.BROAD, now); !ok {
+		t.Fatal("First broadcast was limited")
+	}
+	if ok, _ := l.take("user alice", limits, message.BROAD, now); ok {
+		t.Error("Broadcast over its own burst")
+	}
+	// Kinds without a limit of their own share one bucket
+	l.take("user alice", limits, message.DM, now)
+	l.take("user alice", limits, message.BLOCK, now)
+	if ok, _ := l.take("user alice", limits, message.GET_CONN, now); ok {
+		t.Error("The shared bucket had a third token")
+	}
+	if ok, _ := l.take("user bob", limits, message.DM, now); !ok {
+		t.Error("bob is limited by what alice sent")
+	}
+	// No rate, no limit
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.take("user alice", limits, message.KEY_REQ, now); !ok {
+			t.Fatal("Limited a kind without a rate")
+		}
+	}
+	if ok, _ := l.take("user alice", Limits{}, message.DM, now); !ok {
+		t.Error("Limited without any limits")
+	}
+}
+
+// Someone muted is told so instead of getting an ack, but can still leave
+func TestLimiterMuted(t *testing.T) {
+	s := startServer(t, Config{})
+	now := time.Now()
+	l := &limiter{config: DefaultLimits(), buckets: make(map[string]*bucket), offenders: make(map[string]*offender)}
+	alice := &User{Alias: "alice"}
+	l.offenders["user alice"] = &offender{MutedUntil: now.Add(time.Minute), Last: now}
+	r := &Request{Kind: message.BROAD, Sender: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}, User: alice, Timestamp: now}
+	if l.allow(s, r) || !r.rejected {
+		t.Error("Muted user was allowed to talk")
+	}
+	r.rejected = false
+	r.Kind = message.EXIT
+	if !l.allow(s, r) {
+		t.Error("Muted user can't leave")
+	}
+	// Others at his address aren't muted with him
+	other := &Request{Kind: message.BROAD, Sender: r.Sender, User: &User{Alias: "bob"}, Timestamp: now}
+	if !l.allow(s, other) {
+		t.Error("Muted someone else at the same address")
+	}
+	r.Kind, r.Timestamp = message.BROAD, now.Add(2*time.Minute)
+	if !l.allow(s, r) {
+		t.Error("Still muted after it ran out")
+	}
+
+	// The mute is kept even if it's old, the rest is forgotten
+	l.offenders["user carol"] = &offender{MutedUntil: now.Add(time.Hour), Last: now}
+	l.sweep(now.Add(2 * LIMIT_IDLE))
+	if len(l.buckets) != 0 {
+		t.Errorf("%d idle buckets kept", len(l.buckets))
+	}
+	if _, ok := l.offenders["user alice"]; ok {
+		t.Error("Kept an old offender whose mute ran out")
+	}
+	if _, ok := l.offenders["user carol"]; !ok {
+		t.Error("Forgot someone who is still muted")
+	}
+}
+
+// What the limiter refuses gets an error instead of an ack, and isn't
+// taken as seen when it comes again
+func TestLimitedNotAcked(t *testing.T) {
+	s := startServer(t, Config{Limits: &LimitConfig{PerSession: Limits{message.BROAD: {Rate: 2, Burst: 1}}}})
+	bob := loginAs(t, s, "bob", client.Config{})
+
+	conn := rawConn(t, s)
+	login := message.NewLogin("alice")
+	p := rawAsk(t, conn, &login, func(p *message.ServerPackage) bool { return p.Login != nil })
+	first := message.NewBroadcast("first")
+	first.Token = p.Login.Session
+	rawAsk(t, conn, &first, ackOf(first.Id))
+	waitEvent(t, bob, client.BROADCAST_E, 2*time.Second)
+
+	second := message.NewBroadcast("second")
+	second.Token = p.Login.Session
+	p = rawAsk(t, conn, &second, func(p *message.ServerPackage) bool { return p.Error != nil || p.Ack != nil })
+	if p.Error == nil || p.Error.Code != message.ERR_RATE_LIMITED || p.Error.Ref != second.Id {
+		t.Fatalf("Over the limit got %+v", p.Message())
+	}
+	if got := readRaw(conn, 300*time.Millisecond); got != nil {
+		t.Fatalf("Something came after the error %q", got)
+	}
+	time.Sleep(time.Duration(p.Error.RetryAfter) * time.Millisecond)
+	rawAsk(t, conn, &second, ackOf(second.Id))
+	if e := waitEvent(t, bob, client.BROADCAST_E, 2*time.Second); e.Message != "second" {
+		t.Errorf("Got %q", e.Message)
+	}
+}
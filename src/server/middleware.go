@@ -0,0 +1,106 @@
+package server
+
+import (
+	"log"
+	"message"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Recover keeps a handler that panics from taking the whole server down
+func Recover(next Handler) Handler {
+	return func(s *Server, r *Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				log.Println("[Server] Handler for", r.Kind, "panicked:", err)
+				log.Println("[Server]", string(debug.Stack()))
+				s.Error(r, message.ERR_UNKNOWN, "Something went wrong with your message")
+			}
+		}()
+		next(s, r)
+	}
+}
+
+// Logging writes down every request and how long it took
+func Logging(next Handler) Handler {
+	return func(s *Server, r *Request) {
+		start := time.Now()
+		next(s, r)
+		log.Println("[Server] Handled", r.Kind, r.Header.Id, "from", r.Sender, "in", time.Since(start))
+	}
+}
+
+// RequireLogin rejects messages from someone who didn't login, except for
+// the kinds given
+func RequireLogin(except ...string) Middleware {
+	open := make(map[string]bool, len(except))
+	for _, kind := range except {
+		open[kind] = true
+	}
+	return func(next Handler) Handler {
+		return func(s *Server, r *Request) {
+			if r.User == nil && !open[r.Kind] {
+				s.Error(r, message.ERR_NOT_LOGGED_IN, "Your user wasn't found. Please login first")
+				return
+			}
+			next(s, r)
+		}
+	}
+}
+
+// RequireCapability rejects messages that need a capability the sender
+// didn't ask for at login. caps goes from kind to capability
+func RequireCapability(caps map[string]string) Middleware {
+	return func(next Handler) Handler {
+		return func(s *Server, r *Request) {
+			c, ok := caps[r.Kind]
+			if ok && (r.User == nil || !r.User.can(c)) {
+				s.Error(r, message.ERR_UNSUPPORTED, "That message needs "+c+", which wasn't agreed at login")
+				return
+			}
+			next(s, r)
+		}
+	}
+}
+
+// Metrics counts the requests of each kind and the time spent on them.
+// It can be read from any goroutine
+type Metrics struct {
+	mutex sync.Mutex
+	count map[string]uint64
+	time  map[string]time.Duration
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		count: make(map[string]uint64),
+		time:  make(map[string]time.Duration),
+	}
+}
+
+func (m *Metrics) Middleware(next Handler) Handler {
+	return func(s *Server, r *Request) {
+		start := time.Now()
+		next(s, r)
+		took := time.Since(start)
+		m.mutex.Lock()
+		m.count[r.Kind]++
+		m.time[r.Kind] += took
+		m.mutex.Unlock()
+	}
+}
+
+// Count is how many requests of kind were handled
+func (m *Metrics) Count(kind string) uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.count[kind]
+}
+
+// Time is how long the requests of kind took, all together
+func (m *Metrics) Time(kind string) time.Duration {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.time[kind]
+}
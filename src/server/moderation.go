@@ -0,0 +1,418 @@
+package server
+
+import (
+	"log"
+	"message"
+	"net"
+	"path"
+	"strings"
+	"time"
+)
+
+// ****** Moderation  ****** //
+
+// Each member of a channel has a role. Whoever makes a channel owns it,
+// operators can kick, ban, mute, invite and change its modes, and voiced
+// users can still talk when it's moderated. Nobody can do any of that to
+// someone with his role or a higher one. Roles go away when the member
+// parts, bans, invites and mutes stay with the channel.
+//
+// Who can do what is checked by Moderate before the handlers, the
+// handlers only do it
+const MUTE_FOR = 10 * time.Minute // If whoever mutes doesn't say
+
+type Role int
+
+const (
+	ROLE_MEMBER Role = iota
+	ROLE_VOICED
+	ROLE_OPERATOR
+	ROLE_OWNER
+)
+
+var roleNames = map[Role]string{
+	ROLE_MEMBER:   "member",
+	ROLE_VOICED:   "voiced",
+	ROLE_OPERATOR: "operator",
+	ROLE_OWNER:    "owner",
+}
+
+func (r Role) String() string {
+	return roleNames[r]
+}
+
+// The role each mode gives
+var roleModes = map[string]Role{
+	message.MODE_OPERATOR: ROLE_OPERATOR,
+	message.MODE_VOICE:    ROLE_VOICED,
+}
+
+// role of a member, the ones not in Roles are plain members
+func (ch *Channel) role(alias string) Role {
+	return ch.Roles[alias]
+}
+
+func (ch *Channel) setRole(alias string, r Role) {
+	if r == ROLE_MEMBER {
+		delete(ch.Roles, alias)
+		return
+	}
+	ch.Roles[alias] = r
+}
+
+// muted says for how long the user can't talk, mutes that are over are
+// forgotten
+func (ch *Channel) muted(alias string, now time.Time) (time.Duration, bool) {
+	until, ok := ch.Muted[alias]
+	if !ok {
+		return 0, false
+	}
+	if !now.Before(until) {
+		delete(ch.Muted, alias)
+		return 0, false
+	}
+	return until.Sub(now), true
+}
+
+func (ch *Channel) banned(usr *User) bool {
+	for _, mask := range ch.Bans {
+		if matchesMask(mask, usr) {
+			return true
+		}
+	}
+	return false
+}
+
+// modes are the ones set, like "+im". Empty if there aren't
+func (ch *Channel) modes() string {
+	modes := ""
+	if ch.InviteOnly {
+		modes += message.MODE_INVITE_ONLY
+	}
+	if ch.Moderated {
+		modes += message.MODE_MODERATED
+	}
+	if modes == "" {
+		return ""
+	}
+	return "+" + modes
+}
+
+// splitMask takes a mask apart, what isn't there matches anything
+func splitMask(mask string) (string, string) {
+	nick, addr := mask, "*"
+	if i := strings.LastIndex(mask, "@"); i >= 0 {
+		nick, addr = mask[:i], mask[i+1:]
+	}
+	if nick == "" {
+		nick = "*"
+	}
+	return nick, addr
+}
+
+// validMask tells if mask can be matched, see message.Ban
+func validMask(mask string) bool {
+	if mask == "" {
+		return false
+	}
+	nick, addr := splitMask(mask)
+	if _, err := path.Match(nick, ""); err != nil {
+		return false
+	}
+	if strings.Contains(addr, "/") {
+		_, _, err := net.ParseCIDR(addr)
+		return err == nil
+	}
+	_, err := path.Match(addr, "")
+	return err == nil
+}
+
+// matchesMask tells if mask is the user, by his nickname and the address
+// he was last seen at
+func matchesMask(mask string, usr *User) bool {
+	nick, addr := splitMask(mask)
+	if ok, _ := path.Match(nick, usr.Alias); !ok {
+		return false
+	}
+	if addr == "*" {
+		return true
+	}
+	if usr.Address == nil {
+		return false
+	}
+	if strings.Contains(addr, "/") {
+		_, n, err := net.ParseCIDR(addr)
+		return err == nil && n.Contains(usr.Address.IP)
+	}
+	ok, _ := path.Match(addr, usr.Address.IP.String())
+	return ok
+}
+
+// Moderate enforces the rules of the channels before the handlers see a
+// request, whoever breaks them is told why
+func Moderate(next Handler) Handler {
+	return func(s *Server, r *Request) {
+		if r.User != nil && r.Content != nil && !s.moderate(r) {
+			return
+		}
+		next(s, r)
+	}
+}
+
+// moderate tells if the request can go on. Requests for a channel that
+// isn't there or he isn't in go on too, the handler tells him that
+func (s *Server) moderate(r *Request) bool {
+	c := r.Content
+	switch r.Type {
+	case message.BROAD_T:
+		return s.canTalk(r, c.UMessage.Channel)
+	case message.TOPIC_T:
+		// Anyone can ask for it
+		return c.Topic.Topic == "" || s.canTalk(r, c.Topic.Channel)
+	case message.JOIN_T:
+		return s.canJoin(r, c.Join.Channel)
+	case message.KICK_T:
+		return s.canModerate(r, c.Kick.Channel, c.Kick.Nickname)
+	case message.MUTE_T:
+		return s.canModerate(r, c.Mute.Channel, c.Mute.Nickname)
+	case message.BAN_T:
+		return s.canModerate(r, c.Ban.Channel, "")
+	case message.INVITE_T:
+		return s.canModerate(r, c.Invite.Channel, "")
+	case message.MODE_T:
+		return c.Mode.Mode == "" || s.canModerate(r, c.Mode.Channel, c.Mode.Nickname)
+	}
+	return true
+}
+
+// channelName is the channel a request is for, the default one if it
+// doesn't say
+func (s *Server) channelName(name string) string {
+	if name == "" {
+		return s.config.DefaultChannel
+	}
+	return name
+}
+
+func (s *Server) canTalk(r *Request, name string) bool {
+	ch, ok := r.User.Channels[s.channelName(name)]
+	if !ok {
+		return true
+	}
+	alias := r.User.Alias
+	if left, muted := ch.muted(alias, r.Timestamp); muted {
+		// Rounded up, less than a second is still a second
+		left = (left + time.Second - 1).Truncate(time.Second)
+		s.Error(r, message.ERR_MUTED, "You are muted in "+ch.Name+" for another "+left.String())
+		return false
+	}
+	if ch.Moderated && ch.role(alias) < ROLE_VOICED {
+		s.Error(r, message.ERR_MUTED, ch.Name+" is moderated, only voiced users can talk")
+		return false
+	}
+	return true
+}
+
+func (s *Server) canJoin(r *Request, name string) bool {
+	ch, ok := s.channels[name]
+	if !ok || ch.Members[r.User.Alias] != nil {
+		return true
+	}
+	if ch.banned(r.User) {
+		s.Error(r, message.ERR_BANNED, "You are banned from "+ch.Name)
+		return false
+	}
+	if ch.InviteOnly && !ch.Invited[r.User.Alias] {
+		s.Error(r, message.ERR_INVITE_ONLY, ch.Name+" is invite only, ask an operator")
+		return false
+	}
+	return true
+}
+
+// canModerate tells if the user is an operator of the channel, and of a
+// higher role than target if there's one. An operator can always do it to
+// himself, whatever his role
+func (s *Server) canModerate(r *Request, name string, target string) bool {
+	ch, ok := r.User.Channels[s.channelName(name)]
+	if !ok {
+		return true
+	}
+	me := ch.role(r.User.Alias)
+	if me < ROLE_OPERATOR {
+		s.Error(r, message.ERR_NOT_OPERATOR, "You need to be an operator of "+ch.Name)
+		return false
+	}
+	if _, in := ch.Members[target]; in && target != r.User.Alias && ch.role(target) >= me {
+		s.Error(r, message.ERR_NOT_OPERATOR, target+" is "+ch.role(target).String()+" of "+ch.Name+", you can't")
+		return false
+	}
+	return true
+}
+
+// tellChannel sends msg to every member that is online
+func (s *Server) tellChannel(ch *Channel, msg interface{}) {
+	for _, usr := range ch.Members {
+		if usr.Online {
+			s.sendMessageToUser(usr, msg)
+		}
+	}
+}
+
+// kick takes usr out of the channel, everyone in it is told first so he
+// knows too
+func (s *Server) kick(ch *Channel, usr *User, by string, reason string) {
+	log.Println("[Server]", by, "kicked", usr.Alias, "from", ch.Name)
+	k := message.NewKick(ch.Name, usr.Alias, reason, by)
+	s.tellChannel(ch, &k)
+	s.part(usr, ch)
+}
+
+func (s *Server) kickHandler(m *Request) {
+	req := m.Content.Kick
+	ch := s.memberOf(m, req.Channel)
+	if ch == nil {
+		return
+	}
+	usr, ok := ch.Members[req.Nickname]
+	if !ok {
+		s.Error(m, message.ERR_UNKNOWN_RECIPIENT, req.Nickname+" isn't in "+ch.Name)
+		return
+	}
+	s.kick(ch, usr, m.User.Alias, req.Reason)
+}
+
+// banHandler adds or lifts a ban. Whoever it matches is kicked, unless his
+// role is as high as the one of who banned
+func (s *Server) banHandler(m *Request) {
+	req := m.Content.Ban
+	ch := s.memberOf(m, req.Channel)
+	if ch == nil {
+		return
+	}
+	if !validMask(req.Mask) {
+		s.Error(m, message.ERR_MALFORMED, "Masks go like nickname, nickname@address or @10.0.0.0/8")
+		return
+	}
+	i := 0
+	for i < len(ch.Bans) && ch.Bans[i] != req.Mask {
+		i++
+	}
+	found := i < len(ch.Bans)
+	if found == !req.Remove {
+		// Nothing changes
+		return
+	}
+	alias := m.User.Alias
+	if req.Remove {
+		ch.Bans = append(ch.Bans[:i], ch.Bans[i+1:]...)
+	} else {
+		ch.Bans = append(ch.Bans, req.Mask)
+	}
+	log.Println("[Server]", alias, "banned", req.Mask, "from", ch.Name, "remove", req.Remove)
+	b := message.NewBan(ch.Name, req.Mask, req.Remove, alias)
+	s.tellChannel(ch, &b)
+	if req.Remove {
+		return
+	}
+	me := ch.role(alias)
+	for _, usr := range ch.Members {
+		if usr != m.User && ch.role(usr.Alias) < me && matchesMask(req.Mask, usr) {
+			s.kick(ch, usr, alias, "Banned")
+		}
+	}
+}
+
+func (s *Server) muteHandler(m *Request) {
+	req := m.Content.Mute
+	ch := s.memberOf(m, req.Channel)
+	if ch == nil {
+		return
+	}
+	if _, ok := ch.Members[req.Nickname]; !ok {
+		s.Error(m, message.ERR_UNKNOWN_RECIPIENT, req.Nickname+" isn't in "+ch.Name)
+		return
+	}
+	d := req.For
+	if req.Remove {
+		d = 0
+		delete(ch.Muted, req.Nickname)
+	} else {
+		if d <= 0 {
+			d = MUTE_FOR
+		}
+		ch.Muted[req.Nickname] = time.Now().Add(d)
+	}
+	log.Println("[Server]", m.User.Alias, "muted", req.Nickname, "in", ch.Name, "for", d)
+	mu := message.NewMute(ch.Name, req.Nickname, d, req.Remove, m.User.Alias)
+	s.tellChannel(ch, &mu)
+}
+
+// inviteHandler lets someone join once, he gets the invite when he is
+// online
+func (s *Server) inviteHandler(m *Request) {
+	req := m.Content.Invite
+	ch := s.memberOf(m, req.Channel)
+	if ch == nil {
+		return
+	}
+	usr, ok := s.users[req.Nickname]
+	if !ok {
+		s.Error(m, message.ERR_UNKNOWN_RECIPIENT, "The user "+req.Nickname+" doesn't exist!")
+		return
+	}
+	if _, in := ch.Members[usr.Alias]; in {
+		return
+	}
+	ch.Invited[usr.Alias] = true
+	log.Println("[Server]", m.User.Alias, "invited", usr.Alias, "to", ch.Name)
+	inv := message.NewInvite(ch.Name, usr.Alias, m.User.Alias)
+	s.sendMessageToUser(usr, &inv)
+}
+
+// modeHandler sets a mode or a role, or says which ones are set
+func (s *Server) modeHandler(m *Request) {
+	req := m.Content.Mode
+	ch := s.memberOf(m, req.Channel)
+	if ch == nil {
+		return
+	}
+	if req.Mode == "" {
+		mo := message.NewMode(ch.Name, ch.modes(), "", "")
+		mo.Bans = append([]string{}, ch.Bans...)
+		s.Reply(m, &mo)
+		return
+	}
+	if len(req.Mode) != 2 || (req.Mode[0] != '+' && req.Mode[0] != '-') {
+		s.Error(m, message.ERR_MALFORMED, "Modes go like +i, -m, +o or -v")
+		return
+	}
+	on, mode := req.Mode[0] == '+', req.Mode[1:]
+	nickname := ""
+	switch mode {
+	case message.MODE_INVITE_ONLY:
+		ch.InviteOnly = on
+	case message.MODE_MODERATED:
+		ch.Moderated = on
+	case message.MODE_OPERATOR, message.MODE_VOICE:
+		nickname = req.Nickname
+		if _, ok := ch.Members[nickname]; !ok {
+			s.Error(m, message.ERR_UNKNOWN_RECIPIENT, nickname+" isn't in "+ch.Name)
+			return
+		}
+		role, current := roleModes[mode], ch.role(nickname)
+		if on && current >= role || !on && current != role {
+			// He already has it, or more. Or he doesn't have it
+			return
+		}
+		if !on {
+			role = ROLE_MEMBER
+		}
+		ch.setRole(nickname, role)
+	default:
+		s.Error(m, message.ERR_MALFORMED, "There's no mode "+mode)
+		return
+	}
+	log.Println("[Server]", m.User.Alias, "set", req.Mode, nickname, "in", ch.Name)
+	mo := message.NewMode(ch.Name, req.Mode, nickname, m.User.Alias)
+	s.tellChannel(ch, &mo)
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"client"
+	"message"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMasks(t *testing.T) {
+	usr := newUser("mallory")
+	usr.Address = &net.UDPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 9}
+	for _, c := range []struct {
+		mask    string
+		valid   bool
+		matches bool
+	}{
+		{"mallory", true, true},
+		{"mal*", true, true},
+		{"alice", true, false},
+		{"mallory@10.1.2.3", true, true},
+		{"mallory@10.1.2.4", true, false},
+		{"@10.0.0.0/8", true, true},
+		{"*@192.168.0.0/16", true, false},
+		{"@10.1.*", true, true},
+		{"@10.0.0.0/99", false, false},
+		{"[", false, false},
+		{"", false, false},
+	} {
+		if v := validMask(c.mask); v != c.valid {
+			t.Errorf("%q valid is %v", c.mask, v)
+		}
+		if !c.valid {
+			continue
+		}
+		if m := matchesMask(c.mask, usr); m != c.matches {
+			t.Errorf("%q matches is %v", c.mask, m)
+		}
+	}
+}
+
+// sayIn waits for a moderation event of c about channel
+func sayIn(t *testing.T, c *client.Client, et client.EventType, channel string) client.Event {
+	t.Helper()
+	e := waitEvent(t, c, et, 2*time.Second)
+	if e.Channel != channel {
+		t.Fatalf("Got %v in %q, want %q", et, e.Channel, channel)
+	}
+	return e
+}
+
+func TestModeration(t *testing.T) {
+	s := startServer(t, Config{})
+	alice := loginAs(t, s, "alice", client.Config{})
+	bob := loginAs(t, s, "bob", client.Config{})
+	carol := loginAs(t, s, "carol", client.Config{})
+	// She made it, she owns it
+	for _, c := range []*client.Client{alice, bob, carol} {
+		c.Join("#ops")
+		waitEvent(t, c, client.TOPIC_E, 2*time.Second)
+	}
+
+	bob.Kick("#ops", "carol", "")
+	waitError(t, bob, message.ERR_NOT_OPERATOR)
+	alice.Mode("#ops", "+o", "bob")
+	e := sayIn(t, bob, client.MODE_E, "#ops")
+	if e.Mode.Mode != "+o" || e.Mode.Nickname != "bob" || e.From != "alice" {
+		t.Errorf("Got mode %+v", e.Mode)
+	}
+	// Nothing against someone of his role or higher
+	bob.Kick("#ops", "alice", "")
+	waitError(t, bob, message.ERR_NOT_OPERATOR)
+
+	bob.Mute("#ops", "carol", time.Minute)
+	sayIn(t, carol, client.MUTE_E, "#ops")
+	carol.BroadcastTo("#ops", "let me talk")
+	waitError(t, carol, message.ERR_MUTED)
+	bob.Unmute("#ops", "carol")
+	sayIn(t, carol, client.MUTE_E, "#ops")
+
+	// Moderated, only voiced users and up talk
+	alice.Mode("#ops", "+m", "")
+	sayIn(t, carol, client.MODE_E, "#ops")
+	carol.BroadcastTo("#ops", "still?")
+	waitError(t, carol, message.ERR_MUTED)
+	alice.Mode("#ops", "+v", "carol")
+	sayIn(t, carol, client.MODE_E, "#ops")
+	carol.BroadcastTo("#ops", "thanks")
+	if e := sayIn(t, alice, client.BROADCAST_E, "#ops"); e.Message != "thanks" {
+		t.Errorf("Got %q", e.Message)
+	}
+
+	bob.Kick("#ops", "carol", "bye")
+	e = sayIn(t, carol, client.KICK_E, "#ops")
+	if e.Kick.Nickname != "carol" || e.Kick.Reason != "bye" {
+		t.Errorf("Got kick %+v", e.Kick)
+	}
+	carol.BroadcastTo("#ops", "I'm out?")
+	waitError(t, carol, message.ERR_NOT_IN_CHANNEL)
+
+	bob.Ban("#ops", "carol@127.0.0.1")
+	sayIn(t, bob, client.BAN_E, "#ops")
+	carol.Join("#ops")
+	waitError(t, carol, message.ERR_BANNED)
+	bob.Unban("#ops", "carol@127.0.0.1")
+	sayIn(t, bob, client.BAN_E, "#ops")
+
+	alice.Mode("#ops", "+i", "")
+	sayIn(t, alice, client.MODE_E, "#ops")
+	carol.Join("#ops")
+	waitError(t, carol, message.ERR_INVITE_ONLY)
+	alice.Invite("#ops", "carol")
+	sayIn(t, carol, client.INVITE_E, "#ops")
+	carol.Join("#ops")
+	sayIn(t, carol, client.TOPIC_E, "#ops")
+
+	alice.Mode("#ops", "", "")
+	e = sayIn(t, alice, client.MODE_E, "#ops")
+	if e.Mode.Mode != "+im" || e.From != "" {
+		t.Errorf("Modes are %+v", e.Mode)
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"message"
+	"time"
+)
+
+// Messages for someone offline wait in his queue. Only MaxPending fit, and
+// those older than PendingTTL expire. A message leaves the queue when he
+// acks it, and if whoever sent it asked for receipts he is told it was
+// delivered or it expired
+const (
+	MAX_PENDING  = 1000
+	PENDING_TTL  = 7 * 24 * time.Hour
+	PENDING_TICK = time.Minute
+)
+
+var errQueueFull = errors.New("The queue of that user is full")
+
+// delivered takes the message the user acked out of his queue
+func (s *Server) delivered(usr *User, id string) {
+	for i, p := range usr.Pending {
+		if p.Id != id {
+			continue
+		}
+		usr.Pending = append(usr.Pending[:i], usr.Pending[i+1:]...)
+		s.forgetPending(usr, p)
+		s.receipt(usr, p, message.RECEIPT_DELIVERED)
+		return
+	}
+}
+
+// expirePending drops the messages of the user that waited too long
+func (s *Server) expirePending(usr *User, now time.Time) {
+	kept := usr.Pending[:0]
+	for _, p := range usr.Pending {
+		if now.Sub(p.Saved) < s.config.PendingTTL {
+			kept = append(kept, p)
+			continue
+		}
+		log.Println("[Server] Message", p.Id, "for", usr.Alias, "expired")
+		s.forgetPending(usr, p)
+		s.receipt(usr, p, message.RECEIPT_EXPIRED)
+	}
+	// Don't keep the dropped ones alive at the end of the array
+	for i := len(kept); i < len(usr.Pending); i++ {
+		usr.Pending[i] = nil
+	}
+	usr.Pending = kept
+}
+
+// expireAll looks for old messages in every queue but the ones being
+// delivered, those go when they are acked
+func (s *Server) expireAll(now time.Time) {
+	for _, usr := range s.users {
+		if !usr.Online {
+			s.expirePending(usr, now)
+		}
+	}
+}
+
+// requeue puts back in the queue a message the user never acked. Those
+// that came from it never left
+func (s *Server) requeue(usr *User, u *unackedMessage) {
+	if u.Queued {
+		return
+	}
+	s.saveMessageForLater(usr, u.Msg, u.Origin)
+}
+
+// dropPending empties the queue of a user that starts over, for whoever
+// sent them it's as if they expired
+func (s *Server) dropPending(usr *User) {
+	for _, p := range usr.Pending {
+		s.receipt(usr, p, message.RECEIPT_EXPIRED)
+	}
+	usr.Pending = nil
+}
+
+func (s *Server) forgetPending(usr *User, p *pendingMessage) {
+	err := s.store.RemovePending(usr.Alias, p.Id)
+	if err != nil {
+		log.Println("[Server] Couldn't remove a stored message for", usr.Alias, err)
+	}
+}
+
+// receipt tells whoever sent a message that waited for usr what happened
+// to it, if he wants to know
+func (s *Server) receipt(usr *User, p *pendingMessage, status string) {
+	if p.Origin == nil || !p.Origin.Receipt {
+		return
+	}
+	from, ok := s.users[p.Origin.From]
+	if !ok || !from.can(message.CAP_RECEIPT) {
+		return
+	}
+	r := message.NewReceipt(p.Origin.Ref, usr.Alias, status)
+	s.sendMessageToUser(from, &r)
+}
+
+// tellOrigin sends an error about his message to whoever sent it
+func (s *Server) tellOrigin(o *origin, code message.ErrorCode, text string) {
+	if o == nil {
+		return
+	}
+	from, ok := s.users[o.From]
+	if !ok {
+		return
+	}
+	e := message.NewErrorMessage(code, o.Ref, text)
+	s.sendMessageToUser(from, &e)
+}
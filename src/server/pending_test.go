@@ -0,0 +1,134 @@
+package server
+
+import (
+	"client"
+	"message"
+	"testing"
+	"time"
+)
+
+// quit logs c out, and waits until the server knows
+func quit(t *testing.T, c *client.Client) {
+	t.Helper()
+	c.Quit()
+	// Sent after the exit was acked, so it comes from nobody
+	c.Broadcast("still here?")
+	waitError(t, c, message.ERR_NOT_LOGGED_IN)
+}
+
+// sent waits until the server is done with what c sent before, they go
+// one at a time
+func sent(t *testing.T, c *client.Client) {
+	t.Helper()
+	c.ListUsers()
+	waitEvent(t, c, client.USERS_E, 2*time.Second)
+}
+
+// registered is a client logged in as nick with an account, so what
+// waits for him isn't taken for another guest's
+func registered(t *testing.T, s *Server, nick string) *client.Client {
+	t.Helper()
+	c := dialServer(t, s, client.Config{})
+	c.Register(nick, "secret1")
+	waitEvent(t, c, client.LOGIN_E, 5*time.Second)
+	return c
+}
+
+// back logs nick in again with his password
+func back(t *testing.T, s *Server, nick string) *client.Client {
+	t.Helper()
+	c := dialServer(t, s, client.Config{})
+	c.LoginWithPassword(nick, "secret1")
+	waitEvent(t, c, client.LOGIN_E, 5*time.Second)
+	return c
+}
+
+// What waits for someone offline is limited, goes when he comes back and
+// acks it, and whoever sent it is told
+func TestPendingDelivered(t *testing.T) {
+	s := startServer(t, Config{MaxPending: 2})
+	alice := loginAs(t, s, "alice", client.Config{})
+	quit(t, registered(t, s, "bob"))
+
+	alice.DirectMessage("bob", "one")
+	alice.DirectMessage("bob", "two")
+	alice.DirectMessage("bob", "three")
+	waitError(t, alice, message.ERR_QUEUE_FULL)
+
+	bob := back(t, s, "bob")
+	for _, want := range []string{"one", "two"} {
+		e := waitEvent(t, bob, client.DM_E, 2*time.Second)
+		if e.From != "alice" || e.Message != want {
+			t.Errorf("Got %q from %q, want %q", e.Message, e.From, want)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		e := waitEvent(t, alice, client.RECEIPT_E, 2*time.Second)
+		if e.Receipt.To != "bob" || e.Receipt.Status != message.RECEIPT_DELIVERED {
+			t.Errorf("Got receipt %+v", e.Receipt)
+		}
+	}
+
+	// Acked, so they don't come again
+	quit(t, bob)
+	bob = back(t, s, "bob")
+	bob.DirectMessage("alice", "anything for me?")
+	waitEvent(t, alice, client.DM_E, 2*time.Second)
+	select {
+	case e := <-bob.Events():
+		if e.Type == client.DM_E {
+			t.Errorf("Got %q again", e.Message)
+		}
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestPendingExpired(t *testing.T) {
+	s := startServer(t, Config{PendingTTL: 100 * time.Millisecond})
+	alice := loginAs(t, s, "alice", client.Config{})
+	quit(t, registered(t, s, "bob"))
+
+	alice.DirectMessage("bob", "too late")
+	sent(t, alice)
+	time.Sleep(200 * time.Millisecond)
+	// It expires before it's sent
+	bob := back(t, s, "bob")
+	e := waitEvent(t, alice, client.RECEIPT_E, 2*time.Second)
+	if e.Receipt.To != "bob" || e.Receipt.Status != message.RECEIPT_EXPIRED {
+		t.Errorf("Got receipt %+v", e.Receipt)
+	}
+	bob.DirectMessage("alice", "anything for me?")
+	waitEvent(t, alice, client.DM_E, 2*time.Second)
+	select {
+	case e := <-bob.Events():
+		if e.Type == client.DM_E {
+			t.Errorf("Got %q after it expired", e.Message)
+		}
+	default:
+	}
+}
+
+// Another guest with the same nickname isn't who it was for, so for
+// whoever sent it it's as if it expired
+func TestPendingGuestStartsOver(t *testing.T) {
+	s := startServer(t, Config{})
+	alice := loginAs(t, s, "alice", client.Config{})
+	quit(t, loginAs(t, s, "bob", client.Config{}))
+
+	alice.DirectMessage("bob", "for the first bob")
+	sent(t, alice)
+	bob := loginAs(t, s, "bob", client.Config{})
+	e := waitEvent(t, alice, client.RECEIPT_E, 2*time.Second)
+	if e.Receipt.To != "bob" || e.Receipt.Status != message.RECEIPT_EXPIRED {
+		t.Errorf("Got receipt %+v", e.Receipt)
+	}
+	bob.DirectMessage("alice", "anything for me?")
+	waitEvent(t, alice, client.DM_E, 2*time.Second)
+	select {
+	case e := <-bob.Events():
+		if e.Type == client.DM_E {
+			t.Errorf("The new bob got %q", e.Message)
+		}
+	default:
+	}
+}
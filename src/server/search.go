@@ -0,0 +1,296 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"message"
+	"sort"
+	"store"
+	"strings"
+	"unicode"
+)
+
+// Search goes through an inverted index of the history, every word points
+// to the messages that have it. It's built from the store at the first
+// Start and kept with the history from then on, forgetting the same
+// messages the store forgets. Encrypted messages can't be read, so they
+// can't be found either
+const (
+	SEARCH_PAGE     = 20  // Results in a page if the client doesn't say
+	MAX_SEARCH_PAGE = 100 // And the most he can ask for at once
+)
+
+type indexedMessage struct {
+	Seq          uint64
+	Conversation string
+	Entry        message.HistoryEntry
+	Words        []string // All of them, in order, for the phrases
+}
+
+// searchIndex belongs to the event loop like the users, no need to lock
+type searchIndex struct {
+	next     uint64
+	messages map[uint64]*indexedMessage
+	ids      map[string]uint64   // Message id to seq, for paging
+	postings map[string][]uint64 // Word to the seqs that have it, oldest first
+	// Seqs of each conversation oldest first, to forget them with the store
+	conversations map[string][]uint64
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		next:          1,
+		messages:      make(map[uint64]*indexedMessage),
+		ids:           make(map[string]uint64),
+		postings:      make(map[string][]uint64),
+		conversations: make(map[string][]uint64),
+	}
+}
+
+// words splits text in lower case words, anything that isn't a letter or
+// a number is a separator
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func (x *searchIndex) add(conversation string, h message.HistoryEntry) {
+	im := &indexedMessage{Seq: x.next, Conversation: conversation, Entry: h}
+	x.next++
+	// Encrypted ones only take their place, so we forget the same ones
+	// the store does
+	if !h.Encrypted {
+		im.Words = words(h.Message)
+		x.messages[im.Seq] = im
+		x.ids[h.Id] = im.Seq
+	}
+	for _, w := range im.Words {
+		p := x.postings[w]
+		if len(p) > 0 && p[len(p)-1] == im.Seq {
+			// Said twice in the same message
+			continue
+		}
+		x.postings[w] = append(p, im.Seq)
+	}
+	seqs := append(x.conversations[conversation], im.Seq)
+	if len(seqs) > store.MAX_HISTORY {
+		x.remove(seqs[0])
+		seqs = seqs[1:]
+	}
+	x.conversations[conversation] = seqs
+}
+
+func (x *searchIndex) remove(seq uint64) {
+	im, ok := x.messages[seq]
+	if !ok {
+		return
+	}
+	delete(x.messages, seq)
+	delete(x.ids, im.Entry.Id)
+	for _, w := range im.Words {
+		p := x.postings[w]
+		i := sort.Search(len(p), func(i int) bool { return p[i] >= seq })
+		if i == len(p) || p[i] != seq {
+			continue
+		}
+		p = append(p[:i], p[i+1:]...)
+		if len(p) == 0 {
+			delete(x.postings, w)
+		} else {
+			x.postings[w] = p
+		}
+	}
+}
+
+// query is a Search taken apart
+type query struct {
+	Words   []string   // Every one has to be there
+	Phrases [][]string // And these, one word after the other
+}
+
+// parseQuery takes the "quoted phrases" out of text, their words count
+// as words too
+func parseQuery(text string) query {
+	var q query
+	parts := strings.Split(text, "\"")
+	for i, part := range parts {
+		ws := words(part)
+		q.Words = append(q.Words, ws...)
+		// Odd parts were between quotes, an unclosed one goes to the end
+		if i%2 == 1 && len(ws) > 1 {
+			q.Phrases = append(q.Phrases, ws)
+		}
+	}
+	return q
+}
+
+// candidates are the seqs that have every word, newest first. Without
+// words it's every message
+func (x *searchIndex) candidates(q query) []uint64 {
+	var seqs []uint64
+	if len(q.Words) == 0 {
+		seqs = make([]uint64, 0, len(x.messages))
+		for seq := range x.messages {
+			seqs = append(seqs, seq)
+		}
+		sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	} else {
+		// From the rarest word, the list only gets shorter
+		lists := make([][]uint64, 0, len(q.Words))
+		for _, w := range q.Words {
+			lists = append(lists, x.postings[w])
+		}
+		sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+		seqs = append([]uint64{}, lists[0]...)
+		for _, l := range lists[1:] {
+			seqs = intersect(seqs, l)
+		}
+	}
+	for i, j := 0, len(seqs)-1; i < j; i, j = i+1, j-1 {
+		seqs[i], seqs[j] = seqs[j], seqs[i]
+	}
+	return seqs
+}
+
+// intersect keeps what's in both sorted lists, in a
+func intersect(a []uint64, b []uint64) []uint64 {
+	out := a[:0]
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+// hasPhrase tells if the words of phrase come one after the other
+func hasPhrase(ws []string, phrase []string) bool {
+	for i := 0; i+len(phrase) <= len(ws); i++ {
+		match := true
+		for j := range phrase {
+			if ws[i+j] != phrase[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// buildIndex indexes everything the store has in its history
+func (s *Server) buildIndex() error {
+	conversations, err := s.store.Conversations()
+	if err != nil {
+		return err
+	}
+	for _, conversation := range conversations {
+		stored, err := s.store.History(conversation)
+		if err != nil {
+			return err
+		}
+		for _, e := range stored {
+			var h message.HistoryEntry
+			if json.Unmarshal(e.Data, &h) != nil {
+				continue
+			}
+			s.index.add(conversation, h)
+		}
+	}
+	log.Println("[Server] Indexed", len(s.index.messages), "messages")
+	return nil
+}
+
+// searchHandler finds the messages the user can see that match, leaving
+// out the ones from users he blocked
+func (s *Server) searchHandler(m *Request) {
+	req := m.Content.Search
+	usr := m.User
+	limit := req.Limit
+	if limit <= 0 {
+		limit = SEARCH_PAGE
+	}
+	if limit > MAX_SEARCH_PAGE {
+		limit = MAX_SEARCH_PAGE
+	}
+	var before uint64
+	if req.Before != "" {
+		seq, ok := s.index.ids[req.Before]
+		if !ok {
+			// It's forgotten, and so is everything older
+			res := message.NewSearchResponse(req.Query, nil, false)
+			s.Reply(m, &res)
+			return
+		}
+		before = seq
+	}
+	q := parseQuery(req.Query)
+	results := make([]message.HistoryEntry, 0, limit)
+	more := false
+	for _, seq := range s.index.candidates(q) {
+		if before != 0 && seq >= before {
+			continue
+		}
+		im := s.index.messages[seq]
+		if !s.canSee(usr, im) || !matches(im, q, req) {
+			continue
+		}
+		if len(results) == limit {
+			more = true
+			break
+		}
+		results = append(results, im.Entry)
+	}
+	log.Println("[Server] Search of", usr.Alias, "found", len(results))
+	res := message.NewSearchResponse(req.Query, results, more)
+	s.Reply(m, &res)
+}
+
+// canSee tells if the message is a broadcast of a channel he is in or one
+// of his, and not from someone he blocked
+func (s *Server) canSee(usr *User, im *indexedMessage) bool {
+	if isBlocked(usr, im.Entry.From) {
+		return false
+	}
+	if im.Entry.Kind == message.BROAD {
+		_, ok := usr.Channels[im.Conversation]
+		return ok
+	}
+	if im.Entry.From != usr.Alias && im.Entry.To != usr.Alias {
+		return false
+	}
+	// Or it was for whoever had the nickname before him
+	return !im.Entry.Time.Before(usr.Joined)
+}
+
+// matches checks the filters and phrases of the search on a message that
+// has all the words
+func matches(im *indexedMessage, q query, req *message.Search) bool {
+	h := im.Entry
+	if req.From != "" && h.From != req.From {
+		return false
+	}
+	if !req.Since.IsZero() && h.Time.Before(req.Since) {
+		return false
+	}
+	if !req.Until.IsZero() && !h.Time.Before(req.Until) {
+		return false
+	}
+	for _, phrase := range q.Phrases {
+		if !hasPhrase(im.Words, phrase) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"message"
+	"reflect"
+	"store"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseQuery(t *testing.T) {
+	q := parseQuery(`Lunch, "at NOON" today`)
+	want := query{Words: []string{"lunch", "at", "noon", "today"}, Phrases: [][]string{{"at", "noon"}}}
+	if !reflect.DeepEqual(q, want) {
+		t.Errorf("Got %+v, want %+v", q, want)
+	}
+	// A quoted word is only a word
+	if q := parseQuery(`"lunch"`); q.Phrases != nil {
+		t.Errorf("One word is a phrase %v", q.Phrases)
+	}
+	// Nobody closes the quotes, it goes to the end
+	q = parseQuery(`see "you at noon`)
+	if !reflect.DeepEqual(q.Phrases, [][]string{{"you", "at", "noon"}}) {
+		t.Errorf("Unclosed phrase is %v", q.Phrases)
+	}
+	if q := parseQuery(`  "" !!! `); q.Words != nil || q.Phrases != nil {
+		t.Errorf("Nothing to look for gave %+v", q)
+	}
+}
+
+// find is what searchHandler finds, without looking at who asks
+func find(x *searchIndex, req message.Search) []string {
+	q := parseQuery(req.Query)
+	var ids []string
+	for _, seq := range x.candidates(q) {
+		if im := x.messages[seq]; matches(im, q, &req) {
+			ids = append(ids, im.Entry.Id)
+		}
+	}
+	return ids
+}
+
+func TestSearchIndex(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	x := newSearchIndex()
+	entries := []message.HistoryEntry{
+		{From: "alice", Message: "Good morning everybody"},
+		{From: "bob", Message: "morning alice, good to see you"},
+		{From: "alice", Message: "the secret plan is good", Encrypted: true},
+		{From: "carol", Message: "GOOD MORNING!!! good good"},
+		{From: "bob", Message: "nothing to see here"},
+	}
+	for i, h := range entries {
+		h.Id, h.Kind, h.Time = strconv.Itoa(i+1), message.BROAD, start.Add(time.Duration(i)*time.Hour)
+		x.add("#general", h)
+	}
+
+	// Newest first, and carol said it three times but she's there once
+	if got := find(x, message.Search{Query: "good"}); !reflect.DeepEqual(got, []string{"4", "2", "1"}) {
+		t.Errorf("good found %v", got)
+	}
+	if p := x.postings["good"]; len(p) != 3 {
+		t.Errorf("good is kept %d times", len(p))
+	}
+	// The words can be anywhere, the phrase has to be as it is
+	if got := find(x, message.Search{Query: "morning good"}); !reflect.DeepEqual(got, []string{"4", "2", "1"}) {
+		t.Errorf("morning good found %v", got)
+	}
+	if got := find(x, message.Search{Query: `"good morning"`}); !reflect.DeepEqual(got, []string{"4", "1"}) {
+		t.Errorf(`"good morning" found %v`, got)
+	}
+	// Nobody can read the encrypted ones, the server neither
+	if got := find(x, message.Search{Query: "secret"}); got != nil {
+		t.Errorf("secret found %v", got)
+	}
+	if got := find(x, message.Search{}); !reflect.DeepEqual(got, []string{"5", "4", "2", "1"}) {
+		t.Errorf("Everything is %v", got)
+	}
+
+	if got := find(x, message.Search{Query: "good", From: "alice"}); !reflect.DeepEqual(got, []string{"1"}) {
+		t.Errorf("good from alice found %v", got)
+	}
+	// Since is included and until isn't
+	since := message.Search{Query: "good", Since: start.Add(time.Hour), Until: start.Add(3 * time.Hour)}
+	if got := find(x, since); !reflect.DeepEqual(got, []string{"2"}) {
+		t.Errorf("good between 13 and 15 found %v", got)
+	}
+}
+
+// The index forgets the same messages the store does, encrypted ones too
+func TestSearchIndexForgets(t *testing.T) {
+	x := newSearchIndex()
+	x.add("#general", message.HistoryEntry{Id: "secret", Kind: message.BROAD, Message: "word", Encrypted: true})
+	x.add("#general", message.HistoryEntry{Id: "first", Kind: message.BROAD, Message: "word first"})
+	for i := 0; i < store.MAX_HISTORY-2; i++ {
+		x.add("#general", message.HistoryEntry{Id: strconv.Itoa(i), Kind: message.BROAD, Message: "word"})
+	}
+	x.add("alice\x00bob", message.HistoryEntry{Id: "dm", Kind: message.DM, Message: "word first"})
+
+	// Nothing was forgotten yet, the encrypted one is the oldest
+	if got := find(x, message.Search{Query: "first"}); !reflect.DeepEqual(got, []string{"dm", "first"}) {
+		t.Fatalf("first found %v", got)
+	}
+	x.add("#general", message.HistoryEntry{Id: "one more", Kind: message.BROAD, Message: "word"})
+	if got := find(x, message.Search{Query: "first"}); !reflect.DeepEqual(got, []string{"dm", "first"}) {
+		t.Errorf("After forgetting the encrypted one first found %v", got)
+	}
+	x.add("#general", message.HistoryEntry{Id: "and another", Kind: message.BROAD, Message: "word"})
+	if got := find(x, message.Search{Query: "first"}); !reflect.DeepEqual(got, []string{"dm"}) {
+		t.Errorf("first found %v after it was forgotten", got)
+	}
+	if _, ok := x.ids["first"]; ok {
+		t.Error("Paging can still start at a forgotten message")
+	}
+	if n := len(x.postings["word"]); n != store.MAX_HISTORY+1 {
+		t.Errorf("word is kept for %d messages", n)
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"log"
+	"net"
+	"secure"
+	"time"
+)
+
+// A secure session the server has with a client. It's found by its id when
+// something comes in and by the address of the client when we send, that
+// is the last address it was used from. Anyone can send a HELLO from any
+// address, so the session is only a handshake until a DATA opens with it
+type secureSession struct {
+	*secure.Session
+	Address  string
+	LastUsed time.Time
+	Hello    string // Where the HELLO came from
+	Started  time.Time
+}
+
+func newIdentity() *secure.Identity {
+	id, err := secure.NewIdentity()
+	if err != nil {
+		// Without randomness the key could be guessed
+		panic("Can't make a server identity: " + err.Error())
+	}
+	return id
+}
+
+// openSecure deals with a datagram of the secure package. A HELLO gets its
+// WELCOME and DATA is opened in place. It tells if there's a message left
+// for the handlers
+func (s *Server) openSecure(m *Message) bool {
+	switch secure.Kind(m.Content) {
+	case secure.HELLO:
+		sess, welcome, err := secure.Accept(m.Content, s.config.Identity)
+		if err != nil {
+			log.Println("[Server] Bad secure handshake from", m.Sender, err)
+			return false
+		}
+		s.makeRoom(m.Sender.String(), m.Timestamp)
+		log.Println("[Server] Secure handshake", sess.Id(), "with", m.Sender)
+		s.handshakes[sess.Id()] = &secureSession{Session: sess, Hello: m.Sender.String(), Started: m.Timestamp}
+		// Goes as it is, he doesn't have the keys yet
+		s.sendDatagram(m.Sender, welcome)
+		return false
+
+	case secure.DATA:
+		id, _ := secure.KeyId(m.Content)
+		ss, ok := s.secureIds[id]
+		if !ok {
+			ss, ok = s.handshakes[id]
+		}
+		if !ok {
+			log.Println("[Server] Unknown secure session", id, "from", m.Sender)
+			return false
+		}
+		plain, err := ss.Open(m.Content)
+		if err != nil {
+			log.Println("[Server] Dropping datagram from", m.Sender, err)
+			return false
+		}
+		if _, shaking := s.handshakes[id]; shaking {
+			// Only who has the keys could have sealed it, now it's a session
+			log.Println("[Server] Secure session", id, "with", m.Sender)
+			delete(s.handshakes, id)
+			s.secureIds[id] = ss
+		}
+		s.useSecure(ss, m.Sender, m.Timestamp)
+		m.Content = plain
+		return true
+	}
+	log.Println("[Server] Unexpected secure datagram from", m.Sender)
+	return false
+}
+
+// makeRoom makes room for one more handshake from who. Old ones are
+// forgotten first, then if who has too many his oldest goes. When there
+// are too many in all the oldest of anyone goes, a HELLO can come from
+// any address so keeping the old ones would let a few spoofed ones keep
+// everybody out. A client whose handshake goes sends his HELLO again
+func (s *Server) makeRoom(who string, now time.Time) {
+	s.forgetHandshakes(now)
+	var oldest, oldestFrom *secureSession
+	from := 0
+	for _, ss := range s.handshakes {
+		if oldest == nil || ss.Started.Before(oldest.Started) {
+			oldest = ss
+		}
+		if ss.Hello != who {
+			continue
+		}
+		from++
+		if oldestFrom == nil || ss.Started.Before(oldestFrom.Started) {
+			oldestFrom = ss
+		}
+	}
+	if from >= HANDSHAKES_PER_ADDR {
+		delete(s.handshakes, oldestFrom.Id())
+		return
+	}
+	if len(s.handshakes) >= SECURE_HANDSHAKES {
+		log.Println("[Server] Too many secure handshakes, forgetting the one from", oldest.Hello)
+		delete(s.handshakes, oldest.Id())
+	}
+}
+
+// forgetHandshakes drops the handshakes that never got to DATA in time
+func (s *Server) forgetHandshakes(now time.Time) {
+	for id, ss := range s.handshakes {
+		if now.Sub(ss.Started) >= HANDSHAKE_TIMEOUT {
+			delete(s.handshakes, id)
+		}
+	}
+}
+
+// useSecure makes ss the session for whatever we send to who
+func (s *Server) useSecure(ss *secureSession, who *net.UDPAddr, now time.Time) {
+	if ss.Address != who.String() {
+		if s.secureAddrs[ss.Address] == ss {
+			delete(s.secureAddrs, ss.Address)
+		}
+		ss.Address = who.String()
+		s.secureAddrs[ss.Address] = ss
+	}
+	ss.LastUsed = now
+}
+
+// isSecure tells if who talks to us through a secure session, if he does
+// nothing in plain text from him can be trusted
+func (s *Server) isSecure(who *net.UDPAddr) bool {
+	_, ok := s.secureAddrs[who.String()]
+	return ok
+}
+
+// seal encrypts msg if who has a secure session
+func (s *Server) seal(who *net.UDPAddr, msg []byte) []byte {
+	ss, ok := s.secureAddrs[who.String()]
+	if !ok {
+		return msg
+	}
+	return ss.Seal(msg)
+}
+
+// forgetIdleSecure drops the sessions nobody used for a while, a client
+// that comes back does the handshake again
+func (s *Server) forgetIdleSecure(now time.Time) {
+	s.forgetHandshakes(now)
+	for id, ss := range s.secureIds {
+		if now.Sub(ss.LastUsed) < SECURE_IDLE {
+			continue
+		}
+		log.Println("[Server] Forgetting idle secure session", id)
+		delete(s.secureIds, id)
+		if s.secureAddrs[ss.Address] == ss {
+			delete(s.secureAddrs, ss.Address)
+		}
+	}
+}
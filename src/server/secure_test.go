@@ -0,0 +1,304 @@
+package server
+
+import (
+	"bytes"
+	"client"
+	"context"
+	"message"
+	"net"
+	"secure"
+	"testing"
+	"time"
+)
+
+// startServer runs a server on a loopback port until the test ends
+func startServer(t *testing.T, config Config) *Server {
+	t.Helper()
+	config.Addr = "127.0.0.1:0"
+	s := New(config)
+	err := s.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Stop() })
+	return s
+}
+
+// dialServer is a client of s that is closed when the test ends
+func dialServer(t *testing.T, s *Server, config client.Config) *client.Client {
+	t.Helper()
+	config.ServerAddr = s.Addr().String()
+	c := client.New(config)
+	err := c.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// waitEvent waits for the first event of type et, failing after timeout
+func waitEvent(t *testing.T, c *client.Client, et client.EventType, timeout time.Duration) client.Event {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case e := <-c.Events():
+			if e.Type == et {
+				return e
+			}
+		case <-deadline:
+			t.Fatalf("No event %v after %v", et, timeout)
+		}
+	}
+}
+
+// rawConn talks to s without a client in between
+func rawConn(t *testing.T, s *Server) *net.UDPConn {
+	t.Helper()
+	conn, err := net.DialUDP("udp", nil, s.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readRaw gives the next datagram, nil if nothing came in time
+func readRaw(conn *net.UDPConn, timeout time.Duration) []byte {
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil
+	}
+	return buf[:n]
+}
+
+// shake does the handshake on conn by hand
+func shake(t *testing.T, conn *net.UDPConn) *secure.Session {
+	t.Helper()
+	kx, err := secure.NewKeyExchange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(kx.Hello())
+	welcome := readRaw(conn, time.Second)
+	if welcome == nil {
+		return nil
+	}
+	sess, _, err := kx.Finish(welcome)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sess
+}
+
+func marshalLogin(t *testing.T, nick string) []byte {
+	t.Helper()
+	login := message.NewLogin(nick)
+	b, err := message.XML.Marshal(&login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSecureLoopback(t *testing.T) {
+	s := startServer(t, Config{})
+	alice := dialServer(t, s, client.Config{Secure: true})
+	bob := dialServer(t, s, client.Config{Secure: true})
+	alice.Login("alice")
+	waitEvent(t, alice, client.LOGIN_E, 2*time.Second)
+	bob.Login("bob")
+	waitEvent(t, bob, client.LOGIN_E, 2*time.Second)
+
+	alice.DirectMessage("bob", "nobody else reads this")
+	e := waitEvent(t, bob, client.DM_E, 2*time.Second)
+	if e.From != "alice" || e.Message != "nobody else reads this" {
+		t.Errorf("Got %q from %q", e.Message, e.From)
+	}
+}
+
+// A HELLO can come from anyone, the address isn't taken as secure until
+// something sealed comes from it
+func TestSecureHelloDoesntBind(t *testing.T) {
+	s := startServer(t, Config{})
+	conn := rawConn(t, s)
+	if shake(t, conn) == nil {
+		t.Fatal("No welcome")
+	}
+	conn.Write(marshalLogin(t, "plain"))
+	got := readRaw(conn, time.Second)
+	if got == nil || secure.IsSecure(got) {
+		t.Fatalf("Plain login after a hello got %q", got)
+	}
+}
+
+func TestSecureHandshakeLimits(t *testing.T) {
+	s := startServer(t, Config{})
+
+	// Too many from one address, the oldest is forgotten
+	conn := rawConn(t, s)
+	var sessions []*secure.Session
+	for i := 0; i < HANDSHAKES_PER_ADDR+1; i++ {
+		sess := shake(t, conn)
+		if sess == nil {
+			t.Fatal("No welcome for handshake", i)
+		}
+		sessions = append(sessions, sess)
+	}
+	login := marshalLogin(t, "sealed")
+	conn.Write(sessions[0].Seal(login))
+	if got := readRaw(conn, 300*time.Millisecond); got != nil {
+		t.Errorf("The oldest handshake still works, got %q", got)
+	}
+	conn.Write(sessions[len(sessions)-1].Seal(login))
+	got := readRaw(conn, time.Second)
+	if got == nil {
+		t.Fatal("The newest handshake doesn't work")
+	}
+	if _, err := sessions[len(sessions)-1].Open(got); err != nil {
+		t.Error("The answer isn't sealed for us", err)
+	}
+
+	// Past the total the oldest of anyone goes, whoever comes after a
+	// flood of HELLOs still gets in
+	s = startServer(t, Config{})
+	first := rawConn(t, s)
+	firstSess := shake(t, first)
+	for shaken := 1; shaken < SECURE_HANDSHAKES; {
+		conn := rawConn(t, s)
+		for j := 0; j < HANDSHAKES_PER_ADDR && shaken < SECURE_HANDSHAKES; j++ {
+			if shake(t, conn) == nil {
+				t.Fatal("No welcome for handshake", shaken)
+			}
+			shaken++
+		}
+	}
+	last := rawConn(t, s)
+	lastSess := shake(t, last)
+	if lastSess == nil {
+		t.Fatal("No welcome after the flood")
+	}
+	last.Write(lastSess.Seal(marshalLogin(t, "late")))
+	if got := readRaw(last, time.Second); got == nil {
+		t.Error("The handshake after the flood doesn't work")
+	}
+	first.Write(firstSess.Seal(marshalLogin(t, "early")))
+	if got := readRaw(first, 300*time.Millisecond); got != nil {
+		t.Errorf("The oldest handshake of all still works, got %q", got)
+	}
+}
+
+// The client only takes a WELCOME signed by the key it knows for the
+// server, and signed for its own HELLO
+func TestSecureServerKey(t *testing.T) {
+	id, err := secure.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := secure.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := startServer(t, Config{Identity: id})
+	dialServer(t, s, client.Config{Secure: true, ServerKey: id.SigningKey()})
+
+	dial := func(config client.Config) error {
+		config.ServerAddr = s.Addr().String()
+		c := client.New(config)
+		defer c.Close()
+		return c.Dial()
+	}
+	if err := dial(client.Config{Secure: true, ServerKey: other.SigningKey()}); err != client.ErrServerKey {
+		t.Errorf("Dialing with the wrong key gave %v", err)
+	}
+	// The first key seen is the one, later ones have to match it
+	pins := secure.NewPins()
+	if err := dial(client.Config{Secure: true, ServerPins: pins}); err != nil {
+		t.Fatal("Dialing for the first time gave", err)
+	}
+	if err := dial(client.Config{Secure: true, ServerPins: pins}); err != nil {
+		t.Error("Dialing again gave", err)
+	}
+	pins.Forget(s.Addr().String())
+	pins.Check(s.Addr().String(), other.SigningKey())
+	if err := dial(client.Config{Secure: true, ServerPins: pins}); err != client.ErrServerKey {
+		t.Errorf("Dialing with another key pinned gave %v", err)
+	}
+
+	conn := rawConn(t, s)
+	kx, err := secure.NewKeyExchange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(kx.Hello())
+	welcome := readRaw(conn, time.Second)
+	// Someone in the middle puts his own key in it
+	tampered := append([]byte{}, welcome...)
+	tampered[20] ^= 1
+	if _, _, err := kx.Finish(tampered); err != secure.ErrAuth {
+		t.Errorf("A tampered welcome gave %v", err)
+	}
+	// Or answers another HELLO with it
+	another, err := secure.NewKeyExchange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := another.Finish(welcome); err != secure.ErrAuth {
+		t.Errorf("A welcome for someone else gave %v", err)
+	}
+	if _, key, err := kx.Finish(welcome); err != nil || !bytes.Equal(key, id.SigningKey()) {
+		t.Errorf("The welcome gave %v signed by %x", err, key)
+	}
+}
+
+// Without a key on the other side a direct message goes signed in plain
+// text, unless the sender wants it encrypted or not at all
+func TestEncryptionFallback(t *testing.T) {
+	s := startServer(t, Config{})
+	newIdentity := func() *secure.Identity {
+		id, err := secure.NewIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	alice := loginAs(t, s, "alice", client.Config{Identity: newIdentity()})
+	strict := loginAs(t, s, "strict", client.Config{Identity: newIdentity(), Encryption: client.ENCRYPT_ALWAYS})
+	plain := loginAs(t, s, "plain", client.Config{Identity: newIdentity(), Encryption: client.ENCRYPT_NEVER})
+	bob := loginAs(t, s, "bob", client.Config{})
+	carol := loginAs(t, s, "carol", client.Config{Identity: newIdentity()})
+	// Her key goes after the login
+	for i := 0; ; i++ {
+		_, err := alice.PeerKey("carol")
+		if err == nil {
+			break
+		}
+		if i == 10 {
+			t.Fatal("carol has no key", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err := alice.DirectMessage("bob", "hi bob"); err != nil {
+		t.Fatal("Couldn't send to someone without a key", err)
+	}
+	e := waitEvent(t, bob, client.DM_E, 2*time.Second)
+	if e.Encrypted || e.Message != "hi bob" || e.Signature != client.FIRST_SEEN {
+		t.Errorf("bob got %q encrypted %v signature %v", e.Message, e.Encrypted, e.Signature)
+	}
+	if err := strict.DirectMessage("bob", "hi bob"); err != client.ErrNoKey {
+		t.Errorf("Sending only encrypted to someone without a key gave %v", err)
+	}
+
+	alice.DirectMessage("carol", "hi carol")
+	if e := waitEvent(t, carol, client.DM_E, 2*time.Second); !e.Encrypted || e.Message != "hi carol" {
+		t.Errorf("carol got %q encrypted %v", e.Message, e.Encrypted)
+	}
+	plain.DirectMessage("carol", "hi again")
+	if e := waitEvent(t, carol, client.DM_E, 2*time.Second); e.Encrypted || e.Signature != client.FIRST_SEEN {
+		t.Errorf("carol got %q encrypted %v signature %v", e.Message, e.Encrypted, e.Signature)
+	}
+}
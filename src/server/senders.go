@@ -0,0 +1,235 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"message"
+	"net"
+	"store"
+	"time"
+)
+
+// ****** Server senders  ****** //
+func (s *Server) sendBroadcast(ch *Channel, broadcastMessage *message.SMessage) {
+	for _, usr := range ch.Members {
+		if !usr.Online || usr.Alias == broadcastMessage.From {
+			continue
+		}
+		log.Println("sending data", broadcastMessage, "to user", usr.Alias)
+		s.sendMessaeToUserCheckBlocked(usr, broadcastMessage.From, broadcastMessage)
+	}
+}
+
+// sendPendingMessages sends what waited for the user. Each message stays
+// in the queue until he acks it, if he can't it's delivered once it's sent
+func (s *Server) sendPendingMessages(usr *User) {
+	s.expirePending(usr, time.Now())
+	// Delivering takes them out of the queue
+	pending := append([]*pendingMessage{}, usr.Pending...)
+	for _, p := range pending {
+		if !usr.Online {
+			// We lost him on the way
+			return
+		}
+		u, err := s.transmit(usr, p.Msg)
+		if err != nil {
+			continue
+		}
+		if u == nil {
+			s.delivered(usr, p.Id)
+			continue
+		}
+		u.Origin, u.Queued = p.Origin, true
+	}
+}
+
+func (s *Server) sendMessaeToUserCheckBlocked(to *User, sender string, msg interface{}) error {
+	if isBlocked(to, sender) {
+		return nil
+	}
+	return s.sendMessageToUser(to, msg)
+}
+
+func isBlocked(to *User, sender string) bool {
+	// Iterate and check if the user is blocked
+	for _, alias := range to.Blocked {
+		if alias == sender {
+			return true
+		}
+	}
+	return false
+}
+
+// sendMessageToUser takes the message itself and not the xml since
+// each user numbers the messages he gets on his own
+func (s *Server) sendMessageToUser(usr *User, msg interface{}) error {
+	return s.sendFrom(usr, msg, nil)
+}
+
+// sendFrom is sendMessageToUser for something a user sent, he hears about
+// it if it has to wait
+func (s *Server) sendFrom(usr *User, msg interface{}, o *origin) error {
+	// See if the user is connected
+	if usr.Online {
+		// If he is, try to send message
+		u, err := s.transmit(usr, msg)
+		if err != errUnreachable {
+			if u != nil {
+				u.Origin = o
+			}
+			return err
+		}
+	}
+	// If user is not currently connected or sent failed try to save it for later
+	return s.saveMessageForLater(usr, msg, o)
+}
+
+var errUnreachable = errors.New("Couldn't reach the user")
+
+// transmit sends the message to the user right now. What he has to ack is
+// kept until he does, and given back
+func (s *Server) transmit(usr *User, msg interface{}) (*unackedMessage, error) {
+	stamped := stampOrder(usr, msg)
+	mm, err := usr.Codec.Marshal(stamped)
+	if err != nil {
+		log.Println("[Server] Error marshaling message for", usr.Alias, err.Error())
+		return nil, err
+	}
+	rememberOrdered(usr, stamped, mm)
+	err = s.sendMessage(usr.Address, mm)
+	if err != nil {
+		// Assume he went offline, or we would wait for him every time
+		log.Println("[Server] Couldn't reach", usr.Alias, "taking him as offline")
+		s.disconnectUser(usr.Address)
+		return nil, errUnreachable
+	}
+	m, ok := msg.(message.Identified)
+	if !ok || m.MessageId() == "" || !usr.can(message.CAP_ACK) {
+		return nil, nil
+	}
+	// Keep it until he confirms it
+	u := &unackedMessage{
+		Msg:     msg,
+		Bytes:   mm,
+		Order:   orderOf(stamped),
+		NextTry: time.Now().Add(RETRANSMIT_AFTER),
+	}
+	usr.Unacked[m.MessageId()] = u
+	return u, nil
+}
+
+// saveMessageForLater queues the message until the user comes back, if
+// there's room. If there isn't whoever sent it is told
+func (s *Server) saveMessageForLater(usr *User, msg interface{}, o *origin) error {
+	if len(usr.Pending) >= s.config.MaxPending {
+		log.Println("[Server] Queue of", usr.Alias, "is full, dropping a message")
+		s.tellOrigin(o, message.ERR_QUEUE_FULL, usr.Alias+" is offline and can't get more messages")
+		return errQueueFull
+	}
+	p := &pendingMessage{Msg: msg, Saved: time.Now(), Origin: o}
+	if m, ok := msg.(message.Identified); ok {
+		p.Id = m.MessageId()
+	}
+	usr.Pending = append(usr.Pending, p)
+	b, err := encodePending(p)
+	if err == nil {
+		err = s.store.AddPending(usr.Alias, store.Entry{Id: p.Id, Time: p.Saved, Data: b})
+	}
+	if err != nil {
+		// He still gets it, unless the server goes down first
+		log.Println("[Server] Couldn't store a message for", usr.Alias, err)
+		return err
+	}
+	return nil
+}
+
+// stampOrder gives a copy of the message with the next order of the user,
+// if it is a message that has to be shown in order
+func stampOrder(usr *User, msg interface{}) interface{} {
+	if !usr.can(message.CAP_ORDER) {
+		return msg
+	}
+	switch m := msg.(type) {
+	case *message.SMessage:
+		c := *m
+		c.Order = usr.NextOrder
+		usr.NextOrder++
+		return &c
+	case *message.FileMessage:
+		c := *m
+		c.Order = usr.NextOrder
+		usr.NextOrder++
+		return &c
+	}
+	return msg
+}
+
+// rememberOrdered keeps what we sent in case the user asks for it again
+func rememberOrdered(usr *User, msg interface{}, bytes []byte) {
+	order := orderOf(msg)
+	if order == 0 {
+		return
+	}
+	usr.Sent[order%ORDER_HISTORY] = orderedMessage{order, bytes}
+}
+
+// orderOf is the order stamped in a message, 0 if it has none
+func orderOf(msg interface{}) uint64 {
+	switch m := msg.(type) {
+	case *message.SMessage:
+		return m.Order
+	case *message.FileMessage:
+		return m.Order
+	}
+	return 0
+}
+
+// newAck is the confirmation that we got the message with that id
+func newAck(id string, c message.Codec) []byte {
+	ack := message.NewAck(id)
+	m, err := c.Marshal(&ack)
+	if err != nil {
+		log.Println("[Server] Error marshaling ack", err.Error())
+	}
+	return m
+}
+
+// sendMessage tries to send a confirmation to the user who
+// sent the message. If it doesn't get any confirmation it sends an error
+// Messages that don't fit in a datagram go in fragments
+func (s *Server) sendMessage(whom *net.UDPAddr, msg []byte) error {
+	// Sealed right before it goes, a retransmission is a new datagram
+	msg = s.seal(whom, msg)
+	fragments, err := message.Fragment(msg, message.MAX_DATAGRAM)
+	if err != nil {
+		return err
+	}
+	for _, f := range fragments {
+		err := s.sendDatagram(whom, f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var errStopping = errors.New("Server is stopping")
+
+func (s *Server) sendDatagram(whom *net.UDPAddr, msg []byte) error {
+	retriesLeft := MAX_RETRY
+	// Send confirmation
+	for retriesLeft > 0 {
+		_, err := s.conn.WriteTo(msg, whom)
+		if err == nil {
+			return nil
+		}
+		// Don't hold the event loop if we are stopping
+		select {
+		case <-time.After(time.Millisecond * MILIS_BETWEEN_RETRY):
+		case <-s.ctx.Done():
+			return errStopping
+		}
+		retriesLeft--
+	}
+	return errors.New("Couldn't send confirmation")
+}
@@ -0,0 +1,511 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"message"
+	"net"
+	"secure"
+	"store"
+	"sync"
+	"time"
+)
+
+const (
+	MAX_USR                = 50000
+	MAX_CONN               = 5000
+	MILIS_BETWEEN_RETRY    = 200
+	MAX_RETRY              = 3
+	BLOCKED_INITIAL        = 10
+	TIME_BETWEEN_CLOCK     = 10 * time.Second
+	TIME_BETWEEN_ADDRESSES = 10 * time.Second
+	DEDUP_WINDOW           = 256
+	DEDUP_IDLE             = time.Minute
+	DEDUP_TICK             = 10 * time.Second
+	ORDER_HISTORY          = 128
+	MAX_RETRANSMIT         = 5
+	RETRANSMIT_AFTER       = 500 * time.Millisecond
+	RETRANSMIT_TICK        = 100 * time.Millisecond
+	SECURE_IDLE            = 30 * time.Minute
+	SECURE_TICK            = time.Minute
+	SECURE_HANDSHAKES      = 256 // Waiting for their first DATA
+	HANDSHAKES_PER_ADDR    = 4
+	HANDSHAKE_TIMEOUT      = 10 * time.Second
+)
+
+var ErrAlreadyStarted = errors.New("Server already started")
+var ErrNotStarted = errors.New("Server not started")
+
+// Config is what the server needs to start. Anything left empty takes
+// its default
+type Config struct {
+	Addr           string
+	ClockPeriod    time.Duration    // How often clocks get synchronized
+	AddressPeriod  time.Duration    // How often clients get each other's addresses
+	Accounts       string           // File with the registered nicknames, they are only kept in memory without it
+	Limits         *LimitConfig     // How much clients can send, DefaultLimits if nil
+	LegacyLogin    bool             // Let clients login without a cookie, they can use us to flood someone else
+	Store          store.Store      // Where users, blocks and pending messages outlive the server, only memory if nil. It isn't closed by the server
+	MaxPending     int              // Messages that can wait for each offline user
+	PendingTTL     time.Duration    // How long they wait before they expire
+	DefaultChannel string           // Where broadcasts without a channel go, everyone joins it at login
+	Operators      []string         // Operators of the default channel once they login with their password
+	Identity       *secure.Identity // Signs the secure handshakes so clients know it's us, a new one each time if nil
+}
+
+// Server owns its connection, its users and its timers, so there can be
+// more than one in the same program.
+//
+// Everything about the users belongs to the event loop in handleIncoming.
+// Messages, timers and retransmissions are all handled there one at a time,
+// so nothing else may touch the maps below. The mutex is only for starting
+// and stopping
+type Server struct {
+	config Config
+
+	// Guards ctx, conn and cancel. The server runs while ctx isn't done.
+	// The event loop reads them without it, they don't change while it runs
+	mutex  sync.Mutex
+	ctx    context.Context
+	conn   *net.UDPConn
+	cancel context.CancelFunc
+	done   sync.WaitGroup
+
+	// Owned by the event loop
+	// Map of aliases
+	users map[string]*User
+	// Map of addresses
+	connections map[string]*User
+	// Map of session tokens
+	sessions map[string]*User
+	// Registered nicknames, loaded at the first Start
+	accounts *accounts
+	// What the users had in the last run comes from here, and what they
+	// have goes there
+	store store.Store
+	// Words of the history, to search it
+	index *searchIndex
+	// Channels by name, the default one is always there
+	channels map[string]*Channel
+	// Key for the login cookies
+	cookieSecret []byte
+	// Passwords for the hash workers and what they made of them, new
+	// each Start. Wrong passwords by nickname
+	hashJobs     chan hashJob
+	hashResults  chan hashResult
+	authFailures map[string]*authFailures
+	// Nicknames whose account is being made, with the logins waiting for it
+	registering map[string][]*Request
+	// Secure sessions by id and by the address they were last used from.
+	// Until the first DATA opens they are only handshakes
+	secureIds   map[uint64]*secureSession
+	secureAddrs map[string]*secureSession
+	handshakes  map[uint64]*secureSession
+
+	areWeGettingClocks bool
+	userClocks         []clockMessage
+
+	// Messages already processed, by sender. If an ack gets lost the client
+	// resends and we only answer with the ack again
+	seenMessages map[string]*dedupWindow
+
+	// What to do with each kind of message. routes are the handlers with
+	// the middleware around them, built at Start
+	handlers   map[string]Handler
+	middleware []Middleware
+	routes     map[string]Handler
+}
+
+// Each incoming connection will have a message with whatever they want to send
+// and who sent it
+type Message struct {
+	Content   []byte
+	Sender    *net.UDPAddr
+	Timestamp time.Time
+}
+
+func New(config Config) *Server {
+	if config.ClockPeriod == 0 {
+		config.ClockPeriod = TIME_BETWEEN_CLOCK
+	}
+	if config.AddressPeriod == 0 {
+		config.AddressPeriod = TIME_BETWEEN_ADDRESSES
+	}
+	if config.MaxPending == 0 {
+		config.MaxPending = MAX_PENDING
+	}
+	if config.PendingTTL == 0 {
+		config.PendingTTL = PENDING_TTL
+	}
+	if config.Store == nil {
+		config.Store = store.NewMemory()
+	}
+	if config.DefaultChannel == "" {
+		config.DefaultChannel = DEFAULT_CHANNEL
+	}
+	if config.Identity == nil {
+		config.Identity = newIdentity()
+	}
+	s := &Server{
+		config:       config,
+		users:        make(map[string]*User, MAX_USR),
+		connections:  make(map[string]*User, MAX_CONN),
+		sessions:     make(map[string]*User, MAX_CONN),
+		store:        config.Store,
+		index:        newSearchIndex(),
+		channels:     make(map[string]*Channel),
+		cookieSecret: newCookieSecret(),
+		authFailures: make(map[string]*authFailures),
+		secureIds:    make(map[uint64]*secureSession, MAX_CONN),
+		secureAddrs:  make(map[string]*secureSession, MAX_CONN),
+		handshakes:   make(map[uint64]*secureSession, SECURE_HANDSHAKES),
+		seenMessages: make(map[string]*dedupWindow, MAX_CONN),
+		userClocks:   make([]clockMessage, 0, 1),
+		handlers:     make(map[string]Handler),
+	}
+	s.channels[config.DefaultChannel] = newChannel(config.DefaultChannel)
+	s.registerHandlers()
+	return s
+}
+
+// Start binds the address and serves until Stop is called or ctx is done.
+// Users are kept between a Stop and the next Start
+func (s *Server) Start(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.running() {
+		return ErrAlreadyStarted
+	}
+	// If the last run ended because of its context it may still be
+	// finishing
+	s.done.Wait()
+	log.Println("[Server] Starting server")
+	log.Println("[Server] Handshakes are signed with the key", secure.Fingerprint(s.config.Identity.SigningKey()))
+	if s.accounts == nil {
+		accounts, err := loadAccounts(s.config.Accounts)
+		if err != nil {
+			log.Println("[Server] Couldn't load the accounts from", s.config.Accounts, err)
+			return err
+		}
+		err = s.loadUsers()
+		if err != nil {
+			log.Println("[Server] Couldn't load the users", err)
+			return err
+		}
+		err = s.buildIndex()
+		if err != nil {
+			log.Println("[Server] Couldn't index the history", err)
+			return err
+		}
+		s.accounts = accounts
+	}
+	udpAddress, err := net.ResolveUDPAddr("udp4", s.config.Addr)
+	if err != nil {
+		log.Println("[Server] error resolving UDP address on ", s.config.Addr, err)
+		return err
+	}
+	conn, err := net.ListenUDP("udp", udpAddress)
+	if err != nil {
+		log.Println("[Server] error listening on UDP port ", s.config.Addr, err)
+		return err
+	}
+	s.buildRoutes()
+	ctx, cancel := context.WithCancel(ctx)
+	s.ctx = ctx
+	s.conn = conn
+	s.cancel = cancel
+	jobs, results := make(chan hashJob, HASH_QUEUE), make(chan hashResult)
+	s.hashJobs, s.hashResults = jobs, results
+	// Whatever the workers of the last run had went with them
+	s.registering = make(map[string][]*Request)
+	for _, f := range s.authFailures {
+		f.Checking = 0
+	}
+
+	s.done.Add(HASH_WORKERS)
+	for i := 0; i < HASH_WORKERS; i++ {
+		go func() {
+			defer s.done.Done()
+			hashWorker(ctx, jobs, results)
+		}()
+	}
+
+	s.done.Add(2)
+	go func() {
+		defer s.done.Done()
+		s.handleIncoming(ctx)
+	}()
+	go func() {
+		defer s.done.Done()
+		// Closing the connection is what stops the reader
+		<-ctx.Done()
+		conn.Close()
+		log.Println("[Server] Stopped")
+	}()
+	log.Println("[Server] Listening on ", conn.LocalAddr())
+	return nil
+}
+
+// Stop closes the connection and waits until everything the server
+// started is done
+func (s *Server) Stop() error {
+	s.mutex.Lock()
+	if !s.running() {
+		s.mutex.Unlock()
+		return ErrNotStarted
+	}
+	cancel := s.cancel
+	s.mutex.Unlock()
+	cancel()
+	s.done.Wait()
+	return nil
+}
+
+// Addr is the address the server is listening on, nil if it isn't
+func (s *Server) Addr() net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.running() {
+		return nil
+	}
+	return s.conn.LocalAddr()
+}
+
+// running must be called with the mutex held
+func (s *Server) running() bool {
+	return s.ctx != nil && s.ctx.Err() == nil
+}
+
+// ****** Incoming interface  ****** //
+
+// listen handles any incomming connections and writes them to the channel
+// It doesn't deal with confirmation nor validation
+func (s *Server) listenServer(ctx context.Context, conn *net.UDPConn) <-chan Message {
+	c := make(chan Message)
+	s.done.Add(1)
+	go func() {
+		defer s.done.Done()
+		buff := make([]byte, message.MAX_DATAGRAM)
+		fragments := message.NewReassembler(message.FRAGMENT_TIMEOUT)
+
+		for {
+			n, addr, err := conn.ReadFromUDP(buff)
+			if n > 0 && addr != nil {
+				// Copy the response
+				res := make([]byte, n)
+
+				// Trim newline
+				if string(buff[n-1]) == "\n" && !message.IsBinary(buff[:n]) && !secure.IsSecure(buff[:n]) {
+					copy(res, buff[:n-1])
+					res = res[:n-1]
+				} else {
+					copy(res, buff[:n])
+				}
+
+				// Wait for the rest if it's a piece of something bigger
+				now := time.Now()
+				if whole, ok := fragments.Add(addr.String(), res, now); ok {
+					// Create the message
+					m := Message{Content: whole,
+						Sender:    addr,
+						Timestamp: now}
+					// Send to the channel, unless nobody is reading anymore
+					select {
+					case c <- m:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			if err != nil {
+				// If it fails send a nil message
+				select {
+				case c <- Message{nil, nil, time.Now()}:
+				case <-ctx.Done():
+				}
+				break
+			}
+		}
+	}()
+	return c
+}
+
+// handleIncoming is the event loop. It gets incoming messages and the
+// ticks of every timer, and deals with them one at a time
+func (s *Server) handleIncoming(ctx context.Context) {
+	read := s.listenServer(ctx, s.conn)
+	retransmitTick := time.NewTicker(RETRANSMIT_TICK)
+	defer retransmitTick.Stop()
+	clockTick := time.NewTicker(s.config.ClockPeriod)
+	defer clockTick.Stop()
+	addressTick := time.NewTicker(s.config.AddressPeriod)
+	defer addressTick.Stop()
+	secureTick := time.NewTicker(SECURE_TICK)
+	defer secureTick.Stop()
+	pendingTick := time.NewTicker(PENDING_TICK)
+	defer pendingTick.Stop()
+	dedupTick := time.NewTicker(DEDUP_TICK)
+	defer dedupTick.Stop()
+	// Fires when we stop waiting for clocks, nil while we aren't
+	var clocksDone <-chan time.Time
+	for {
+		select {
+		case m := <-read:
+			s.handleMessage(m)
+		case r := <-s.hashResults:
+			s.hashed(r)
+		case now := <-retransmitTick.C:
+			s.retransmit(now)
+		case <-clockTick.C:
+			s.sendTimeRequest()
+			clocksDone = time.After(s.config.ClockPeriod / 2)
+		case <-clocksDone:
+			clocksDone = nil
+			s.adjustClocks()
+		case <-addressTick.C:
+			s.sendAddresses()
+		case now := <-secureTick.C:
+			s.forgetIdleSecure(now)
+		case now := <-pendingTick.C:
+			s.expireAll(now)
+		case now := <-dedupTick.C:
+			s.forgetIdleWindows(now)
+			s.forgetFailures(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleMessage dispatchs the message to its handler and then sends a
+// confirmation, unless it was refused
+func (s *Server) handleMessage(m Message) {
+	if m.Content == nil {
+		return
+	}
+	if secure.IsSecure(m.Content) {
+		if !s.openSecure(&m) {
+			return
+		}
+	} else if s.isSecure(m.Sender) {
+		log.Println("[Server] Dropping plain message from secure client", m.Sender)
+		return
+	}
+	// Convert to internal message
+	codec := message.DetectCodec(m.Content)
+	kind, _ := codec.Kind(m.Content)
+	if message.HasPassword(kind) {
+		log.Println("[Server] Content of a", kind, "isn't shown")
+	} else {
+		log.Println("[Server] Content", message.Redact(m.Content))
+	}
+	log.Println("[Server] From address", *m.Sender)
+	log.Println("[Server] In time", m.Timestamp)
+	t, p, err := message.DecodeUserMessage(m.Content)
+	var header message.Base
+	if p != nil {
+		header = p.Header
+	} else if s.isCustom(kind) {
+		// Someone else knows what to do with it
+		header, err = message.DecodeHeader(m.Content)
+	}
+	var usr *User
+	if err == nil {
+		usr = s.session(m.Sender, header.Token)
+	}
+	if t == message.ACK_T {
+		// Acks aren't acked, and they don't move anybody since they
+		// can't be challenged
+		s.ackHandler(usr, p.Ack)
+		return
+	}
+	if usr != nil && s.moved(usr, m.Sender) {
+		// He may come from a new address, but until it proves itself
+		// it gets nothing but the challenge
+		if !s.proved(header, m) {
+			s.challenge(header, m)
+			return
+		}
+		s.migrate(usr, m.Sender)
+	}
+	if err == nil && s.needsCookie(t, p, m) {
+		// Not even acked, he sends it again with the cookie
+		return
+	}
+	if err == nil && header.Id == "" {
+		// Version 1 client, all he understands is OK
+		s.sendMessage(m.Sender, []byte("OK"))
+	}
+	if err != nil {
+		log.Println("[Server] Error reading XML. Please check it")
+		log.Println("[Server] Got", message.Redact(m.Content))
+		log.Println("[Server] Error from server, got", err.Error())
+		s.sendError(m.Sender, message.ERR_MALFORMED, "", "Error reading XML. Please check it")
+		return
+	}
+	key := s.dedupKey(m.Sender)
+	if header.Id != "" {
+		ack, dup := s.isDuplicate(key, header.Instance(), header.Seq)
+		if dup {
+			log.Println("[Server] Already processed", header.Id, "from", key)
+			if ack == nil {
+				ack = newAck(header.Id, codec)
+			}
+			s.sendAck(m.Sender, header.Id, ack)
+			return
+		}
+	}
+	r := &Request{
+		Kind:      kind,
+		Type:      t,
+		Content:   p,
+		Header:    header,
+		Raw:       m.Content,
+		Codec:     codec,
+		Sender:    m.Sender,
+		Timestamp: m.Timestamp,
+		User:      usr,
+	}
+	s.dispatch(r)
+	if header.Id == "" || r.rejected {
+		// What was refused isn't acked, the error is the answer. If he
+		// sends it again it's looked at again
+		return
+	}
+	// Answer in whatever he wrote to us
+	ack := newAck(header.Id, codec)
+	s.sendAck(m.Sender, header.Id, ack)
+	s.recordMessage(key, header.Instance(), header.Seq, ack, m.Timestamp)
+}
+
+func (s *Server) sendAck(who *net.UDPAddr, id string, ack []byte) {
+	err := s.sendMessage(who, ack)
+	if err != nil {
+		// Assume he went offline
+		log.Println("[Server] Couldn't ack message ", id, "to ", who)
+		s.disconnectUser(who)
+	}
+}
+
+// retransmit sends again whatever users haven't confirmed, waiting twice as
+// long each time. When we run out of tries it stays for when he logs in again
+func (s *Server) retransmit(now time.Time) {
+	for _, usr := range s.connections {
+		for id, u := range usr.Unacked {
+			if now.Before(u.NextTry) {
+				continue
+			}
+			if u.Attempts >= MAX_RETRANSMIT {
+				log.Println("[Server] Giving up on", id, "for", usr.Alias)
+				delete(usr.Unacked, id)
+				s.requeue(usr, u)
+				continue
+			}
+			log.Println("[Server] Retransmitting", id, "to", usr.Alias)
+			s.sendMessage(usr.Address, u.Bytes)
+			u.Attempts++
+			u.NextTry = now.Add(RETRANSMIT_AFTER << uint(u.Attempts))
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"client"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Every client broadcasts while the others do the same and the clock and
+// address timers go off, run it with -race
+func TestConcurrentBroadcasts(t *testing.T) {
+	const clients = 8
+	const each = 5
+	s := startServer(t, Config{
+		Limits:        &LimitConfig{}, // They all share an address
+		ClockPeriod:   100 * time.Millisecond,
+		AddressPeriod: 100 * time.Millisecond,
+	})
+
+	var loggedIn, done sync.WaitGroup
+	loggedIn.Add(clients)
+	done.Add(clients)
+	missing := make([][]string, clients)
+	for i := 0; i < clients; i++ {
+		c := dialServer(t, s, client.Config{Codecs: []string{"xml", "json", "binary"}[i%3 : i%3+1]})
+		go func(i int, c *client.Client) {
+			defer done.Done()
+			nick := fmt.Sprint("user", i)
+			c.Login(nick)
+			waitLogin(c)
+			loggedIn.Done()
+			loggedIn.Wait()
+			for j := 0; j < each; j++ {
+				c.Broadcast(fmt.Sprint(nick, " says ", j))
+			}
+			// Everybody else's, never ours
+			want := make(map[string]bool)
+			for k := 0; k < clients; k++ {
+				for j := 0; j < each && k != i; j++ {
+					want[fmt.Sprint("user", k, " says ", j)] = true
+				}
+			}
+			deadline := time.After(10 * time.Second)
+			for len(want) > 0 {
+				select {
+				case e := <-c.Events():
+					if e.Type == client.BROADCAST_E {
+						delete(want, e.Message)
+					}
+				case <-deadline:
+					for m := range want {
+						missing[i] = append(missing[i], m)
+					}
+					return
+				}
+			}
+		}(i, c)
+	}
+	done.Wait()
+	for i, m := range missing {
+		if len(m) > 0 {
+			t.Errorf("user%d didn't get %d broadcasts: %v", i, len(m), m)
+		}
+	}
+}
+
+// waitLogin is waitEvent for goroutines that can't fail the test
+func waitLogin(c *client.Client) {
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-c.Events():
+			if e.Type == client.LOGIN_E {
+				return
+			}
+		case <-deadline:
+			return
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"message"
+	"store"
+)
+
+// ****** Storage  ****** //
+
+// Everything about a user that has to outlive the server goes through
+// s.store as well as in the User. The store is only read at the first
+// Start, after that the users in memory are the ones that count
+
+// loadUsers brings back the users the store kept, all of them offline
+// until they login again
+func (s *Server) loadUsers() error {
+	records, err := s.store.Users()
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		usr := newUser(r.Alias)
+		usr.Blocked = append(usr.Blocked, r.Blocked...)
+		for _, e := range r.Pending {
+			p, err := decodePending(e)
+			if err != nil {
+				log.Println("[Server] Dropping a stored message for", r.Alias, err)
+				continue
+			}
+			usr.Pending = append(usr.Pending, p)
+		}
+		s.users[usr.Alias] = usr
+	}
+	log.Println("[Server] Loaded", len(records), "users")
+	return nil
+}
+
+// newUser is an offline user with nothing yet
+func newUser(alias string) *User {
+	return &User{
+		Alias:     alias,
+		Blocked:   make([]string, 0, BLOCKED_INITIAL),
+		NextOrder: 1,
+		Unacked:   make(map[string]*unackedMessage),
+		Channels:  make(map[string]*Channel),
+	}
+}
+
+// storeUser writes a user that starts from nothing, whatever the store had
+// for him is gone
+func (s *Server) storeUser(usr *User) {
+	err := s.store.PutUser(store.UserRecord{Alias: usr.Alias})
+	if err != nil {
+		log.Println("[Server] Couldn't store user", usr.Alias, err)
+	}
+}
+
+// storedPending is a pending message as it's stored. The message is in
+// JSON, whatever codec it goes in later
+type storedPending struct {
+	Origin *origin `json:",omitempty"`
+	Msg    json.RawMessage
+}
+
+func encodePending(p *pendingMessage) ([]byte, error) {
+	msg, err := message.JSON.Marshal(p.Msg)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(storedPending{Origin: p.Origin, Msg: msg})
+}
+
+func decodePending(e store.Entry) (*pendingMessage, error) {
+	var sp storedPending
+	err := json.Unmarshal(e.Data, &sp)
+	if err != nil {
+		return nil, err
+	}
+	_, m, err := message.DecodeServerMessage(sp.Msg)
+	if err != nil {
+		return nil, err
+	}
+	return &pendingMessage{Msg: m.Message(), Id: e.Id, Saved: e.Time, Origin: sp.Origin}, nil
+}
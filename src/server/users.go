@@ -0,0 +1,395 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"message"
+	"net"
+	"strings"
+	"time"
+)
+
+type User struct {
+	Alias   string
+	Address *net.UDPAddr
+	Online  bool
+	Blocked []string
+	Pending []*pendingMessage // Oldest first
+	Codec   message.Codec     // What we write to him, picked at login
+
+	// Negotiated at login
+	Version      int
+	Capabilities []string
+
+	// Session he signs his messages with, if he can
+	Token string
+	// What others encrypt their messages to him with, base64
+	PublicKey string
+	// When he got his nickname, direct messages from before were for
+	// someone else. Zero if we don't know
+	Joined time.Time
+	// Channels he is in, by name
+	Channels map[string]*Channel
+
+	// Order for the next message that needs to be shown in order, and
+	// the last ORDER_HISTORY of them in case he asks for one again
+	NextOrder uint64
+	Sent      [ORDER_HISTORY]orderedMessage
+
+	// Messages he hasn't confirmed yet, by id
+	Unacked map[string]*unackedMessage
+}
+
+// unackedMessage is sent again with backoff until the user acks it.
+// Msg is kept so it can go to Pending when we give up
+type unackedMessage struct {
+	Msg      interface{}
+	Bytes    []byte
+	Order    uint64 // 0 if it doesn't go in order
+	Attempts int
+	NextTry  time.Time
+	Origin   *origin
+	Queued   bool // It came from Pending and is still there until he acks it
+}
+
+// pendingMessage waits for a user who isn't there, until he acks it or
+// it's too old
+type pendingMessage struct {
+	Msg    interface{}
+	Id     string // What he acks it with
+	Saved  time.Time
+	Origin *origin
+}
+
+// origin is who sent a message to a user and the id he sent it with. He
+// hears about it if it can't wait or, if Receipt, when it's delivered or
+// expires
+type origin struct {
+	From    string
+	Ref     string
+	Receipt bool
+}
+
+type orderedMessage struct {
+	Order uint64
+	Bytes []byte
+}
+
+// dedupWindow remembers the last DEDUP_WINDOW sequence numbers of a sender
+// and the ack we answered each one with. The numbers are only good for the
+// instance that sent them, a new process with the same token starts again
+type dedupWindow struct {
+	Instance string
+	Highest  uint64
+	Acks     map[uint64][]byte
+	LastUsed time.Time
+}
+
+// ****** Server helpers  ****** //
+
+var errLoginTaken = errors.New("Login already taken, choose a different one")
+var errWrongPassword = errors.New("Wrong password for that nickname")
+var errChannelNick = errors.New("Nicknames can't start with #, those are channels")
+
+// registerUser assumes that a user already was already chec
+func (s *Server) registerUser(who *net.UDPAddr, loginMessage *message.Login) error {
+	alias := loginMessage.Nickname
+	if strings.HasPrefix(alias, "#") {
+		return errChannelNick
+	}
+	// Registered nicknames had their password checked before they got
+	// here, or anyone could read their offline messages
+	_, hasAccount := s.accounts.Get(alias)
+	// Check that he doesn't exist already
+	var usr *User
+	usr, isAlreadyRegistered := s.users[alias]
+	if isAlreadyRegistered && usr.Online {
+		// That login is already used, choose a different one
+		return errLoginTaken
+	}
+	if !isAlreadyRegistered {
+		usr = s.addUser(alias)
+	} else if !hasAccount {
+		// Nothing says this is the same guest as before, so whatever
+		// was waiting for him or he blocked isn't for this one
+		usr = s.startOver(usr)
+	}
+	// Update to new status
+	usr.Address = who
+	usr.Online = true
+	s.connections[who.String()] = usr
+	usr.Version, _ = message.NegotiateVersion(loginMessage.Versions, message.Versions)
+	usr.Capabilities = message.CommonCapabilities(loginMessage.Capabilities, message.Capabilities)
+	usr.Codec = message.DefaultCodec
+	if usr.can(message.CAP_CODEC) {
+		usr.Codec = message.NegotiateCodec(loginMessage.Codecs, usr.Version)
+	}
+	// New session, his numbering may start over
+	delete(s.seenMessages, alias)
+	s.endSession(usr)
+	if usr.can(message.CAP_SESSION) {
+		usr.Token = newToken()
+		s.sessions[usr.Token] = usr
+	}
+	// Login response goes first, it tells him from where we count
+	s.joinDefault(usr, hasAccount)
+	m := message.NewLoginResponse(who.Port, usr.NextOrder, usr.Codec.Name(), usr.Version, usr.Capabilities, usr.Token)
+	m.Channel = s.config.DefaultChannel
+	s.sendMessageToUser(usr, &m)
+	s.sendPendingMessages(usr)
+	return nil
+}
+
+// session finds who sent a message. Users that agreed on sessions are
+// known by their token, wherever it comes from, and the rest by their
+// address
+func (s *Server) session(who *net.UDPAddr, token string) *User {
+	if token != "" {
+		usr, ok := s.sessions[token]
+		if !ok {
+			log.Println("[Server] Unknown session from", who)
+			return nil
+		}
+		return usr
+	}
+	usr, ok := s.connections[who.String()]
+	if !ok || usr.can(message.CAP_SESSION) {
+		// He has a session, without it it isn't him
+		return nil
+	}
+	return usr
+}
+
+// moved tells if a session came from somewhere else than where the user
+// is, or if he was taken as offline
+func (s *Server) moved(usr *User, who *net.UDPAddr) bool {
+	return !usr.Online || usr.Address.String() != who.String()
+}
+
+// migrate moves a user to the address his token came from. If we had
+// taken him as offline he is back
+func (s *Server) migrate(usr *User, who *net.UDPAddr) {
+	log.Println("[Server] Moving", usr.Alias, "from", usr.Address, "to", who)
+	if s.connections[usr.Address.String()] == usr {
+		delete(s.connections, usr.Address.String())
+	}
+	usr.Address = who
+	s.connections[who.String()] = usr
+	wasOnline := usr.Online
+	usr.Online = true
+	// He may be a new process that knows nothing but the token, so he
+	// gets the login response again. It counts from the oldest message he
+	// hasn't confirmed, those are still coming
+	m := message.NewLoginResponse(who.Port, resumeOrder(usr), usr.Codec.Name(), usr.Version, usr.Capabilities, usr.Token)
+	m.Channel = s.config.DefaultChannel
+	s.sendMessageToUser(usr, &m)
+	if !wasOnline {
+		s.sendPendingMessages(usr)
+	}
+}
+
+// resumeOrder is the order of the oldest message the user may not have
+func resumeOrder(usr *User) uint64 {
+	order := usr.NextOrder
+	for _, u := range usr.Unacked {
+		if u.Order != 0 && u.Order < order {
+			order = u.Order
+		}
+	}
+	return order
+}
+
+// addUser makes a user that was never seen, offline until he logs in
+func (s *Server) addUser(alias string) *User {
+	usr := newUser(alias)
+	usr.Joined = time.Now()
+	s.users[usr.Alias] = usr
+	s.storeUser(usr)
+	return usr
+}
+
+// startOver forgets an offline guest, whoever gets his nickname next is
+// somebody else and gets nothing of what he had: pending messages, blocks,
+// channels or roles
+func (s *Server) startOver(usr *User) *User {
+	log.Println("[Server] Guest", usr.Alias, "starts over")
+	s.endSession(usr)
+	s.dropPending(usr)
+	err := s.store.ClearPending(usr.Alias)
+	if err != nil {
+		log.Println("[Server] Couldn't clear the stored messages of", usr.Alias, err)
+	}
+	s.partAll(usr)
+	return s.addUser(usr.Alias)
+}
+
+// endSession forgets the token of the user, it isn't good anymore
+func (s *Server) endSession(usr *User) {
+	if usr.Token == "" {
+		return
+	}
+	delete(s.sessions, usr.Token)
+	usr.Token = ""
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		// Without randomness the token could be guessed
+		panic("Can't make a session token: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+func (s *Server) disconnectUser(who *net.UDPAddr) {
+	usr, ok := s.connections[who.String()]
+	if ok {
+		// User already known, set as offline
+		usr.Online = false
+		delete(s.seenMessages, usr.Alias)
+		// Whatever he didn't confirm he gets when he comes back
+		for id, u := range usr.Unacked {
+			delete(usr.Unacked, id)
+			s.requeue(usr, u)
+		}
+	}
+	delete(s.connections, who.String())
+	delete(s.seenMessages, who.String())
+}
+
+func (s *Server) blockUser(blocker string, blocked string) {
+	// Get both users
+	I, ok := s.users[blocker]
+	if !ok {
+		log.Println("[Server] Couldn't get the current alias for blocking", blocker)
+		return
+	}
+	_, ok = s.users[blocked]
+	if !ok {
+		log.Println("[Server] You can't block a user that is not registered!, you tried to block", blocked)
+	}
+
+	// Blocking twice is the same as blocking once
+	for _, alias := range I.Blocked {
+		if alias == blocked {
+			return
+		}
+	}
+	I.Blocked = append(I.Blocked, blocked)
+	err := s.store.Block(blocker, blocked)
+	if err != nil {
+		log.Println("[Server] Couldn't store that", blocker, "blocked", blocked, err)
+	}
+}
+
+// sendError tells who what went wrong. ref is the id of the message
+// that caused it, if we know it
+func (s *Server) sendError(who *net.UDPAddr, code message.ErrorCode, ref string, msg string) {
+	errMsg := message.NewErrorMessage(code, ref, msg)
+	s.sendErrorMessage(who, &errMsg)
+}
+
+func (s *Server) sendErrorMessage(who *net.UDPAddr, errMsg *message.ErrorMessage) {
+	log.Println("[Server] Sending error to ", who.String())
+	log.Println("[Server] Message", errMsg.Message)
+	m, err := s.codecFor(who).Marshal(errMsg)
+	if err != nil {
+		// server error
+		log.Println("[Server] Server error sending broadcast", err.Error())
+		return
+	}
+	// Don't buffer error messages
+	s.sendMessage(who, m)
+}
+
+// can tells if the user agreed on using a capability at login
+func (u *User) can(c string) bool {
+	return message.HasCapability(u.Capabilities, c)
+}
+
+// codecFor is what we write to an address, XML if he didn't login
+func (s *Server) codecFor(who *net.UDPAddr) message.Codec {
+	usr, ok := s.connections[who.String()]
+	if !ok || usr.Codec == nil {
+		return message.DefaultCodec
+	}
+	return usr.Codec
+}
+
+func (s *Server) isUserConnected(who *net.UDPAddr) (*User, bool) {
+	val, ok := s.connections[who.String()]
+	return val, ok
+}
+
+// dedupKey is the alias once the sender logged in, before that all
+// we know is his address
+func (s *Server) dedupKey(who *net.UDPAddr) string {
+	usr, ok := s.connections[who.String()]
+	if ok {
+		return usr.Alias
+	}
+	return who.String()
+}
+
+// isDuplicate tells if the message with seq from instance was already
+// handled, and if so the ack we sent back then. Anything older than the
+// window is taken as a duplicate too, we can't know
+func (s *Server) isDuplicate(key string, instance string, seq uint64) ([]byte, bool) {
+	if seq == 0 {
+		// Sender doesn't number his messages
+		return nil, false
+	}
+	w, ok := s.seenMessages[key]
+	if !ok || w.Instance != instance {
+		return nil, false
+	}
+	if ack, ok := w.Acks[seq]; ok {
+		return ack, true
+	}
+	if seq+DEDUP_WINDOW <= w.Highest {
+		return nil, true
+	}
+	return nil, false
+}
+
+func (s *Server) recordMessage(key string, instance string, seq uint64, ack []byte, now time.Time) {
+	if seq == 0 {
+		return
+	}
+	w, ok := s.seenMessages[key]
+	if !ok || w.Instance != instance {
+		// What the one before sent says nothing about this one
+		w = &dedupWindow{Instance: instance, Acks: make(map[uint64][]byte, DEDUP_WINDOW)}
+		s.seenMessages[key] = w
+	}
+	w.LastUsed = now
+	w.Acks[seq] = ack
+	if seq <= w.Highest {
+		return
+	}
+	w.Highest = seq
+	// Slide the window
+	for old := range w.Acks {
+		if old+DEDUP_WINDOW <= w.Highest {
+			delete(w.Acks, old)
+		}
+	}
+}
+
+// forgetIdleWindows drops the windows nobody used for a while. Anything
+// can send from any address, so without it the ones of addresses that
+// never logged in would pile up. Users that are online keep theirs
+func (s *Server) forgetIdleWindows(now time.Time) {
+	for key, w := range s.seenMessages {
+		if now.Sub(w.LastUsed) < DEDUP_IDLE {
+			continue
+		}
+		if usr, ok := s.users[key]; ok && usr.Online {
+			continue
+		}
+		delete(s.seenMessages, key)
+	}
+}
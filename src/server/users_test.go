@@ -0,0 +1,182 @@
+package server
+
+import (
+	"client"
+	"message"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDedupRepeated(t *testing.T) {
+	s := New(Config{})
+	now := time.Now()
+	s.recordMessage("alice", "one", 1, []byte("ack 1"), now)
+	s.recordMessage("alice", "one", 2, []byte("ack 2"), now)
+
+	// A retry gets the same ack we sent the first time
+	if ack, dup := s.isDuplicate("alice", "one", 2); !dup || string(ack) != "ack 2" {
+		t.Errorf("A retry of 2 gave %v and %q", dup, ack)
+	}
+	if _, dup := s.isDuplicate("alice", "one", 3); dup {
+		t.Error("A new one is a duplicate")
+	}
+	if _, dup := s.isDuplicate("bob", "one", 1); dup {
+		t.Error("Someone else's is a duplicate")
+	}
+	// A new process with his token counts from 1 again
+	if _, dup := s.isDuplicate("alice", "two", 2); dup {
+		t.Error("Another instance's 2 is a duplicate")
+	}
+	s.recordMessage("alice", "two", 1, []byte("ack 1 of two"), now)
+	if ack, dup := s.isDuplicate("alice", "two", 1); !dup || string(ack) != "ack 1 of two" {
+		t.Errorf("A retry of 1 of the new instance gave %v and %q", dup, ack)
+	}
+	// Old clients don't number their messages, nothing of theirs is repeated
+	s.recordMessage("alice", "one", 0, []byte("ack"), now)
+	if _, dup := s.isDuplicate("alice", "one", 0); dup {
+		t.Error("An unnumbered one is a duplicate")
+	}
+}
+
+func TestDedupWindowSlides(t *testing.T) {
+	s := New(Config{})
+	now := time.Now()
+	s.recordMessage("alice", "one", 1, []byte("ack 1"), now)
+	s.recordMessage("alice", "one", 3, []byte("ack 3"), now)
+	// Came late, but we never saw it
+	if _, dup := s.isDuplicate("alice", "one", 2); dup {
+		t.Error("2 is a duplicate before it came")
+	}
+
+	last := uint64(DEDUP_WINDOW + 2)
+	s.recordMessage("alice", "one", last, []byte("ack"), now)
+	if ack, dup := s.isDuplicate("alice", "one", 3); !dup || string(ack) != "ack 3" {
+		t.Errorf("3 is still in the window, got %v and %q", dup, ack)
+	}
+	// Too old to tell, so it's taken as seen. We don't have its ack anymore
+	if ack, dup := s.isDuplicate("alice", "one", 2); !dup || ack != nil {
+		t.Errorf("2 fell out of the window, got %v and %q", dup, ack)
+	}
+	if n := len(s.seenMessages["alice"].Acks); n > DEDUP_WINDOW {
+		t.Errorf("%d acks kept", n)
+	}
+}
+
+func TestForgetIdleWindows(t *testing.T) {
+	s := New(Config{})
+	now := time.Now()
+	alice := newUser("alice")
+	alice.Online = true
+	s.users["alice"] = alice
+	s.users["bob"] = newUser("bob")
+	s.recordMessage("alice", "one", 1, nil, now)
+	s.recordMessage("bob", "one", 1, nil, now)
+	// Before the login the window is the address
+	s.recordMessage("127.0.0.1:9", "one", 1, nil, now)
+	s.recordMessage("127.0.0.1:10", "one", 1, nil, now.Add(DEDUP_IDLE/2))
+
+	s.forgetIdleWindows(now.Add(DEDUP_IDLE))
+	if _, ok := s.seenMessages["alice"]; !ok {
+		t.Error("Forgot the window of someone online")
+	}
+	if _, ok := s.seenMessages["bob"]; ok {
+		t.Error("Kept the window of someone who left")
+	}
+	if _, ok := s.seenMessages["127.0.0.1:9"]; ok {
+		t.Error("Kept the window of an idle address")
+	}
+	if _, ok := s.seenMessages["127.0.0.1:10"]; !ok {
+		t.Error("Forgot the window of an address in use")
+	}
+}
+
+// rawAsk sends m on conn until an answer want likes comes, with the cookie
+// if the server asks for one
+func rawAsk(t *testing.T, conn *net.UDPConn, m message.Cookied, want func(p *message.ServerPackage) bool) *message.ServerPackage {
+	t.Helper()
+	for tries := 0; tries < 2; tries++ {
+		b, err := message.XML.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(b)
+		for got := readRaw(conn, time.Second); got != nil; got = readRaw(conn, time.Second) {
+			_, p, err := message.DecodeServerMessage(got)
+			if err != nil {
+				continue
+			}
+			if p.Challenge != nil {
+				m.SetCookie(p.Challenge.Cookie)
+				break
+			}
+			if want(p) {
+				return p
+			}
+		}
+	}
+	t.Fatal("No answer")
+	return nil
+}
+
+func ackOf(id string) func(p *message.ServerPackage) bool {
+	return func(p *message.ServerPackage) bool {
+		return p.Ack != nil && len(p.Ack.Ids) == 1 && p.Ack.Ids[0] == id
+	}
+}
+
+// Another process with the same token numbers its messages from 1 again,
+// they aren't taken for the ones of the process before
+func TestDedupNewInstance(t *testing.T) {
+	s := startServer(t, Config{})
+	bob := loginAs(t, s, "bob", client.Config{})
+
+	first := rawConn(t, s)
+	login := message.NewLogin("alice")
+	login.Id, login.Seq = "first-process-1", 1
+	p := rawAsk(t, first, &login, func(p *message.ServerPackage) bool { return p.Login != nil })
+	token := p.Login.Session
+	said := message.NewBroadcast("from the first one")
+	said.Id, said.Seq, said.Token = "first-process-2", 2, token
+	rawAsk(t, first, &said, ackOf(said.Id))
+	waitEvent(t, bob, client.BROADCAST_E, 2*time.Second)
+
+	second := rawConn(t, s)
+	said = message.NewBroadcast("from the second one")
+	said.Id, said.Seq, said.Token = "second-process-2", 2, token
+	rawAsk(t, second, &said, ackOf(said.Id))
+	e := waitEvent(t, bob, client.BROADCAST_E, 2*time.Second)
+	if e.From != "alice" || e.Message != "from the second one" {
+		t.Errorf("Got %q from %q", e.Message, e.From)
+	}
+}
+
+// A client that knows nothing but the token picks up the session from
+// another address, and what is for alice goes there from then on
+func TestSessionResume(t *testing.T) {
+	s := startServer(t, Config{})
+	alice := loginAs(t, s, "alice", client.Config{})
+	bob := loginAs(t, s, "bob", client.Config{})
+
+	moved := dialServer(t, s, client.Config{Token: alice.Session()})
+	moved.Broadcast("from my new port")
+	waitEvent(t, moved, client.LOGIN_E, 2*time.Second)
+	e := waitEvent(t, bob, client.BROADCAST_E, 2*time.Second)
+	if e.From != "alice" || e.Message != "from my new port" {
+		t.Errorf("Got %q from %q", e.Message, e.From)
+	}
+	if moved.Session() != alice.Session() {
+		t.Error("The session changed when it moved")
+	}
+
+	bob.DirectMessage("alice", "where are you")
+	e = waitEvent(t, moved, client.DM_E, 2*time.Second)
+	if e.From != "bob" || e.Message != "where are you" {
+		t.Errorf("Got %q from %q", e.Message, e.From)
+	}
+
+	// A token nobody was given is nobody
+	forged := dialServer(t, s, client.Config{Token: "0123456789abcdef"})
+	forged.Broadcast("it's me, alice")
+	waitError(t, forged, message.ERR_NOT_LOGGED_IN)
+}
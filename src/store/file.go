@@ -0,0 +1,268 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// File is a Store in a log, each change is a line of JSON added at the
+// end. Opening it plays the log again into a Memory, which is what gets
+// read from.
+//
+// Every line is written before the change is made, so whatever a crash
+// leaves is at most a half line at the end, and that one never happened.
+// When the log is much longer than what's in it, it's written again with
+// only what's left
+const (
+	COMPACT_MIN = 1000 // Logs shorter than this are never written again
+
+	OP_PUT     = "put"
+	OP_REMOVE  = "remove"
+	OP_BLOCK   = "block"
+	OP_PENDING = "pending"
+	OP_DONE    = "done"
+	OP_CLEAR   = "clear"
+	OP_HISTORY = "history"
+)
+
+var ErrCorrupt = errors.New("The store has a line that isn't a change")
+
+// A line of the log
+type op struct {
+	Op           string
+	Alias        string      `json:",omitempty"`
+	Blocked      string      `json:",omitempty"`
+	Id           string      `json:",omitempty"`
+	User         *UserRecord `json:",omitempty"`
+	Conversation string      `json:",omitempty"`
+	Entry        *Entry      `json:",omitempty"`
+}
+
+type File struct {
+	// Guards the log, mem has its own
+	mutex   sync.Mutex
+	path    string
+	file    *os.File
+	records int
+	mem     *Memory
+}
+
+// OpenFile reads the store in path, or starts one there if there isn't
+func OpenFile(path string) (*File, error) {
+	f := &File{path: path, mem: NewMemory()}
+	err := f.replay()
+	if err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	// Starts clean, without what was undone or a half line
+	err = f.compact()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) Users() ([]UserRecord, error) {
+	return f.mem.Users()
+}
+
+func (f *File) PutUser(u UserRecord) error {
+	return f.write(op{Op: OP_PUT, User: &u})
+}
+
+func (f *File) RemoveUser(alias string) error {
+	return f.write(op{Op: OP_REMOVE, Alias: alias})
+}
+
+func (f *File) Block(blocker string, blocked string) error {
+	return f.write(op{Op: OP_BLOCK, Alias: blocker, Blocked: blocked})
+}
+
+func (f *File) AddPending(alias string, e Entry) error {
+	return f.write(op{Op: OP_PENDING, Alias: alias, Entry: &e})
+}
+
+func (f *File) RemovePending(alias string, id string) error {
+	return f.write(op{Op: OP_DONE, Alias: alias, Id: id})
+}
+
+func (f *File) ClearPending(alias string) error {
+	return f.write(op{Op: OP_CLEAR, Alias: alias})
+}
+
+func (f *File) AddHistory(conversation string, e Entry) error {
+	return f.write(op{Op: OP_HISTORY, Conversation: conversation, Entry: &e})
+}
+
+func (f *File) History(conversation string) ([]Entry, error) {
+	return f.mem.History(conversation)
+}
+
+func (f *File) Conversations() ([]string, error) {
+	return f.mem.Conversations()
+}
+
+func (f *File) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.file.Close()
+}
+
+// write adds o to the log and then makes the change
+func (f *File) write(o op) error {
+	b, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	// All of it in one write, so it's there whole or cut at the end
+	_, err = f.file.Write(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+	err = f.mem.apply(o)
+	if err != nil {
+		return err
+	}
+	f.records++
+	if f.records > COMPACT_MIN && f.records > 2*f.mem.size() {
+		return f.compact()
+	}
+	return nil
+}
+
+// replay plays the log into mem
+func (f *File) replay() error {
+	file, err := os.Open(f.path)
+	if os.IsNotExist(err) {
+		// Nothing was stored yet
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// Anything left is a line a crash cut
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var o op
+		err = json.Unmarshal(line, &o)
+		if err != nil {
+			return ErrCorrupt
+		}
+		err = f.mem.apply(o)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// compact writes a new log with only what's in mem and puts it in place of
+// the old one. It must be called with the mutex held
+func (f *File) compact() error {
+	users, err := f.mem.Users()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	records := 0
+	for i := range users {
+		err = enc.Encode(op{Op: OP_PUT, User: &users[i]})
+		if err != nil {
+			break
+		}
+		records++
+	}
+	conversations, _ := f.mem.Conversations()
+	for _, conversation := range conversations {
+		if err != nil {
+			break
+		}
+		entries, _ := f.mem.History(conversation)
+		for i := range entries {
+			err = enc.Encode(op{Op: OP_HISTORY, Conversation: conversation, Entry: &entries[i]})
+			if err != nil {
+				break
+			}
+			records++
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.file = file
+	f.records = records
+	return nil
+}
+
+// apply makes the change of a line of the log
+func (m *Memory) apply(o op) error {
+	switch o.Op {
+	case OP_PUT:
+		if o.User == nil {
+			return ErrCorrupt
+		}
+		return m.PutUser(*o.User)
+	case OP_REMOVE:
+		return m.RemoveUser(o.Alias)
+	case OP_BLOCK:
+		return m.Block(o.Alias, o.Blocked)
+	case OP_PENDING:
+		if o.Entry == nil {
+			return ErrCorrupt
+		}
+		return m.AddPending(o.Alias, *o.Entry)
+	case OP_DONE:
+		return m.RemovePending(o.Alias, o.Id)
+	case OP_CLEAR:
+		return m.ClearPending(o.Alias)
+	case OP_HISTORY:
+		if o.Entry == nil {
+			return ErrCorrupt
+		}
+		return m.AddHistory(o.Conversation, *o.Entry)
+	}
+	return ErrCorrupt
+}
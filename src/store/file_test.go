@@ -0,0 +1,187 @@
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// logPath is where a test keeps its log, gone when the test ends
+func logPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "store.log")
+}
+
+func open(t *testing.T, path string) *File {
+	f, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func lines(t *testing.T, path string) int {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(b, []byte("\n"))
+}
+
+// Everything comes back after a restart, and after the one after it when
+// the log is the compacted one
+func TestFileReopen(t *testing.T) {
+	path := logPath(t)
+	at := time.Date(2020, 5, 6, 7, 8, 9, 0, time.UTC)
+	f := open(t, path)
+	f.PutUser(UserRecord{Alias: "bob"})
+	f.Block("alice", "bob")
+	f.Block("alice", "bob")
+	f.AddPending("bob", Entry{Id: "1", Time: at, Data: []byte("hi bob")})
+	f.AddHistory("#general", Entry{Time: at, Data: []byte("first")})
+	f.AddHistory("alice\x00bob", Entry{Time: at, Data: []byte("between them")})
+	f.AddHistory("#general", Entry{Time: at, Data: []byte("second")})
+	f.Close()
+
+	want := []UserRecord{
+		{Alias: "alice", Blocked: []string{"bob"}},
+		{Alias: "bob", Pending: []Entry{{Id: "1", Time: at, Data: []byte("hi bob")}}},
+	}
+	for i := 0; i < 2; i++ {
+		f = open(t, path)
+		users, _ := f.Users()
+		if !reflect.DeepEqual(users, want) {
+			t.Errorf("Opening %d, users are %+v", i, users)
+		}
+		history, _ := f.History("#general")
+		if len(history) != 2 || string(history[0].Data) != "first" || !history[1].Time.Equal(at) {
+			t.Errorf("Opening %d, history is %+v", i, history)
+		}
+		f.Close()
+	}
+	// The block that was there already isn't kept twice
+	if n := lines(t, path); n != 5 {
+		t.Errorf("The log has %d lines, want 5", n)
+	}
+}
+
+func TestFilePutStartsOver(t *testing.T) {
+	path := logPath(t)
+	f := open(t, path)
+	f.Block("alice", "bob")
+	f.AddPending("alice", Entry{Id: "1", Data: []byte("for alice")})
+	f.PutUser(UserRecord{Alias: "alice"})
+	f.AddPending("carol", Entry{Id: "2", Data: []byte("for carol")})
+	f.ClearPending("carol")
+	f.PutUser(UserRecord{Alias: "dave"})
+	f.RemoveUser("dave")
+	f.Close()
+
+	f = open(t, path)
+	defer f.Close()
+	users, _ := f.Users()
+	want := []UserRecord{{Alias: "alice"}, {Alias: "carol"}}
+	if !reflect.DeepEqual(users, want) {
+		t.Errorf("Users are %+v, want %+v", users, want)
+	}
+	if n := lines(t, path); n != 2 {
+		t.Errorf("What was undone is still in the log, it has %d lines", n)
+	}
+}
+
+// A crash can cut the last line, that one is lost and nothing else
+func TestFileCutLine(t *testing.T) {
+	path := logPath(t)
+	f := open(t, path)
+	f.PutUser(UserRecord{Alias: "alice"})
+	f.Close()
+	log, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.WriteString(`{"Op":"put","User":{"Alias":"bo`)
+	log.Close()
+
+	f = open(t, path)
+	users, _ := f.Users()
+	if len(users) != 1 || users[0].Alias != "alice" {
+		t.Errorf("Users are %+v", users)
+	}
+	// What comes next doesn't get glued to the half line
+	f.PutUser(UserRecord{Alias: "carol"})
+	f.Close()
+	f = open(t, path)
+	defer f.Close()
+	if users, _ := f.Users(); len(users) != 2 {
+		t.Errorf("Users are %+v", users)
+	}
+}
+
+func TestFileCorrupt(t *testing.T) {
+	for _, line := range []string{"not json", `{"Op":"explode"}`, `{"Op":"put"}`} {
+		path := logPath(t)
+		err := ioutil.WriteFile(path, []byte(`{"Op":"put","User":{"Alias":"alice"}}`+"\n"+line+"\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := OpenFile(path); err != ErrCorrupt {
+			t.Errorf("%s gave %v", line, err)
+		}
+		// It's left as it was for someone to look at
+		if b, _ := ioutil.ReadFile(path); !strings.Contains(string(b), line) {
+			t.Errorf("%s isn't in the log anymore", line)
+		}
+	}
+}
+
+// The log is written again once most of it is changes that were undone
+func TestFileCompacts(t *testing.T) {
+	path := logPath(t)
+	f := open(t, path)
+	defer f.Close()
+	for i := 0; i < 3*COMPACT_MIN; i++ {
+		id := strconv.Itoa(i)
+		f.AddPending("alice", Entry{Id: id, Data: []byte("hello")})
+		f.RemovePending("alice", id)
+	}
+	if n := lines(t, path); n > COMPACT_MIN+1 {
+		t.Errorf("The log has %d lines", n)
+	}
+	users, _ := f.Users()
+	if len(users) != 1 || len(users[0].Pending) != 0 {
+		t.Errorf("Users are %+v", users)
+	}
+}
+
+// Pending messages leave one by one as they are acked
+func TestFilePendingDone(t *testing.T) {
+	path := logPath(t)
+	f := open(t, path)
+	for _, id := range []string{"1", "2", "3"} {
+		f.AddPending("alice", Entry{Id: id, Data: []byte("message " + id)})
+	}
+	f.RemovePending("alice", "2")
+	f.RemovePending("alice", "2")
+	f.RemovePending("nobody", "1")
+	f.Close()
+
+	f = open(t, path)
+	defer f.Close()
+	users, _ := f.Users()
+	if len(users) != 1 || len(users[0].Pending) != 2 {
+		t.Fatalf("Users are %+v", users)
+	}
+	if p := users[0].Pending; p[0].Id != "1" || p[1].Id != "3" || string(p[1].Data) != "message 3" {
+		t.Errorf("Pending are %+v", p)
+	}
+}
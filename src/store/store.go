@@ -0,0 +1,211 @@
+package store
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// How many entries each conversation keeps, older ones are forgotten
+const MAX_HISTORY = 1000
+
+// Store is where the server keeps what has to outlive it: its users, who
+// each of them blocked, the messages waiting for them and what was said.
+// Messages go in already marshaled, the store doesn't care what's in them
+type Store interface {
+	// Users gives every user with his blocks and pending messages
+	Users() ([]UserRecord, error)
+	// PutUser adds the user, or replaces him with everything he had
+	PutUser(u UserRecord) error
+	RemoveUser(alias string) error
+
+	Block(blocker string, blocked string) error
+	AddPending(alias string, e Entry) error
+	RemovePending(alias string, id string) error
+	ClearPending(alias string) error
+
+	// History is kept by conversation, whatever the caller says one is
+	AddHistory(conversation string, e Entry) error
+	History(conversation string) ([]Entry, error)
+	Conversations() ([]string, error)
+
+	Close() error
+}
+
+type UserRecord struct {
+	Alias   string
+	Blocked []string `json:",omitempty"`
+	Pending []Entry  `json:",omitempty"`
+}
+
+// Entry is a message and when it was kept. Id is whatever the caller
+// knows it by, pending messages are removed by it
+type Entry struct {
+	Id   string `json:",omitempty"`
+	Time time.Time
+	Data []byte
+}
+
+// ****** Memory  ****** //
+
+// Memory keeps everything in maps, it's gone with the program. It's what
+// the server uses if it isn't given a store, and what File keeps up to
+// date with its log
+type Memory struct {
+	mutex   sync.Mutex
+	users   map[string]*UserRecord
+	history map[string][]Entry
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		users:   make(map[string]*UserRecord),
+		history: make(map[string][]Entry),
+	}
+}
+
+// Users come sorted by alias
+func (m *Memory) Users() ([]UserRecord, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	users := make([]UserRecord, 0, len(m.users))
+	for _, u := range m.users {
+		users = append(users, copyUser(u))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Alias < users[j].Alias })
+	return users, nil
+}
+
+func (m *Memory) PutUser(u UserRecord) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	c := copyUser(&u)
+	m.users[u.Alias] = &c
+	return nil
+}
+
+func (m *Memory) RemoveUser(alias string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.users, alias)
+	return nil
+}
+
+// Block for a user we don't have yet adds him
+func (m *Memory) Block(blocker string, blocked string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	u := m.user(blocker)
+	for _, alias := range u.Blocked {
+		if alias == blocked {
+			return nil
+		}
+	}
+	u.Blocked = append(u.Blocked, blocked)
+	return nil
+}
+
+func (m *Memory) AddPending(alias string, e Entry) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	u := m.user(alias)
+	e.Data = append([]byte{}, e.Data...)
+	u.Pending = append(u.Pending, e)
+	return nil
+}
+
+func (m *Memory) RemovePending(alias string, id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	u, ok := m.users[alias]
+	if !ok {
+		return nil
+	}
+	for i, e := range u.Pending {
+		if e.Id == id {
+			u.Pending = append(u.Pending[:i], u.Pending[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (m *Memory) ClearPending(alias string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if u, ok := m.users[alias]; ok {
+		u.Pending = nil
+	}
+	return nil
+}
+
+func (m *Memory) AddHistory(conversation string, e Entry) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	e.Data = append([]byte{}, e.Data...)
+	h := append(m.history[conversation], e)
+	if len(h) > MAX_HISTORY {
+		// Copied so the forgotten ones don't stay in the array
+		h = append([]Entry{}, h[len(h)-MAX_HISTORY:]...)
+	}
+	m.history[conversation] = h
+	return nil
+}
+
+// History comes oldest first
+func (m *Memory) History(conversation string) ([]Entry, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]Entry{}, m.history[conversation]...), nil
+}
+
+// Conversations are the ones with any history, sorted
+func (m *Memory) Conversations() ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	names := make([]string, 0, len(m.history))
+	for name := range m.history {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+// user must be called with the mutex held
+func (m *Memory) user(alias string) *UserRecord {
+	u, ok := m.users[alias]
+	if !ok {
+		u = &UserRecord{Alias: alias}
+		m.users[alias] = u
+	}
+	return u
+}
+
+// size is how many things there are, what a log of them would have
+// without anything that was undone
+func (m *Memory) size() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	n := 0
+	for _, u := range m.users {
+		n += 1 + len(u.Blocked) + len(u.Pending)
+	}
+	for _, h := range m.history {
+		n += len(h)
+	}
+	return n
+}
+
+func copyUser(u *UserRecord) UserRecord {
+	c := UserRecord{Alias: u.Alias}
+	c.Blocked = append(c.Blocked, u.Blocked...)
+	for _, e := range u.Pending {
+		e.Data = append([]byte{}, e.Data...)
+		c.Pending = append(c.Pending, e)
+	}
+	return c
+}